@@ -13,7 +13,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
 
 	"github.com/gin-gonic/gin"
 	"github.com/missuo/raycast2api/service"
@@ -28,6 +32,9 @@ func main() {
 	// Set Release Mode
 	gin.SetMode(gin.ReleaseMode)
 
-	app := service.Router(config)
-	app.Run(fmt.Sprintf(":%v", config.Port))
+	// Serve until SIGTERM, then drain in-flight requests
+	if err := service.Serve(service.NewConfigStore(config)); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Server error", "error", err)
+		os.Exit(1)
+	}
 }
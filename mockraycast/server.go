@@ -0,0 +1,256 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 14:10:32
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 14:10:32
+ * @FilePath: /raycast2api/mockraycast/server.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+// Package mockraycast provides a stand-in for the Raycast AI backend so the
+// relay can be driven end to end without a real Raycast account. Point
+// RAYCAST_BASE_URL (or Config.RaycastBaseURL) at the server's URL.
+package mockraycast
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// Default upstream paths, matching the real Raycast backend
+const (
+	ChatPath   = "/api/v1/ai/chat_completions"
+	ModelsPath = "/api/v1/ai/models"
+)
+
+// Model is a model advertised by the models endpoint
+type Model struct {
+	Provider  string                 `json:"provider"`
+	Model     string                 `json:"model"`
+	Abilities map[string]interface{} `json:"abilities,omitempty"`
+}
+
+// Message is a message in a Raycast chat request
+type Message struct {
+	Author  string `json:"author"`
+	Content struct {
+		Text        string       `json:"text"`
+		Attachments []Attachment `json:"attachments,omitempty"`
+	} `json:"content"`
+}
+
+// Attachment is an inline file attached to a message
+type Attachment struct {
+	Type     string `json:"type"`
+	MimeType string `json:"mime_type"`
+	Data     string `json:"data"`
+}
+
+// ChatRequest is the chat request received from the relay
+type ChatRequest struct {
+	AdditionalSystemInstructions string    `json:"additional_system_instructions"`
+	Messages                     []Message `json:"messages"`
+	Model                        string    `json:"model"`
+	Provider                     string    `json:"provider"`
+	SystemInstruction            string    `json:"system_instruction"`
+	Temperature                  float64   `json:"temperature"`
+	ThreadID                     string    `json:"thread_id"`
+	MaxTokens                    int       `json:"max_tokens,omitempty"`
+
+	Token string `json:"-"` // Bearer token the request was made with
+}
+
+// Reply describes how the mock answers a chat request
+type Reply struct {
+	Status       int      // HTTP status, 200 when zero
+	Body         string   // Response body for non 200 statuses
+	Chunks       []string // Text of each SSE event
+	FinishReason string   // Finish reason of the last event, "stop" when empty
+}
+
+// Server is a mock Raycast backend
+type Server struct {
+	*httptest.Server
+
+	// Models is returned by the models endpoint
+	Models []Model
+	// Reply decides the answer to each chat request. By default the last
+	// user message is echoed back.
+	Reply func(req ChatRequest) Reply
+	// TokenStatus forces a status code for requests made with a given token,
+	// e.g. 401 or 429 to exercise the token pool. Use SetTokenStatus once
+	// the server is handling requests.
+	TokenStatus map[string]int
+
+	mutex    sync.Mutex
+	requests []ChatRequest
+}
+
+// DefaultModels is the model list served when none is configured
+var DefaultModels = []Model{
+	{Provider: "anthropic", Model: "claude-3-7-sonnet-latest", Abilities: vision},
+	{Provider: "openai", Model: "gpt-4.1", Abilities: vision},
+	{Provider: "openai", Model: "gpt-4o", Abilities: vision},
+	{Provider: "openai_o1", Model: "o3-mini", Abilities: map[string]interface{}{}},
+	{Provider: "google", Model: "gemini-2.0-flash", Abilities: vision},
+}
+
+// vision marks a model as accepting image attachments
+var vision = map[string]interface{}{"vision": map[string]interface{}{}}
+
+// NewServer starts a mock Raycast backend on a local port. Call Close when done.
+func NewServer() *Server {
+	s := &Server{
+		Models:      DefaultModels,
+		Reply:       EchoReply,
+		TokenStatus: make(map[string]int),
+	}
+	s.Server = httptest.NewServer(s.Handler())
+	return s
+}
+
+// Handler returns the HTTP handler of the mock, for use with a custom listener
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(ModelsPath, s.handleModels)
+	mux.HandleFunc(ChatPath, s.handleChat)
+	return mux
+}
+
+// Requests returns the chat requests received so far
+func (s *Server) Requests() []ChatRequest {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]ChatRequest(nil), s.requests...)
+}
+
+// SetTokenStatus forces the status code returned for a token, 0 clears it
+func (s *Server) SetTokenStatus(token string, status int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if status == 0 {
+		delete(s.TokenStatus, token)
+		return
+	}
+	s.TokenStatus[token] = status
+}
+
+// EchoReply answers with the text of the last user message
+func EchoReply(req ChatRequest) Reply {
+	text := ""
+	for i := len(req.Messages) - 1; i >= 0; i-- {
+		if req.Messages[i].Author == "user" {
+			text = req.Messages[i].Content.Text
+			break
+		}
+	}
+	return Reply{Chunks: splitWords("Echo: " + text)}
+}
+
+// TextReply answers every request with the given text, streamed word by word
+func TextReply(text string) func(ChatRequest) Reply {
+	return func(ChatRequest) Reply {
+		return Reply{Chunks: splitWords(text)}
+	}
+}
+
+// checkToken validates the bearer token and applies forced statuses
+func (s *Server) checkToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		http.Error(w, `{"error":"unauthorized"}`, http.StatusUnauthorized)
+		return "", false
+	}
+
+	s.mutex.Lock()
+	status := s.TokenStatus[token]
+	s.mutex.Unlock()
+	if status != 0 && status != http.StatusOK {
+		http.Error(w, fmt.Sprintf(`{"error":"forced status %d"}`, status), status)
+		return "", false
+	}
+	return token, true
+}
+
+// handleModels serves the model list
+func (s *Server) handleModels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if _, ok := s.checkToken(w, r); !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"models": s.Models})
+}
+
+// handleChat answers a chat request with an SSE stream
+func (s *Server) handleChat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token, ok := s.checkToken(w, r)
+	if !ok {
+		return
+	}
+
+	var req ChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":%q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+	req.Token = token
+
+	s.mutex.Lock()
+	s.requests = append(s.requests, req)
+	s.mutex.Unlock()
+
+	reply := s.Reply(req)
+	if reply.Status != 0 && reply.Status != http.StatusOK {
+		http.Error(w, reply.Body, reply.Status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+
+	for _, chunk := range reply.Chunks {
+		data, _ := json.Marshal(map[string]string{"text": chunk})
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	finishReason := reply.FinishReason
+	if finishReason == "" {
+		finishReason = "stop"
+	}
+	data, _ := json.Marshal(map[string]string{"text": "", "finish_reason": finishReason})
+	fmt.Fprintf(w, "data: %s\n\n", data)
+	if flusher != nil {
+		flusher.Flush()
+	}
+}
+
+// splitWords splits text into chunks that keep their trailing spaces
+func splitWords(text string) []string {
+	var chunks []string
+	for _, word := range strings.SplitAfter(text, " ") {
+		if word != "" {
+			chunks = append(chunks, word)
+		}
+	}
+	return chunks
+}
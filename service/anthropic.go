@@ -0,0 +1,505 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 11:40:05
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 11:40:05
+ * @FilePath: /raycast2api/service/anthropic.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// handleAnthropicMessages handles the Anthropic Messages API endpoint
+func handleAnthropicMessages(c *gin.Context, config Config) {
+	var body AnthropicMessagesRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		anthropicError(c, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	if len(body.Messages) == 0 {
+		anthropicError(c, http.StatusBadRequest, "invalid_request_error", "messages: field required")
+		return
+	}
+
+	if body.MaxTokens <= 0 {
+		anthropicError(c, http.StatusBadRequest, "invalid_request_error", "max_tokens: field required")
+		return
+	}
+
+	// Reuse the OpenAI conversion so tools and tool results behave the same
+	tools, toolChoice := convertAnthropicTools(body.Tools, body.ToolChoice)
+	toolInstructions := buildToolInstructions(tools, toolChoice)
+	withTools := toolInstructions != ""
+
+	systemPrompt := extractAnthropicText(body.System)
+
+	// Use default model if not specified
+	model := body.Model
+	if model == "" {
+		model = config.DefaultModel
+	}
+
+	raycastMessages, err := convertMessages(config, convertAnthropicMessages(body.Messages))
+	if err != nil {
+		anthropicError(c, http.StatusBadRequest, "invalid_request_error", fmt.Sprintf("Invalid image content: %v", err))
+		return
+	}
+
+	// Send the request, retrying and falling back to other models on failure
+	result, relayErr := relayChat(c, config, raycastChatParams{
+		Model:                        model,
+		Messages:                     raycastMessages,
+		SystemInstruction:            systemPrompt,
+		AdditionalSystemInstructions: toolInstructions,
+		Temperature:                  body.Temperature,
+		MaxTokens:                    body.MaxTokens,
+	})
+	if relayErr != nil {
+		anthropicError(c, relayErr.Status, anthropicErrorType(relayErr.Status), relayErr.Message)
+		return
+	}
+	resp := result.Response
+	defer resp.Body.Close()
+
+	opts := chatResponseOptions{
+		Model:     result.Model,
+		Request:   result.Request,
+		WithTools: withTools,
+	}
+
+	getRequestRecord(c.Request.Context()).setStream(body.Stream)
+	if body.Stream {
+		defer config.Metrics.StreamStarted(c.FullPath())()
+		handleAnthropicStreamingResponse(c, resp, opts, body.StopSequences)
+	} else {
+		handleAnthropicNonStreamingResponse(c, resp, opts, body.StopSequences)
+	}
+}
+
+// handleAnthropicNonStreamingResponse collects the Raycast reply into a message
+func handleAnthropicNonStreamingResponse(c *gin.Context, response *http.Response, opts chatResponseOptions, stopSequences []string) {
+	stopFilter := newStopSequenceFilter(stopSequences)
+	finishReason := ""
+	var reportedUsage *RaycastUsage
+
+	var fullText strings.Builder
+	err := readRaycastEvents(response.Body, func(data RaycastSSEData) bool {
+		if data.FinishReason != "" {
+			finishReason = data.FinishReason
+		}
+		if data.Usage != nil {
+			reportedUsage = data.Usage
+		}
+		fullText.WriteString(stopFilter.Feed(data.Text))
+		_, stopped := stopFilter.Stopped()
+		return !stopped
+	})
+	if err != nil {
+		if clientDisconnected(c) {
+			logCancelledRequest(c, opts.Model)
+			return
+		}
+		anthropicError(c, http.StatusInternalServerError, "api_error", fmt.Sprintf("Error reading response body: %v", err))
+		return
+	}
+	fullText.WriteString(stopFilter.Flush())
+
+	text := fullText.String()
+	usage := buildUsage(opts.Request, text, reportedUsage)
+	getRequestRecord(c.Request.Context()).setUsage(opts.Request, usage)
+	logReply(opts, text, usage)
+
+	var toolCalls []OpenAIToolCall
+	if opts.WithTools {
+		text, toolCalls = extractToolCalls(text)
+	}
+
+	content := []AnthropicContentBlock{}
+	if text != "" {
+		content = append(content, AnthropicContentBlock{Type: "text", Text: text})
+	}
+	for _, call := range toolCalls {
+		content = append(content, anthropicToolUseBlock(call))
+	}
+
+	stopSequence, stopped := stopFilter.Stopped()
+	stopReason := anthropicStopReason(finishReason, stopped, len(toolCalls) > 0)
+
+	message := newAnthropicMessage(opts.Model)
+	message.Content = content
+	message.StopReason = &stopReason
+	if stopped {
+		message.StopSequence = &stopSequence
+	}
+	message.Usage = AnthropicUsage{
+		InputTokens:  usage.PromptTokens,
+		OutputTokens: usage.CompletionTokens,
+	}
+
+	c.JSON(http.StatusOK, message)
+}
+
+// handleAnthropicStreamingResponse relays the Raycast stream as Anthropic SSE events
+func handleAnthropicStreamingResponse(c *gin.Context, response *http.Response, opts chatResponseOptions, stopSequences []string) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		slog.Error("Streaming unsupported")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// writeEvent sends a single named SSE event
+	writeEvent := func(event string, data interface{}) {
+		eventData, err := json.Marshal(data)
+		if err != nil {
+			slog.Error("Error marshaling event", "event", event, "error", err)
+			return
+		}
+		fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", event, string(eventData))
+		flusher.Flush()
+	}
+
+	message := newAnthropicMessage(opts.Model)
+	message.Usage.InputTokens = countPromptTokens(opts.Request)
+	writeEvent("message_start", gin.H{"type": "message_start", "message": message})
+	writeEvent("ping", gin.H{"type": "ping"})
+
+	record := getRequestRecord(c.Request.Context())
+
+	// Content blocks are opened lazily and closed when the block type changes
+	blockIndex := -1
+	textBlockOpen := false
+	closeTextBlock := func() {
+		if textBlockOpen {
+			writeEvent("content_block_stop", gin.H{"type": "content_block_stop", "index": blockIndex})
+			textBlockOpen = false
+		}
+	}
+	sendText := func(text string) {
+		if text == "" {
+			return
+		}
+		record.markFirstToken()
+		if !textBlockOpen {
+			blockIndex++
+			textBlockOpen = true
+			writeEvent("content_block_start", gin.H{
+				"type":          "content_block_start",
+				"index":         blockIndex,
+				"content_block": gin.H{"type": "text", "text": ""},
+			})
+		}
+		writeEvent("content_block_delta", gin.H{
+			"type":  "content_block_delta",
+			"index": blockIndex,
+			"delta": gin.H{"type": "text_delta", "text": text},
+		})
+	}
+	sendToolCalls := func(calls []OpenAIToolCall) {
+		for _, call := range calls {
+			record.markFirstToken()
+			closeTextBlock()
+			blockIndex++
+			writeEvent("content_block_start", gin.H{
+				"type":          "content_block_start",
+				"index":         blockIndex,
+				"content_block": gin.H{"type": "tool_use", "id": call.ID, "name": call.Function.Name, "input": gin.H{}},
+			})
+			writeEvent("content_block_delta", gin.H{
+				"type":  "content_block_delta",
+				"index": blockIndex,
+				"delta": gin.H{"type": "input_json_delta", "partial_json": call.Function.Arguments},
+			})
+			writeEvent("content_block_stop", gin.H{"type": "content_block_stop", "index": blockIndex})
+		}
+	}
+
+	var toolParser *toolCallStreamParser
+	if opts.WithTools {
+		toolParser = &toolCallStreamParser{}
+	}
+	emit := func(text string) {
+		if toolParser == nil {
+			sendText(text)
+			return
+		}
+		text, calls := toolParser.Feed(text)
+		sendText(text)
+		sendToolCalls(calls)
+	}
+
+	stopFilter := newStopSequenceFilter(stopSequences)
+	finishReason := ""
+	var completionText strings.Builder
+	var reportedUsage *RaycastUsage
+	err := readRaycastEvents(response.Body, func(data RaycastSSEData) bool {
+		if data.FinishReason != "" {
+			finishReason = data.FinishReason
+		}
+		if data.Usage != nil {
+			reportedUsage = data.Usage
+		}
+		text := stopFilter.Feed(data.Text)
+		completionText.WriteString(text)
+		emit(text)
+		_, stopped := stopFilter.Stopped()
+		return !stopped
+	})
+	if err != nil {
+		if clientDisconnected(c) {
+			logCancelledRequest(c, opts.Model)
+			return
+		}
+		slog.Error("Error reading from response", "error", err)
+	}
+
+	rest := stopFilter.Flush()
+	completionText.WriteString(rest)
+	emit(rest)
+	hasToolCalls := false
+	if toolParser != nil {
+		sendText(toolParser.Flush())
+		hasToolCalls = toolParser.HasToolCalls()
+	}
+	closeTextBlock()
+
+	stopSequence, stopped := stopFilter.Stopped()
+	delta := gin.H{
+		"stop_reason":   anthropicStopReason(finishReason, stopped, hasToolCalls),
+		"stop_sequence": nil,
+	}
+	if stopped {
+		delta["stop_sequence"] = stopSequence
+	}
+	usage := buildUsage(opts.Request, completionText.String(), reportedUsage)
+	record.setUsage(opts.Request, usage)
+	logReply(opts, completionText.String(), usage)
+	writeEvent("message_delta", gin.H{
+		"type":  "message_delta",
+		"delta": delta,
+		"usage": gin.H{"output_tokens": usage.CompletionTokens},
+	})
+	writeEvent("message_stop", gin.H{"type": "message_stop"})
+}
+
+// newAnthropicMessage creates an empty assistant message in Anthropic format
+func newAnthropicMessage(modelId string) AnthropicMessagesResponse {
+	return AnthropicMessagesResponse{
+		ID:      "msg_" + strings.ReplaceAll(uuid.New().String(), "-", ""),
+		Type:    "message",
+		Role:    "assistant",
+		Model:   modelId,
+		Content: []AnthropicContentBlock{},
+	}
+}
+
+// convertAnthropicMessages converts Anthropic messages into OpenAI messages so
+// they can go through the same conversion as chat completions
+func convertAnthropicMessages(messages []AnthropicMessage) []OpenAIMessage {
+	var openaiMessages []OpenAIMessage
+	for _, msg := range messages {
+		blocks, ok := msg.Content.([]interface{})
+		if !ok {
+			openaiMessages = append(openaiMessages, OpenAIMessage{Role: msg.Role, Content: msg.Content})
+			continue
+		}
+
+		var text strings.Builder
+		var images []interface{}
+		var toolCalls []OpenAIToolCall
+		for _, block := range blocks {
+			blockMap, ok := block.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			switch blockMap["type"] {
+			case "text":
+				if value, ok := blockMap["text"].(string); ok {
+					text.WriteString(value)
+				}
+			case "image":
+				if url := anthropicImageURL(blockMap["source"]); url != "" {
+					images = append(images, map[string]interface{}{
+						"type":      "image_url",
+						"image_url": map[string]interface{}{"url": url},
+					})
+				}
+			case "tool_use":
+				call := OpenAIToolCall{Type: "function"}
+				call.ID, _ = blockMap["id"].(string)
+				call.Function.Name, _ = blockMap["name"].(string)
+				arguments, _ := json.Marshal(blockMap["input"])
+				call.Function.Arguments = string(arguments)
+				toolCalls = append(toolCalls, call)
+			case "tool_result":
+				toolUseID, _ := blockMap["tool_use_id"].(string)
+				openaiMessages = append(openaiMessages, OpenAIMessage{
+					Role:       "tool",
+					Content:    extractAnthropicText(blockMap["content"]),
+					ToolCallID: toolUseID,
+				})
+			}
+		}
+
+		if text.Len() > 0 || len(images) > 0 || len(toolCalls) > 0 {
+			var content interface{} = text.String()
+			if len(images) > 0 {
+				// Images travel as OpenAI content parts alongside the text
+				content = append([]interface{}{
+					map[string]interface{}{"type": "text", "text": text.String()},
+				}, images...)
+			}
+			openaiMessages = append(openaiMessages, OpenAIMessage{
+				Role:      msg.Role,
+				Content:   content,
+				ToolCalls: toolCalls,
+			})
+		}
+	}
+	return openaiMessages
+}
+
+// anthropicImageURL converts an Anthropic image source into a data or http URL
+func anthropicImageURL(source interface{}) string {
+	sourceMap, ok := source.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	switch sourceMap["type"] {
+	case "base64":
+		mediaType, _ := sourceMap["media_type"].(string)
+		data, _ := sourceMap["data"].(string)
+		return "data:" + mediaType + ";base64," + data
+	case "url":
+		url, _ := sourceMap["url"].(string)
+		return url
+	}
+	return ""
+}
+
+// convertAnthropicTools converts Anthropic tool definitions and tool choice
+// into their OpenAI equivalents
+func convertAnthropicTools(tools []AnthropicTool, choice *AnthropicToolChoice) ([]OpenAITool, interface{}) {
+	openaiTools := make([]OpenAITool, 0, len(tools))
+	for _, tool := range tools {
+		openaiTools = append(openaiTools, OpenAITool{
+			Type: "function",
+			Function: OpenAIToolFunction{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.InputSchema,
+			},
+		})
+	}
+
+	if choice == nil {
+		return openaiTools, nil
+	}
+	switch choice.Type {
+	case "any":
+		return openaiTools, "required"
+	case "none":
+		return openaiTools, "none"
+	case "tool":
+		return openaiTools, map[string]interface{}{
+			"type":     "function",
+			"function": map[string]interface{}{"name": choice.Name},
+		}
+	}
+	return openaiTools, "auto"
+}
+
+// extractAnthropicText extracts the text of a string or text block array
+func extractAnthropicText(content interface{}) string {
+	switch content := content.(type) {
+	case string:
+		return content
+	case []interface{}:
+		var parts []string
+		for _, block := range content {
+			if blockMap, ok := block.(map[string]interface{}); ok && blockMap["type"] == "text" {
+				if text, ok := blockMap["text"].(string); ok {
+					parts = append(parts, text)
+				}
+			}
+		}
+		return strings.Join(parts, "\n\n")
+	}
+	return ""
+}
+
+// anthropicToolUseBlock converts a parsed tool call into a tool_use block
+func anthropicToolUseBlock(call OpenAIToolCall) AnthropicContentBlock {
+	input := json.RawMessage(call.Function.Arguments)
+	if !json.Valid(input) {
+		input = json.RawMessage("{}")
+	}
+	return AnthropicContentBlock{
+		Type:  "tool_use",
+		ID:    call.ID,
+		Name:  call.Function.Name,
+		Input: input,
+	}
+}
+
+// anthropicStopReason maps the Raycast finish reason to an Anthropic stop reason
+func anthropicStopReason(finishReason string, stopped bool, toolUse bool) string {
+	if stopped {
+		return "stop_sequence"
+	}
+	switch mapFinishReason(finishReason, toolUse) {
+	case "tool_calls":
+		return "tool_use"
+	case "length":
+		return "max_tokens"
+	case "content_filter":
+		return "refusal"
+	}
+	return "end_turn"
+}
+
+// anthropicErrorType maps an HTTP status to an Anthropic error type
+func anthropicErrorType(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "invalid_request_error"
+	case http.StatusUnauthorized:
+		return "authentication_error"
+	case http.StatusForbidden:
+		return "permission_error"
+	case http.StatusNotFound:
+		return "not_found_error"
+	case http.StatusTooManyRequests:
+		return "rate_limit_error"
+	}
+	return "api_error"
+}
+
+// anthropicError writes an error response in Anthropic format
+func anthropicError(c *gin.Context, status int, errType, message string) {
+	var resp AnthropicErrorResponse
+	resp.Type = "error"
+	resp.Error.Type = errType
+	resp.Error.Message = message
+	c.JSON(status, resp)
+}
@@ -0,0 +1,223 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 20:24:17
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 20:24:17
+ * @FilePath: /raycast2api/service/breaker.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states
+const (
+	BreakerClosed   = "closed"    // Requests go through
+	BreakerOpen     = "open"      // Requests fail fast until the open period ends
+	BreakerHalfOpen = "half_open" // A single probe request decides whether to close
+)
+
+// CircuitBreakers tracks the health of every provider/model pair, so models
+// that keep failing inside Raycast are skipped instead of tried every time
+type CircuitBreakers struct {
+	threshold    int           // Consecutive failures that open a breaker, 0 disables them
+	openDuration time.Duration // Time before an open breaker lets a probe through
+	breakers     map[string]*circuitBreaker
+	mutex        sync.Mutex
+}
+
+// circuitBreaker is the breaker of a single provider/model pair
+type circuitBreaker struct {
+	provider    string
+	model       string
+	state       string
+	failures    int // Consecutive failures
+	openedAt    time.Time
+	probing     bool // Whether the half-open probe is in flight
+	lastError   string
+	lastFailure time.Time
+}
+
+// BreakerStatus describes a breaker for the admin API
+type BreakerStatus struct {
+	Provider    string     `json:"provider"`
+	Model       string     `json:"model"`
+	State       string     `json:"state"`
+	Failures    int        `json:"consecutive_failures"`
+	OpenUntil   *time.Time `json:"open_until,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+}
+
+// NewCircuitBreakers creates the breakers of the relay
+func NewCircuitBreakers(threshold int, openDuration time.Duration) *CircuitBreakers {
+	return &CircuitBreakers{
+		threshold:    threshold,
+		openDuration: openDuration,
+		breakers:     make(map[string]*circuitBreaker),
+	}
+}
+
+// SetLimits changes the failure threshold and open duration of the breakers.
+// Breakers keep their state; a threshold of 0 disables them.
+func (b *CircuitBreakers) SetLimits(threshold int, openDuration time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.threshold = threshold
+	b.openDuration = openDuration
+}
+
+// get returns the breaker of a provider/model pair, creating it if needed
+func (b *CircuitBreakers) get(provider, model string) *circuitBreaker {
+	key := provider + "/" + model
+	breaker, ok := b.breakers[key]
+	if !ok {
+		breaker = &circuitBreaker{provider: provider, model: model, state: BreakerClosed}
+		b.breakers[key] = breaker
+	}
+	return breaker
+}
+
+// Allow reports whether a request to a model may be sent. Once the open
+// period is over, the first caller gets through as the half-open probe.
+func (b *CircuitBreakers) Allow(provider, model string) bool {
+	if b == nil {
+		return true
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.threshold <= 0 {
+		return true
+	}
+
+	breaker := b.get(provider, model)
+	switch breaker.state {
+	case BreakerOpen:
+		if time.Since(breaker.openedAt) < b.openDuration {
+			return false
+		}
+		breaker.state = BreakerHalfOpen
+		breaker.probing = true
+		slog.Info("Circuit breaker half-open, probing", "provider", provider, "model", model)
+		return true
+	case BreakerHalfOpen:
+		if breaker.probing {
+			return false
+		}
+		breaker.probing = true
+		return true
+	}
+	return true
+}
+
+// Report records the outcome of a request allowed by Allow
+func (b *CircuitBreakers) Report(provider, model string, relayErr *relayError) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.threshold <= 0 {
+		return
+	}
+
+	breaker := b.get(provider, model)
+	breaker.probing = false
+
+	if relayErr == nil {
+		if breaker.state != BreakerClosed {
+			slog.Info("Circuit breaker closed", "provider", provider, "model", model)
+		}
+		breaker.state = BreakerClosed
+		breaker.failures = 0
+		return
+	}
+	if !relayErr.modelFailure() {
+		// Nothing learnt about the model, a half-open breaker probes again
+		return
+	}
+
+	breaker.failures++
+	breaker.lastError = relayErr.Message
+	breaker.lastFailure = time.Now()
+	if breaker.state == BreakerHalfOpen || breaker.failures >= b.threshold {
+		if breaker.state != BreakerOpen {
+			slog.Warn("Circuit breaker opened", "provider", provider, "model", model,
+				"failures", breaker.failures, "error", relayErr.Message)
+		}
+		breaker.state = BreakerOpen
+		breaker.openedAt = time.Now()
+	}
+}
+
+// modelFailure reports whether an error points at the model or its provider
+// rather than at the token, the client or the request
+func (e *relayError) modelFailure() bool {
+	if e.Type != "relay_error" {
+		return false
+	}
+	return e.Status == http.StatusRequestTimeout || e.Status >= 500
+}
+
+// openError is the error returned while a breaker is open
+func (b *CircuitBreakers) openError(provider, model string) *relayError {
+	return &relayError{
+		Status:  http.StatusServiceUnavailable,
+		Message: fmt.Sprintf("Model %s is temporarily unavailable after repeated upstream failures, try again later or use another model", model),
+		Type:    "model_unavailable",
+		Details: fmt.Sprintf("circuit breaker for %s/%s is open", provider, model),
+	}
+}
+
+// Status describes every breaker that has seen a failure, open ones first
+func (b *CircuitBreakers) Status() []BreakerStatus {
+	statuses := []BreakerStatus{}
+	if b == nil {
+		return statuses
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, breaker := range b.breakers {
+		if breaker.state == BreakerClosed && breaker.failures == 0 && breaker.lastFailure.IsZero() {
+			continue
+		}
+		status := BreakerStatus{
+			Provider:  breaker.provider,
+			Model:     breaker.model,
+			State:     breaker.state,
+			Failures:  breaker.failures,
+			LastError: breaker.lastError,
+		}
+		if breaker.state == BreakerOpen {
+			openUntil := breaker.openedAt.Add(b.openDuration)
+			status.OpenUntil = &openUntil
+		}
+		if !breaker.lastFailure.IsZero() {
+			lastFailure := breaker.lastFailure
+			status.LastFailure = &lastFailure
+		}
+		statuses = append(statuses, status)
+	}
+
+	order := map[string]int{BreakerOpen: 0, BreakerHalfOpen: 1, BreakerClosed: 2}
+	slices.SortFunc(statuses, func(a, b BreakerStatus) int {
+		if a.State != b.State {
+			return order[a.State] - order[b.State]
+		}
+		return strings.Compare(a.Provider+"/"+a.Model, b.Provider+"/"+b.Model)
+	})
+	return statuses
+}
@@ -0,0 +1,445 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 23:05:47
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 23:05:47
+ * @FilePath: /raycast2api/service/completions.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// maxCompletionChoices bounds the choices of a chat or text completion
+// request, as every choice is a separate Raycast request
+const maxCompletionChoices = 16
+
+// admitFanOut charges the rate limit of the client key for the upstream
+// requests of a fan-out beyond the first one, counted when the request was
+// admitted. It answers the request and returns false when they are refused.
+func admitFanOut(c *gin.Context, config Config, requests int) bool {
+	if requests <= 1 {
+		return true
+	}
+	policy := getAPIKeyPolicy(c)
+	if limit := policy.RequestsPerMinute; limit > 0 && requests > limit {
+		message := fmt.Sprintf("This request makes %d upstream requests, more than the limit of %d requests per minute of %s", requests, limit, policy.Name)
+		c.JSON(http.StatusBadRequest, newErrorResponse(message, "invalid_request_error", ""))
+		return false
+	}
+
+	status := config.Keys.Admit(getRequestAPIKey(c), requests-1)
+	status.setHeaders(c)
+	if status.Limited != "" {
+		c.JSON(http.StatusTooManyRequests, newErrorResponse(status.message(policy.Name), "rate_limit_exceeded", status.Limited))
+		return false
+	}
+	return true
+}
+
+// Raycast only chats, so completions are asked for with these instructions
+const (
+	completionInstruction   = "Continue the text given by the user. Reply with the continuation only: do not repeat the text, do not add any commentary or formatting, and stop where the text would naturally end."
+	fillInMiddleInstruction = "The user gives the beginning and the end of a text, in <prefix> and <suffix> tags. Reply with the text that goes between them only: do not repeat the prefix or the suffix, and do not add any tags, commentary or formatting."
+)
+
+// checkBestOf validates best_of against n. Every candidate must be read in
+// full before the best ones are known, so best_of cannot be streamed.
+func checkBestOf(n, bestOf int, stream bool) *relayError {
+	switch {
+	case bestOf < n:
+		return &relayError{
+			Status:  http.StatusBadRequest,
+			Message: fmt.Sprintf("Invalid 'best_of' field: best_of (%d) must be greater than or equal to n (%d)", bestOf, n),
+			Type:    "invalid_request_error",
+		}
+	case stream && bestOf > n:
+		return &relayError{
+			Status:  http.StatusBadRequest,
+			Message: "Invalid 'best_of' field: best_of cannot be used with stream",
+			Type:    "invalid_request_error",
+		}
+	}
+	return nil
+}
+
+// pickBestOf returns the indexes of the n best candidate choices, in order.
+// Raycast returns no log probabilities to rank them, so the choices that
+// finished on their own are preferred to the ones cut short by the token
+// limit or a content filter, and earlier candidates win ties.
+func pickBestOf(finishReasons []string, n int) []int {
+	rank := func(finishReason string) int {
+		if finishReason == "stop" || finishReason == "tool_calls" {
+			return 0
+		}
+		return 1
+	}
+	indexes := make([]int, len(finishReasons))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	slices.SortStableFunc(indexes, func(a, b int) int {
+		return rank(finishReasons[a]) - rank(finishReasons[b])
+	})
+	indexes = indexes[:n]
+	slices.Sort(indexes)
+	return indexes
+}
+
+// handleCompletions handles the legacy OpenAI text completions endpoint.
+// Every prompt becomes a single-turn Raycast chat, sent n times.
+func handleCompletions(c *gin.Context, config Config) {
+	var body OpenAICompletionRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, newErrorResponse("Invalid request body", "invalid_request_error", err.Error()))
+		return
+	}
+
+	prompts, ok := stringList(body.Prompt)
+	if !ok || len(prompts) == 0 {
+		c.JSON(http.StatusBadRequest, newErrorResponse("Missing or invalid 'prompt' field, expected a string or an array of strings", "invalid_request_error", ""))
+		return
+	}
+	stops, ok := stringList(body.Stop)
+	if !ok {
+		c.JSON(http.StatusBadRequest, newErrorResponse("Invalid 'stop' field, expected a string or an array of strings", "invalid_request_error", ""))
+		return
+	}
+
+	n := body.N
+	if n == 0 {
+		n = 1
+	}
+	bestOf := body.BestOf
+	if bestOf == 0 {
+		bestOf = n
+	}
+	if n < 0 || bestOf*len(prompts) > maxCompletionChoices {
+		message := fmt.Sprintf("Too many choices requested: %d prompts with n=%d and best_of=%d, at most %d choices are allowed", len(prompts), n, bestOf, maxCompletionChoices)
+		c.JSON(http.StatusBadRequest, newErrorResponse(message, "invalid_request_error", ""))
+		return
+	}
+	if relayErr := checkBestOf(n, bestOf, body.Stream); relayErr != nil {
+		c.JSON(relayErr.Status, relayErr.toErrorResponse())
+		return
+	}
+
+	// Use default model if not specified
+	model := body.Model
+	if model == "" {
+		model = config.DefaultModel
+	}
+	if !admitFanOut(c, config, bestOf*len(prompts)) {
+		return
+	}
+
+	// Every candidate choice is a separate Raycast request, sent concurrently
+	run := completionRun{
+		ID:      fmt.Sprintf("cmpl-%s", uuid.New().String()),
+		Created: time.Now().Unix(),
+		Echo:    body.Echo,
+		Stops:   stops,
+		N:       n,
+		BestOf:  bestOf,
+		Prompts: make([]string, bestOf*len(prompts)),
+		Results: make([]relayResult, bestOf*len(prompts)),
+	}
+	for i := range run.Prompts {
+		run.Prompts[i] = prompts[i/bestOf]
+	}
+	relayErrs := make([]*relayError, len(run.Results))
+	fanOut(len(run.Results), func(i int) {
+		run.Results[i], relayErrs[i] = relayChat(c, config, completionParams(body, model, run.Prompts[i]))
+	})
+	defer closeRelayResults(run.Results)
+	for _, relayErr := range relayErrs {
+		if relayErr != nil {
+			c.JSON(relayErr.Status, relayErr.toErrorResponse())
+			return
+		}
+	}
+	run.Model = run.Results[0].Model
+
+	getRequestRecord(c.Request.Context()).setStream(body.Stream)
+	if body.Stream {
+		defer config.Metrics.StreamStarted(c.FullPath())()
+		run.stream(c, body.StreamOptions != nil && body.StreamOptions.IncludeUsage)
+	} else {
+		run.respond(c)
+	}
+}
+
+// stringList reads a string or an array of strings. Token arrays and other
+// values are rejected.
+func stringList(value interface{}) ([]string, bool) {
+	switch value := value.(type) {
+	case nil:
+		return nil, true
+	case string:
+		return []string{value}, true
+	case []interface{}:
+		list := make([]string, 0, len(value))
+		for _, item := range value {
+			text, ok := item.(string)
+			if !ok {
+				return nil, false
+			}
+			list = append(list, text)
+		}
+		return list, true
+	}
+	return nil, false
+}
+
+// completionParams wraps a prompt into a single-turn Raycast chat. With a
+// suffix, the model is asked to fill in the middle.
+func completionParams(body OpenAICompletionRequest, model, prompt string) raycastChatParams {
+	instruction, text := completionInstruction, prompt
+	if body.Suffix != "" {
+		instruction = fillInMiddleInstruction
+		text = "<prefix>" + prompt + "</prefix>\n<suffix>" + body.Suffix + "</suffix>"
+	}
+	return raycastChatParams{
+		Model: model,
+		Messages: []RaycastMessage{
+			{Author: "user", Content: RaycastMessageContent{Text: text}},
+		},
+		SystemInstruction: instruction,
+		Temperature:       body.Temperature,
+		MaxTokens:         body.MaxTokens,
+	}
+}
+
+// fanOut calls fn for every index from 0 to n-1 concurrently and waits for all
+func fanOut(n int, fn func(i int)) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// completionRun holds the Raycast replies of a completion request, one per choice
+type completionRun struct {
+	ID      string
+	Created int64
+	Model   string // Model reported to the client
+	Echo    bool   // Whether the prompt is echoed before the completion
+	Stops   []string
+	N       int           // Choices returned for each prompt
+	BestOf  int           // Candidate choices generated for each prompt, at least N
+	Prompts []string      // Prompt of each candidate
+	Results []relayResult // Raycast reply of each candidate
+}
+
+// completionOutcome is a finished completion choice
+type completionOutcome struct {
+	Text         string
+	FinishReason string
+	Usage        OpenAIUsage
+}
+
+// readCompletion reads a Raycast reply up to the first stop sequence, passing
+// the text to emit as it arrives when emit is set
+func readCompletion(body io.Reader, request RaycastChatRequest, stops []string, emit func(string)) (completionOutcome, error) {
+	stopFilter := newStopSequenceFilter(stops)
+	finishReason := ""
+	var reportedUsage *RaycastUsage
+
+	var text strings.Builder
+	send := func(delta string) {
+		text.WriteString(delta)
+		if emit != nil && delta != "" {
+			emit(delta)
+		}
+	}
+	err := readRaycastEvents(body, func(data RaycastSSEData) bool {
+		if data.FinishReason != "" {
+			finishReason = data.FinishReason
+		}
+		if data.Usage != nil {
+			reportedUsage = data.Usage
+		}
+		send(stopFilter.Feed(data.Text))
+		_, stopped := stopFilter.Stopped()
+		return !stopped
+	})
+	send(stopFilter.Flush())
+
+	// Completions only finish with stop, length or content_filter
+	finishReason = mapFinishReason(finishReason, false)
+	if _, stopped := stopFilter.Stopped(); stopped || finishReason == "tool_calls" {
+		finishReason = "stop"
+	}
+	return completionOutcome{
+		Text:         text.String(),
+		FinishReason: finishReason,
+		Usage:        buildUsage(request, text.String(), reportedUsage),
+	}, err
+}
+
+// sumUsage adds up the usage of several Raycast replies
+func sumUsage(usages ...OpenAIUsage) OpenAIUsage {
+	var total OpenAIUsage
+	for _, usage := range usages {
+		total.PromptTokens += usage.PromptTokens
+		total.CompletionTokens += usage.CompletionTokens
+		total.TotalTokens += usage.TotalTokens
+	}
+	return total
+}
+
+// finish records the usage of the finished choices and logs them
+func (r completionRun) finish(c *gin.Context, outcomes []completionOutcome) OpenAIUsage {
+	record := getRequestRecord(c.Request.Context())
+	usages := make([]OpenAIUsage, len(outcomes))
+	for i, outcome := range outcomes {
+		usages[i] = outcome.Usage
+		record.setUsage(r.Results[i].Request, outcome.Usage)
+		logReply(chatResponseOptions{Model: r.Results[i].Model, Request: r.Results[i].Request}, outcome.Text, outcome.Usage)
+	}
+	return sumUsage(usages...)
+}
+
+// respond collects every choice into a text_completion object
+func (r completionRun) respond(c *gin.Context) {
+	outcomes := make([]completionOutcome, len(r.Results))
+	errs := make([]error, len(r.Results))
+	fanOut(len(r.Results), func(i int) {
+		outcomes[i], errs[i] = readCompletion(r.Results[i].Response.Body, r.Results[i].Request, r.Stops, nil)
+	})
+	if err := errors.Join(errs...); err != nil {
+		if clientDisconnected(c) {
+			logCancelledRequest(c, r.Model)
+			return
+		}
+		c.JSON(http.StatusInternalServerError, newErrorResponse("Error reading response body", "server_error", err.Error()))
+		return
+	}
+	usage := r.finish(c, outcomes)
+
+	// Keep the best N candidates of every prompt
+	choices := make([]OpenAICompletionChoice, 0, len(outcomes)/r.BestOf*r.N)
+	for start := 0; start < len(outcomes); start += r.BestOf {
+		finishReasons := make([]string, r.BestOf)
+		for i := range finishReasons {
+			finishReasons[i] = outcomes[start+i].FinishReason
+		}
+		for _, i := range pickBestOf(finishReasons, r.N) {
+			outcome := outcomes[start+i]
+			text := outcome.Text
+			if r.Echo {
+				text = r.Prompts[start+i] + text
+			}
+			finishReason := outcome.FinishReason
+			choices = append(choices, OpenAICompletionChoice{Text: text, Index: len(choices), FinishReason: &finishReason})
+		}
+	}
+
+	c.JSON(http.StatusOK, OpenAICompletionResponse{
+		ID:      r.ID,
+		Object:  "text_completion",
+		Created: r.Created,
+		Model:   r.Model,
+		Choices: choices,
+		Usage:   &usage,
+	})
+}
+
+// stream relays every choice as text_completion chunks. The choices are read
+// concurrently and their chunks interleaved, each carrying its choice index.
+func (r completionRun) stream(c *gin.Context, includeUsage bool) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		slog.Error("Streaming unsupported")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// writeChunk writes a single streaming chunk
+	writeChunk := func(choices []OpenAICompletionChoice, usage *OpenAIUsage) {
+		chunkData, err := json.Marshal(OpenAICompletionResponse{
+			ID:      r.ID,
+			Object:  "text_completion",
+			Created: r.Created,
+			Model:   r.Model,
+			Choices: choices,
+			Usage:   usage,
+		})
+		if err != nil {
+			slog.Error("Error marshaling chunk", "error", err)
+			return
+		}
+		fmt.Fprintf(c.Writer, "data: %s\n\n", string(chunkData))
+		flusher.Flush()
+	}
+
+	// Only this goroutine writes, the readers hand their text over
+	chunks := make(chan OpenAICompletionChoice)
+	outcomes := make([]completionOutcome, len(r.Results))
+	errs := make([]error, len(r.Results))
+	go func() {
+		fanOut(len(r.Results), func(i int) {
+			if r.Echo {
+				chunks <- OpenAICompletionChoice{Text: r.Prompts[i], Index: i}
+			}
+			outcomes[i], errs[i] = readCompletion(r.Results[i].Response.Body, r.Results[i].Request, r.Stops, func(text string) {
+				chunks <- OpenAICompletionChoice{Text: text, Index: i}
+			})
+			finishReason := outcomes[i].FinishReason
+			chunks <- OpenAICompletionChoice{Index: i, FinishReason: &finishReason}
+		})
+		close(chunks)
+	}()
+
+	record := getRequestRecord(c.Request.Context())
+	for chunk := range chunks {
+		if chunk.Text != "" {
+			record.markFirstToken()
+		}
+		writeChunk([]OpenAICompletionChoice{chunk}, nil)
+	}
+	if err := errors.Join(errs...); err != nil {
+		if clientDisconnected(c) {
+			logCancelledRequest(c, r.Model)
+			return
+		}
+		slog.Error("Error reading from response", "error", err)
+	}
+
+	usage := r.finish(c, outcomes)
+	if includeUsage {
+		writeChunk([]OpenAICompletionChoice{}, &usage)
+	}
+
+	// Send final [DONE] marker
+	fmt.Fprintf(c.Writer, "data: [DONE]\n\n")
+	flusher.Flush()
+}
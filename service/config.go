@@ -13,8 +13,13 @@
 package service
 
 import (
-	"log"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -24,20 +29,95 @@ import (
 
 // Configuration constants
 const (
-	RaycastAPIURL    = "https://backend.raycast.com/api/v1/ai/chat_completions"
-	RaycastModelsURL = "https://backend.raycast.com/api/v1/ai/models"
-	UserAgent        = "Raycast/1.96.3 (macOS Version 15.5 (Build 24F5068b))"
-	DefaultProvider  = "anthropic"
-	DefaultModel     = "claude-3-7-sonnet-latest"
-	ModelCacheTTL    = 6 * time.Hour // Cache models for 6 hours
+	DefaultRaycastBaseURL    = "https://backend.raycast.com"
+	DefaultRaycastChatPath   = "/api/v1/ai/chat_completions"
+	DefaultRaycastModelsPath = "/api/v1/ai/models"
+	DefaultUserAgent         = "Raycast/1.96.3 (macOS Version 15.5 (Build 24F5068b))"
+	DefaultLocale            = "en-US"
+	DefaultProvider          = "anthropic"
+	DefaultModel             = "claude-3-7-sonnet-latest"
+	DefaultTemperature       = 0.5
+	DefaultModelCacheTTL     = 6 * time.Hour // Cache models for 6 hours
+	DefaultMaxImageBytes     = 20 << 20      // Largest image accepted in image_url parts
+
+	DefaultMaxRetries     = 2                      // Retries of a failed Raycast request, per model
+	DefaultRetryBaseDelay = 500 * time.Millisecond // Backoff before the first retry
+	DefaultRetryMaxDelay  = 8 * time.Second        // Longest backoff between retries
+
+	DefaultBreakerThreshold    = 5                // Consecutive failures that open a circuit breaker
+	DefaultBreakerOpenDuration = 30 * time.Second // Time before an open breaker lets a probe through
+
+	TokenRateLimitCooldown    = 1 * time.Minute  // Cooldown after a 429 without Retry-After
+	TokenUnauthorizedCooldown = 30 * time.Minute // Cooldown after a 401
+
+	ConfigPollInterval = 2 * time.Second // How often the config file is checked for changes
+
+	DefaultShutdownTimeout = 30 * time.Second // Time in-flight requests get to finish on shutdown
+	ShutdownCancelGrace    = 2 * time.Second  // Time cancelled requests get to clean up after the timeout
+
+	ReadinessCacheTTL = 30 * time.Second // How long the result of a Raycast readiness probe is reused
+
+	DefaultResponseStoreSize = 1000     // Responses kept for previous_response_id
+	ResponseStoreMaxBytes    = 64 << 20 // Approximate memory the kept responses may use
+
+	UsageRecentRecords = 10000 // Latest usage records kept in memory
 )
 
 // Config represents the application configuration
 type Config struct {
-	RaycastBearerToken string
-	APIKey             string
-	ModelCache         *ModelCache
-	Port               string
+	TokenPool         *TokenPool
+	Metrics           *Metrics
+	Keys              *KeyStore    // Client API keys and their policies
+	Usage             *UsageLedger // Record of every completion, for billing
+	APIKey            string
+	AdminKey          string
+	ModelCache        *ModelCache
+	Port              string
+	RaycastBaseURL    string // Upstream base URL, e.g. a local mock or an egress proxy
+	RaycastChatPath   string
+	RaycastModelsPath string
+	RaycastHost       string // Optional Host header override
+	UserAgent         string // User-Agent sent to Raycast
+	Locale            string // Locale of the Raycast chat requests
+
+	DefaultModel        string        // Model used when the client sends none
+	DefaultProvider     string        // Provider of the default model when Raycast does not list it
+	DefaultTemperature  float64       // Temperature used when the client sends none
+	DefaultSystemPrompt string        // System instruction used when the client sends none
+	ModelCacheTTL       time.Duration // How long the Raycast model list is cached
+	MaxImageBytes       int64         // Size limit of images sent in messages
+	AllowRemoteImages   bool          // Whether http(s) image URLs are downloaded by the relay
+
+	MaxRetries     int                 // Retries of a failed Raycast request, per model
+	RetryBaseDelay time.Duration       // Backoff before the first retry, doubled on every retry
+	RetryMaxDelay  time.Duration       // Longest backoff between retries
+	ModelFallbacks map[string][]string // Models tried in order when a model keeps failing
+	ModelRoutes    *ModelRouter        // Aliases and rewrite rules of client model names
+	Breakers       *CircuitBreakers    // Health of each provider/model pair
+
+	LogLevel     string // debug, info, warn or error
+	LogFormat    string // text or json
+	LogRedaction string // How prompts and completions are logged: metadata, truncated or full
+
+	ShutdownTimeout time.Duration  // Time in-flight requests get to finish on shutdown
+	ShutdownDelay   time.Duration  // Time the probes fail before the relay stops accepting requests
+	Drain           *Drain         // Graceful shutdown state
+	Upstream        *UpstreamProbe // Cached readiness probe of Raycast
+	Responses       *ResponseStore // Recent Responses API responses, for previous_response_id
+
+	ConfigFile      string // YAML or TOML config file, reloaded on SIGHUP or change
+	KeyStoreFile    string
+	UsageLedgerFile string
+}
+
+// RaycastAPIURL returns the upstream chat completions URL
+func (config Config) RaycastAPIURL() string {
+	return strings.TrimSuffix(config.RaycastBaseURL, "/") + config.RaycastChatPath
+}
+
+// RaycastModelsURL returns the upstream models URL
+func (config Config) RaycastModelsURL() string {
+	return strings.TrimSuffix(config.RaycastBaseURL, "/") + config.RaycastModelsPath
 }
 
 // ErrorResponse represents an error response
@@ -46,12 +126,23 @@ type ErrorResponse struct {
 		Message string `json:"message"`
 		Type    string `json:"type"`
 		Details string `json:"details,omitempty"`
+		Code    string `json:"code,omitempty"`
 	} `json:"error"`
 }
 
+// newErrorResponse creates an error response in OpenAI format
+func newErrorResponse(message, errType, details string) ErrorResponse {
+	var resp ErrorResponse
+	resp.Error.Message = message
+	resp.Error.Type = errType
+	resp.Error.Details = details
+	return resp
+}
+
 // ModelCache represents the cache for models
 type ModelCache struct {
 	models    map[string]ModelCacheEntry
+	updatedAt time.Time // Last successful fetch, zero before the first one
 	expiresAt time.Time
 	mutex     sync.RWMutex
 }
@@ -60,71 +151,213 @@ type ModelCache struct {
 type ModelCacheEntry struct {
 	Model    string `json:"model"`
 	Provider string `json:"provider"`
+	Vision   bool   `json:"vision"` // Whether the model accepts image attachments
 }
 
-// validateAPIKey validates the API key from the request
-func validateAPIKey(c *gin.Context, config Config) bool {
-	if config.APIKey == "" {
-		return true // If no API key is set, allow all requests
-	}
+// validateAPIKey validates the API key from the request and returns its policy
+func validateAPIKey(c *gin.Context, config Config) (APIKeyPolicy, bool) {
+	return config.Keys.Authenticate(getRequestAPIKey(c))
+}
 
+// apiKeyIDContextKey is the gin context key holding the client key identity,
+// the policy name, used in logs and metrics
+const apiKeyIDContextKey = "api_key_id"
+
+// getRequestAPIKey extracts the client API key from the request. Anthropic
+// clients send it in x-api-key instead of the Authorization header, Gemini
+// clients in x-goog-api-key or the key query parameter.
+func getRequestAPIKey(c *gin.Context) string {
 	authHeader := c.GetHeader("Authorization")
-	if !strings.HasPrefix(authHeader, "Bearer ") {
-		return false
+	if strings.HasPrefix(authHeader, "Bearer ") {
+		return strings.TrimPrefix(authHeader, "Bearer ")
 	}
-
-	// Extract the token from the Authorization header
-	token := strings.TrimPrefix(authHeader, "Bearer ")
-
-	// Split the config.APIKey by comma and trim spaces
-	validKeys := strings.Split(config.APIKey, ",")
-	for _, key := range validKeys {
-		if strings.TrimSpace(key) == token {
-			return true
-		}
+	if key := c.GetHeader("x-api-key"); key != "" {
+		return key
+	}
+	if key := c.GetHeader("x-goog-api-key"); key != "" {
+		return key
+	}
+	if isGeminiPath(c.Request.URL.Path) {
+		return c.Query("key")
 	}
+	return ""
+}
 
-	return false
+// validateAdminKey validates the admin key from the request
+func validateAdminKey(c *gin.Context, config Config) bool {
+	if config.AdminKey == "" {
+		return false // The admin API is disabled without an admin key
+	}
+	return subtle.ConstantTimeCompare([]byte(getRequestAPIKey(c)), []byte(config.AdminKey)) == 1
 }
 
 // getRaycastHeaders returns headers for Raycast API requests
-func getRaycastHeaders(config Config) map[string]string {
+func getRaycastHeaders(config Config, token raycastToken) map[string]string {
+	language, _, _ := strings.Cut(config.Locale, "-")
 	return map[string]string{
-		"Host":            "backend.raycast.com",
 		"Accept":          "application/json",
-		"User-Agent":      UserAgent,
-		"Authorization":   "Bearer " + config.RaycastBearerToken,
-		"Accept-Language": "en-US,en;q=0.9",
+		"User-Agent":      config.UserAgent,
+		"Authorization":   "Bearer " + token.Value,
+		"Accept-Language": config.Locale + "," + language + ";q=0.9",
 		"Content-Type":    "application/json",
 		"Connection":      "close",
 	}
 }
 
-// InitConfig initializes the configuration
+// applyRaycastHeaders sets the Raycast headers and the optional Host override
+// on an upstream request. The Host header has to go through req.Host, the
+// net/http client ignores it in req.Header.
+func applyRaycastHeaders(req *http.Request, config Config, token raycastToken) {
+	for key, value := range getRaycastHeaders(config, token) {
+		req.Header.Set(key, value)
+	}
+	if config.RaycastHost != "" {
+		req.Host = config.RaycastHost
+	}
+}
+
+// InitConfig initializes the configuration from the environment and the
+// optional CONFIG_FILE
 func InitConfig() *Config {
-	// Initialize model cache
-	modelCache := NewModelCache()
+	config, err := loadConfig(os.Getenv("CONFIG_FILE"), nil)
+	if err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
 
-	// Load configuration from environment variables
-	config := &Config{
-		RaycastBearerToken: os.Getenv("RAYCAST_BEARER_TOKEN"),
-		APIKey:             os.Getenv("API_KEY"),
-		ModelCache:         modelCache,
-		Port:               os.Getenv("PORT"),
+	// Log configuration status
+	slog.Info("Configuration loaded",
+		"config_file", config.ConfigFile,
+		"raycast_tokens", config.TokenPool.Size(),
+		"api_keys", config.Keys.Size(),
+		"admin_key", map[bool]string{true: "Set", false: "Not set"}[config.AdminKey != ""],
+		"log_redaction", config.LogRedaction,
+	)
+	if config.RaycastBaseURL != DefaultRaycastBaseURL {
+		slog.Info("Using a custom Raycast backend", "base_url", config.RaycastBaseURL)
 	}
 
-	// Log environment variable status
-	log.Printf("RAYCAST_BEARER_TOKEN: %s", map[bool]string{true: "Set", false: "Not set"}[config.RaycastBearerToken != ""])
-	log.Printf("API_KEY: %s", map[bool]string{true: "Set", false: "Not set"}[config.APIKey != ""])
+	return config
+}
 
-	// Validate required environment variables
-	if config.RaycastBearerToken == "" {
-		log.Fatal("Missing required environment variable: RAYCAST_BEARER_TOKEN")
+// loadConfig reads the settings from the environment and the config file and
+// builds the configuration. On reload, previous is the running configuration:
+// its token pool, keys, usage ledger, metrics, model cache and breakers are
+// kept and updated in place, so their state survives the reload.
+func loadConfig(path string, previous *Config) (*Config, error) {
+	settings, err := settingsFromEnv()
+	if err != nil {
+		return nil, fmt.Errorf("invalid environment:\n%w", err)
+	}
+	if path != "" {
+		if err := readConfigFile(path, &settings); err != nil {
+			return nil, err
+		}
 	}
 
-	if config.Port == "" {
-		config.Port = "8080"
+	errs := []error{settings.validate()}
+	tokens, err := settings.bearerTokens()
+	errs = append(errs, err)
+	policies, err := settings.apiKeys()
+	errs = append(errs, err)
+	routes, err := settings.modelRouter()
+	errs = append(errs, err)
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
 	}
 
-	return config
+	redaction, _ := parseLogRedaction(settings.Logging.Redaction)
+	config := &Config{
+		APIKey:   os.Getenv("API_KEY"),
+		AdminKey: settings.Server.AdminKey,
+		Port:     strconv.Itoa(settings.Server.Port),
+
+		RaycastBaseURL:    settings.Raycast.BaseURL,
+		RaycastChatPath:   settings.Raycast.ChatPath,
+		RaycastModelsPath: settings.Raycast.ModelsPath,
+		RaycastHost:       settings.Raycast.Host,
+		UserAgent:         settings.Raycast.UserAgent,
+		Locale:            settings.Raycast.Locale,
+
+		DefaultModel:        settings.Defaults.Model,
+		DefaultProvider:     settings.Defaults.Provider,
+		DefaultTemperature:  settings.Defaults.Temperature,
+		DefaultSystemPrompt: settings.Defaults.SystemPrompt,
+		ModelCacheTTL:       time.Duration(settings.Defaults.ModelCacheTTL),
+		MaxImageBytes:       settings.Limits.MaxImageBytes,
+		AllowRemoteImages:   settings.Limits.AllowRemoteImages,
+
+		MaxRetries:     settings.Limits.MaxRetries,
+		RetryBaseDelay: time.Duration(settings.Limits.RetryBaseDelay),
+		RetryMaxDelay:  time.Duration(settings.Limits.RetryMaxDelay),
+		ModelFallbacks: settings.Routing.Fallbacks,
+		ModelRoutes:    routes,
+
+		LogLevel:     settings.Logging.Level,
+		LogFormat:    settings.Logging.Format,
+		LogRedaction: redaction,
+
+		ShutdownTimeout: time.Duration(settings.Server.ShutdownTimeout),
+		ShutdownDelay:   time.Duration(settings.Server.ShutdownDelay),
+
+		ConfigFile:      path,
+		KeyStoreFile:    settings.Server.KeyStoreFile,
+		UsageLedgerFile: settings.Server.UsageLedgerFile,
+	}
+	threshold, openDuration := settings.Limits.BreakerFailureThreshold, time.Duration(settings.Limits.BreakerOpenDuration)
+
+	if previous == nil {
+		// Set up logging first so everything below is logged in the configured format
+		if err := setupLogging(os.Stderr, config.LogLevel, config.LogFormat, config.LogRedaction); err != nil {
+			return nil, err
+		}
+		if config.Keys, err = NewKeyStore(policies, config.KeyStoreFile); err != nil {
+			return nil, fmt.Errorf("failed to load the key store: %w", err)
+		}
+		if config.Usage, err = NewUsageLedger(config.UsageLedgerFile); err != nil {
+			return nil, fmt.Errorf("failed to open the usage ledger: %w", err)
+		}
+		config.TokenPool = NewTokenPool(tokens)
+		config.Metrics = NewMetrics()
+		config.ModelCache = NewModelCache()
+		config.Breakers = NewCircuitBreakers(threshold, openDuration)
+		config.Drain = &Drain{}
+		config.Upstream = &UpstreamProbe{}
+		config.Responses = NewResponseStore(settings.Limits.ResponseStoreSize)
+		return config, nil
+	}
+
+	// Update the shared state, starting with the only step that can fail
+	if err := previous.Keys.SetConfigKeys(policies); err != nil {
+		return nil, err
+	}
+	previous.TokenPool.SetTokens(tokens)
+	previous.Breakers.SetLimits(threshold, openDuration)
+	previous.Responses.SetCapacity(settings.Limits.ResponseStoreSize)
+	if err := setupLogging(os.Stderr, config.LogLevel, config.LogFormat, config.LogRedaction); err != nil {
+		return nil, err
+	}
+	config.Keys = previous.Keys
+	config.Usage = previous.Usage
+	config.TokenPool = previous.TokenPool
+	config.Metrics = previous.Metrics
+	config.ModelCache = previous.ModelCache
+	config.Breakers = previous.Breakers
+	config.Drain = previous.Drain
+	config.Upstream = previous.Upstream
+	config.Responses = previous.Responses
+
+	// The listener and the state files are only opened at startup
+	for setting, changed := range map[string]bool{
+		"server.port":              config.Port != previous.Port,
+		"server.key_store_file":    config.KeyStoreFile != previous.KeyStoreFile,
+		"server.usage_ledger_file": config.UsageLedgerFile != previous.UsageLedgerFile,
+	} {
+		if changed {
+			slog.Warn("Setting changed, restart to apply it", "setting", setting)
+		}
+	}
+	config.Port = previous.Port
+	config.KeyStoreFile = previous.KeyStoreFile
+	config.UsageLedgerFile = previous.UsageLedgerFile
+	return config, nil
 }
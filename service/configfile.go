@@ -0,0 +1,493 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 21:14:52
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 21:14:52
+ * @FilePath: /raycast2api/service/configfile.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Settings is the configuration as written in the config file. It starts
+// from the defaults and the environment variables, then the values set in the
+// file take precedence. Every section of the file is optional.
+type Settings struct {
+	Server   ServerSettings   `yaml:"server" toml:"server"`
+	Raycast  RaycastSettings  `yaml:"raycast" toml:"raycast"`
+	Defaults DefaultSettings  `yaml:"defaults" toml:"defaults"`
+	Limits   LimitSettings    `yaml:"limits" toml:"limits"`
+	Routing  RoutingSettings  `yaml:"routing" toml:"routing"`
+	Logging  LoggingSettings  `yaml:"logging" toml:"logging"`
+	Keys     []APIKeySettings `yaml:"keys" toml:"keys"` // Added to the API_KEY and API_KEYS_FILE keys
+}
+
+// ServerSettings configures the HTTP server and its state files
+type ServerSettings struct {
+	Port            int      `yaml:"port" toml:"port"`
+	AdminKey        string   `yaml:"admin_key" toml:"admin_key"`
+	KeyStoreFile    string   `yaml:"key_store_file" toml:"key_store_file"`
+	UsageLedgerFile string   `yaml:"usage_ledger_file" toml:"usage_ledger_file"`
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	ShutdownDelay   Duration `yaml:"shutdown_delay" toml:"shutdown_delay"`
+}
+
+// RaycastSettings configures the upstream Raycast backend
+type RaycastSettings struct {
+	BaseURL    string   `yaml:"base_url" toml:"base_url"`
+	ChatPath   string   `yaml:"chat_path" toml:"chat_path"`
+	ModelsPath string   `yaml:"models_path" toml:"models_path"`
+	Host       string   `yaml:"host" toml:"host"`
+	Tokens     []string `yaml:"tokens" toml:"tokens"` // Added to the RAYCAST_BEARER_TOKEN tokens
+	TokenFile  string   `yaml:"token_file" toml:"token_file"`
+	UserAgent  string   `yaml:"user_agent" toml:"user_agent"`
+	Locale     string   `yaml:"locale" toml:"locale"`
+}
+
+// DefaultSettings holds the values used when a request does not set them
+type DefaultSettings struct {
+	Model         string   `yaml:"model" toml:"model"`
+	Provider      string   `yaml:"provider" toml:"provider"` // Provider of the default model when Raycast does not list it
+	Temperature   float64  `yaml:"temperature" toml:"temperature"`
+	SystemPrompt  string   `yaml:"system_prompt" toml:"system_prompt"`
+	ModelCacheTTL Duration `yaml:"model_cache_ttl" toml:"model_cache_ttl"`
+}
+
+// LimitSettings configures request limits, retries and circuit breakers
+type LimitSettings struct {
+	MaxImageBytes           int64    `yaml:"max_image_bytes" toml:"max_image_bytes"`
+	AllowRemoteImages       bool     `yaml:"allow_remote_images" toml:"allow_remote_images"`
+	MaxRetries              int      `yaml:"max_retries" toml:"max_retries"`
+	RetryBaseDelay          Duration `yaml:"retry_base_delay" toml:"retry_base_delay"`
+	RetryMaxDelay           Duration `yaml:"retry_max_delay" toml:"retry_max_delay"`
+	BreakerFailureThreshold int      `yaml:"breaker_failure_threshold" toml:"breaker_failure_threshold"`
+	BreakerOpenDuration     Duration `yaml:"breaker_open_duration" toml:"breaker_open_duration"`
+	ResponseStoreSize       int      `yaml:"response_store_size" toml:"response_store_size"`
+}
+
+// RoutingSettings configures model aliases, rewrite rules and fallbacks
+type RoutingSettings struct {
+	Aliases   map[string]string   `yaml:"aliases" toml:"aliases"`
+	Rules     []ModelRuleSettings `yaml:"rules" toml:"rules"`
+	Strict    bool                `yaml:"strict" toml:"strict"`
+	Fallbacks map[string][]string `yaml:"fallbacks" toml:"fallbacks"`
+}
+
+// LoggingSettings configures the structured logs
+type LoggingSettings struct {
+	Level     string `yaml:"level" toml:"level"`
+	Format    string `yaml:"format" toml:"format"`
+	Redaction string `yaml:"redaction" toml:"redaction"`
+}
+
+// APIKeySettings is a client key with its policy, as in API_KEYS_FILE
+type APIKeySettings struct {
+	Name              string     `yaml:"name" toml:"name"`
+	Key               string     `yaml:"key" toml:"key"`
+	AllowedModels     []string   `yaml:"allowed_models" toml:"allowed_models"`
+	DeniedModels      []string   `yaml:"denied_models" toml:"denied_models"`
+	RequestsPerMinute int        `yaml:"rpm" toml:"rpm"`
+	TokensPerDay      int        `yaml:"tpd" toml:"tpd"`
+	ExpiresAt         *time.Time `yaml:"expires_at" toml:"expires_at"`
+}
+
+// Duration is a time.Duration written as a string such as 30s or 6h
+type Duration time.Duration
+
+// UnmarshalText parses a duration string
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid duration %q, expected a value such as 500ms, 30s or 6h", text)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// UnmarshalYAML parses a duration string, so errors come with a line number
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	if err := d.UnmarshalText([]byte(node.Value)); err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	return nil
+}
+
+// defaultSettings returns the settings used when nothing is configured
+func defaultSettings() Settings {
+	return Settings{
+		Server: ServerSettings{Port: 8080, ShutdownTimeout: Duration(DefaultShutdownTimeout)},
+		Raycast: RaycastSettings{
+			BaseURL:    DefaultRaycastBaseURL,
+			ChatPath:   DefaultRaycastChatPath,
+			ModelsPath: DefaultRaycastModelsPath,
+			UserAgent:  DefaultUserAgent,
+			Locale:     DefaultLocale,
+		},
+		Defaults: DefaultSettings{
+			Model:         DefaultModel,
+			Provider:      DefaultProvider,
+			Temperature:   DefaultTemperature,
+			ModelCacheTTL: Duration(DefaultModelCacheTTL),
+		},
+		Limits: LimitSettings{
+			MaxImageBytes:           DefaultMaxImageBytes,
+			MaxRetries:              DefaultMaxRetries,
+			RetryBaseDelay:          Duration(DefaultRetryBaseDelay),
+			RetryMaxDelay:           Duration(DefaultRetryMaxDelay),
+			BreakerFailureThreshold: DefaultBreakerThreshold,
+			BreakerOpenDuration:     Duration(DefaultBreakerOpenDuration),
+			ResponseStoreSize:       DefaultResponseStoreSize,
+		},
+	}
+}
+
+// settingsFromEnv returns the default settings overridden by the environment
+func settingsFromEnv() (Settings, error) {
+	settings := defaultSettings()
+	var errs []error
+
+	for key, target := range map[string]*string{
+		"ADMIN_KEY":                 &settings.Server.AdminKey,
+		"KEY_STORE_FILE":            &settings.Server.KeyStoreFile,
+		"USAGE_LEDGER_FILE":         &settings.Server.UsageLedgerFile,
+		"RAYCAST_BASE_URL":          &settings.Raycast.BaseURL,
+		"RAYCAST_CHAT_PATH":         &settings.Raycast.ChatPath,
+		"RAYCAST_MODELS_PATH":       &settings.Raycast.ModelsPath,
+		"RAYCAST_HOST":              &settings.Raycast.Host,
+		"RAYCAST_BEARER_TOKEN_FILE": &settings.Raycast.TokenFile,
+		"RAYCAST_USER_AGENT":        &settings.Raycast.UserAgent,
+		"RAYCAST_LOCALE":            &settings.Raycast.Locale,
+		"DEFAULT_MODEL":             &settings.Defaults.Model,
+		"DEFAULT_PROVIDER":          &settings.Defaults.Provider,
+		"DEFAULT_SYSTEM_PROMPT":     &settings.Defaults.SystemPrompt,
+		"LOG_LEVEL":                 &settings.Logging.Level,
+		"LOG_FORMAT":                &settings.Logging.Format,
+		"LOG_REDACTION":             &settings.Logging.Redaction,
+	} {
+		if value := os.Getenv(key); value != "" {
+			*target = value
+		}
+	}
+
+	for key, target := range map[string]*int{
+		"PORT":                      &settings.Server.Port,
+		"RAYCAST_MAX_RETRIES":       &settings.Limits.MaxRetries,
+		"BREAKER_FAILURE_THRESHOLD": &settings.Limits.BreakerFailureThreshold,
+		"RESPONSE_STORE_SIZE":       &settings.Limits.ResponseStoreSize,
+	} {
+		if value := os.Getenv(key); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid number %q", key, value))
+			}
+			*target = parsed
+		}
+	}
+
+	for key, target := range map[string]*Duration{
+		"SHUTDOWN_TIMEOUT":         &settings.Server.ShutdownTimeout,
+		"SHUTDOWN_DELAY":           &settings.Server.ShutdownDelay,
+		"MODEL_CACHE_TTL":          &settings.Defaults.ModelCacheTTL,
+		"RAYCAST_RETRY_BASE_DELAY": &settings.Limits.RetryBaseDelay,
+		"RAYCAST_RETRY_MAX_DELAY":  &settings.Limits.RetryMaxDelay,
+		"BREAKER_OPEN_DURATION":    &settings.Limits.BreakerOpenDuration,
+	} {
+		if value := os.Getenv(key); value != "" {
+			if err := target.UnmarshalText([]byte(value)); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", key, err))
+			}
+		}
+	}
+
+	if value := os.Getenv("MAX_IMAGE_BYTES"); value != "" {
+		var err error
+		if settings.Limits.MaxImageBytes, err = strconv.ParseInt(value, 10, 64); err != nil {
+			errs = append(errs, fmt.Errorf("MAX_IMAGE_BYTES: invalid number %q", value))
+		}
+	}
+	if value := os.Getenv("DEFAULT_TEMPERATURE"); value != "" {
+		var err error
+		if settings.Defaults.Temperature, err = strconv.ParseFloat(value, 64); err != nil {
+			errs = append(errs, fmt.Errorf("DEFAULT_TEMPERATURE: invalid number %q", value))
+		}
+	}
+
+	var err error
+	if settings.Routing.Aliases, err = parseModelAliases(os.Getenv("MODEL_ALIASES")); err != nil {
+		errs = append(errs, fmt.Errorf("MODEL_ALIASES: %w", err))
+	}
+	if settings.Routing.Rules, err = parseModelRules(os.Getenv("MODEL_RULES")); err != nil {
+		errs = append(errs, fmt.Errorf("MODEL_RULES: %w", err))
+	}
+	if settings.Routing.Fallbacks, err = parseModelFallbacks(os.Getenv("MODEL_FALLBACKS")); err != nil {
+		errs = append(errs, fmt.Errorf("MODEL_FALLBACKS: %w", err))
+	}
+	settings.Routing.Strict = os.Getenv("MODEL_STRICT") == "true"
+	settings.Limits.AllowRemoteImages = os.Getenv("ALLOW_REMOTE_IMAGES") == "true"
+
+	return settings, errors.Join(errs...)
+}
+
+// readConfigFile applies a YAML or TOML config file to the settings. Unknown
+// fields are rejected so that typos do not go unnoticed.
+func readConfigFile(path string, settings *Settings) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(settings); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	case ".toml":
+		decoder := toml.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(settings); err != nil {
+			var decodeErr *toml.DecodeError
+			if errors.As(err, &decodeErr) {
+				row, column := decodeErr.Position()
+				return fmt.Errorf("%s:%d:%d: %s", path, row, column, decodeErr.Error())
+			}
+			var strictErr *toml.StrictMissingError
+			if errors.As(err, &strictErr) {
+				return fmt.Errorf("%s: %s", path, strictErr.String())
+			}
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	default:
+		return fmt.Errorf("unsupported config file %s, expected a .yaml, .yml or .toml file", path)
+	}
+	return nil
+}
+
+// settingError describes an invalid setting by its config file field and,
+// when there is one, the environment variable setting it
+func settingError(field, env, format string, args ...any) error {
+	if env != "" {
+		field += " (" + env + ")"
+	}
+	return fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...))
+}
+
+// validate checks every setting and reports all the invalid ones
+func (s Settings) validate() error {
+	var errs []error
+	check := func(ok bool, field, env, format string, args ...any) {
+		if !ok {
+			errs = append(errs, settingError(field, env, format, args...))
+		}
+	}
+
+	check(s.Server.Port > 0 && s.Server.Port <= 65535, "server.port", "PORT", "must be between 1 and 65535, got %d", s.Server.Port)
+	check(s.Server.ShutdownTimeout > 0, "server.shutdown_timeout", "SHUTDOWN_TIMEOUT", "must be positive, got %s", time.Duration(s.Server.ShutdownTimeout))
+	check(s.Server.ShutdownDelay >= 0, "server.shutdown_delay", "SHUTDOWN_DELAY", "must not be negative, got %s", time.Duration(s.Server.ShutdownDelay))
+
+	baseURL, err := url.Parse(s.Raycast.BaseURL)
+	check(err == nil && (baseURL.Scheme == "http" || baseURL.Scheme == "https") && baseURL.Host != "",
+		"raycast.base_url", "RAYCAST_BASE_URL", "must be an http or https URL, got %q", s.Raycast.BaseURL)
+	check(strings.HasPrefix(s.Raycast.ChatPath, "/"), "raycast.chat_path", "RAYCAST_CHAT_PATH", "must start with /, got %q", s.Raycast.ChatPath)
+	check(strings.HasPrefix(s.Raycast.ModelsPath, "/"), "raycast.models_path", "RAYCAST_MODELS_PATH", "must start with /, got %q", s.Raycast.ModelsPath)
+	check(s.Raycast.UserAgent != "", "raycast.user_agent", "RAYCAST_USER_AGENT", "must not be empty")
+	check(s.Raycast.Locale != "", "raycast.locale", "RAYCAST_LOCALE", "must not be empty")
+
+	check(s.Defaults.Model != "", "defaults.model", "DEFAULT_MODEL", "must not be empty")
+	check(s.Defaults.Provider != "", "defaults.provider", "DEFAULT_PROVIDER", "must not be empty")
+	check(s.Defaults.Temperature >= 0 && s.Defaults.Temperature <= 2, "defaults.temperature", "DEFAULT_TEMPERATURE", "must be between 0 and 2, got %g", s.Defaults.Temperature)
+	check(s.Defaults.ModelCacheTTL > 0, "defaults.model_cache_ttl", "MODEL_CACHE_TTL", "must be positive, got %s", time.Duration(s.Defaults.ModelCacheTTL))
+
+	check(s.Limits.MaxImageBytes > 0, "limits.max_image_bytes", "MAX_IMAGE_BYTES", "must be positive, got %d", s.Limits.MaxImageBytes)
+	check(s.Limits.MaxRetries >= 0, "limits.max_retries", "RAYCAST_MAX_RETRIES", "must not be negative, got %d", s.Limits.MaxRetries)
+	check(s.Limits.RetryBaseDelay > 0, "limits.retry_base_delay", "RAYCAST_RETRY_BASE_DELAY", "must be positive, got %s", time.Duration(s.Limits.RetryBaseDelay))
+	check(s.Limits.RetryMaxDelay > 0, "limits.retry_max_delay", "RAYCAST_RETRY_MAX_DELAY", "must be positive, got %s", time.Duration(s.Limits.RetryMaxDelay))
+	check(s.Limits.BreakerFailureThreshold >= 0, "limits.breaker_failure_threshold", "BREAKER_FAILURE_THRESHOLD", "must not be negative, got %d", s.Limits.BreakerFailureThreshold)
+	check(s.Limits.BreakerOpenDuration > 0, "limits.breaker_open_duration", "BREAKER_OPEN_DURATION", "must be positive, got %s", time.Duration(s.Limits.BreakerOpenDuration))
+	check(s.Limits.ResponseStoreSize >= 0, "limits.response_store_size", "RESPONSE_STORE_SIZE", "must not be negative, got %d", s.Limits.ResponseStoreSize)
+
+	for model, fallbacks := range s.Routing.Fallbacks {
+		check(model != "", "routing.fallbacks", "MODEL_FALLBACKS", "model names must not be empty")
+		check(!slices.Contains(fallbacks, model), "routing.fallbacks."+model, "MODEL_FALLBACKS", "a model cannot fall back to itself")
+	}
+
+	if _, err := newLogHandler(io.Discard, s.Logging.Level, s.Logging.Format); err != nil {
+		errs = append(errs, settingError("logging", "LOG_LEVEL, LOG_FORMAT", "%v", err))
+	}
+	if _, err := parseLogRedaction(s.Logging.Redaction); err != nil {
+		errs = append(errs, settingError("logging.redaction", "LOG_REDACTION", "%v", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// bearerTokens returns the Raycast tokens of the environment, the token file
+// and the settings, without duplicates
+func (s Settings) bearerTokens() ([]string, error) {
+	tokens, err := loadBearerTokens(os.Getenv("RAYCAST_BEARER_TOKEN"), s.Raycast.TokenFile)
+	if err != nil {
+		return nil, settingError("raycast.token_file", "RAYCAST_BEARER_TOKEN_FILE", "%v", err)
+	}
+	for _, token := range s.Raycast.Tokens {
+		if token = strings.TrimSpace(token); token != "" && !slices.Contains(tokens, token) {
+			tokens = append(tokens, token)
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, settingError("raycast.tokens", "RAYCAST_BEARER_TOKEN", "at least one Raycast bearer token is required")
+	}
+	return tokens, nil
+}
+
+// apiKeys returns the client keys of the environment, the API key file and
+// the settings, named and validated
+func (s Settings) apiKeys() ([]APIKeyPolicy, error) {
+	policies, err := loadAPIKeys(os.Getenv("API_KEY"), os.Getenv("API_KEYS_FILE"))
+	if err != nil {
+		return nil, settingError("keys", "API_KEYS_FILE", "%v", err)
+	}
+	for _, key := range s.Keys {
+		policies = append(policies, APIKeyPolicy{
+			Name:              key.Name,
+			Key:               key.Key,
+			AllowedModels:     key.AllowedModels,
+			DeniedModels:      key.DeniedModels,
+			RequestsPerMinute: key.RequestsPerMinute,
+			TokensPerDay:      key.TokensPerDay,
+			ExpiresAt:         key.ExpiresAt,
+		})
+	}
+	if err := checkAPIKeys(policies); err != nil {
+		return nil, settingError("keys", "API_KEY, API_KEYS_FILE", "%v", err)
+	}
+	return policies, nil
+}
+
+// modelRouter creates the model router of the settings
+func (s Settings) modelRouter() (*ModelRouter, error) {
+	defaultModel := ModelCacheEntry{
+		Provider: s.Defaults.Provider,
+		Model:    s.Defaults.Model,
+		Vision:   guessVisionSupport(s.Defaults.Model),
+	}
+	router, err := NewModelRouter(s.Routing.Aliases, s.Routing.Rules, s.Routing.Strict, defaultModel)
+	if err != nil {
+		return nil, settingError("routing", "MODEL_ALIASES, MODEL_RULES", "%v", err)
+	}
+	return router, nil
+}
+
+// ConfigStore holds the running configuration and reloads it. Requests take
+// a snapshot when they start, so a reload never changes the configuration of
+// a request in flight, streams included.
+type ConfigStore struct {
+	current atomic.Pointer[Config]
+	mutex   sync.Mutex // Serializes reloads
+}
+
+// NewConfigStore creates a store serving the given configuration
+func NewConfigStore(config *Config) *ConfigStore {
+	store := &ConfigStore{}
+	store.current.Store(config)
+	return store
+}
+
+// Get returns a snapshot of the running configuration
+func (s *ConfigStore) Get() Config {
+	return *s.current.Load()
+}
+
+// Reload reads the configuration again. An invalid configuration is
+// rejected as a whole and the running one is kept.
+func (s *ConfigStore) Reload() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous := s.current.Load()
+	config, err := loadConfig(previous.ConfigFile, previous)
+	if err != nil {
+		return err
+	}
+	s.current.Store(config)
+	slog.Info("Configuration reloaded",
+		"config_file", config.ConfigFile,
+		"raycast_tokens", config.TokenPool.Size(),
+		"api_keys", config.Keys.Size(),
+	)
+	return nil
+}
+
+// Watch reloads the configuration on SIGHUP and whenever the config file
+// changes, until ctx is cancelled
+func (s *ConfigStore) Watch(ctx context.Context) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	ticker := time.NewTicker(ConfigPollInterval)
+	defer ticker.Stop()
+	path := s.current.Load().ConfigFile
+	lastModified := configFileVersion(path)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			slog.Info("Received SIGHUP, reloading the configuration")
+		case <-ticker.C:
+			if path == "" {
+				continue
+			}
+			modified := configFileVersion(path)
+			if modified == "" || modified == lastModified {
+				continue
+			}
+			lastModified = modified
+			slog.Info("Config file changed, reloading the configuration", "config_file", path)
+		}
+		if err := s.Reload(); err != nil {
+			slog.Error("Configuration reload failed, keeping the running configuration", "error", err)
+		}
+	}
+}
+
+// configFileVersion identifies the content of the config file by its
+// modification time and size, empty when the file cannot be read
+func configFileVersion(path string) string {
+	if path == "" {
+		return ""
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size())
+}
@@ -0,0 +1,560 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 23:48:20
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 23:48:20
+ * @FilePath: /raycast2api/service/gemini.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Generation methods of the Gemini API, called as models/{model}:{method}
+const (
+	geminiGenerateContent       = "generateContent"
+	geminiStreamGenerateContent = "streamGenerateContent"
+)
+
+// isGeminiPath reports whether a request path belongs to the Gemini API,
+// whose clients expect errors in Gemini format
+func isGeminiPath(path string) bool {
+	return strings.HasPrefix(path, "/v1beta/")
+}
+
+// handleGeminiModelAction handles POST /v1beta/models/{model}:{method}. The
+// method is part of the last path segment, so it is split off the model here.
+func handleGeminiModelAction(c *gin.Context, config Config) {
+	model, method := c.Param("model"), ""
+	if i := strings.LastIndex(model, ":"); i >= 0 {
+		model, method = model[:i], model[i+1:]
+	}
+
+	switch method {
+	case geminiGenerateContent:
+		handleGeminiGenerateContent(c, config, model, false)
+	case geminiStreamGenerateContent:
+		handleGeminiGenerateContent(c, config, model, true)
+	default:
+		geminiError(c, http.StatusNotFound, fmt.Sprintf("Method '%s' is not supported", method))
+	}
+}
+
+// handleGeminiGenerateContent handles the Gemini generateContent and
+// streamGenerateContent endpoints
+func handleGeminiGenerateContent(c *gin.Context, config Config, model string, stream bool) {
+	var body GeminiGenerateContentRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		geminiError(c, http.StatusBadRequest, fmt.Sprintf("Invalid JSON payload received: %v", err))
+		return
+	}
+
+	if len(body.Contents) == 0 {
+		geminiError(c, http.StatusBadRequest, "contents is not specified")
+		return
+	}
+
+	generation := GeminiGenerationConfig{}
+	if body.GenerationConfig != nil {
+		generation = *body.GenerationConfig
+	}
+	if generation.CandidateCount > 1 {
+		geminiError(c, http.StatusBadRequest, "Only one candidate can be specified")
+		return
+	}
+
+	// Reuse the OpenAI conversion so tools and tool results behave the same
+	tools, toolChoice := convertGeminiTools(body.Tools, body.ToolConfig)
+	toolInstructions := buildToolInstructions(tools, toolChoice)
+
+	// Use default model if not specified
+	if model == "" {
+		model = config.DefaultModel
+	}
+
+	messages, err := convertGeminiContents(body.Contents)
+	if err != nil {
+		geminiError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	raycastMessages, err := convertMessages(config, messages)
+	if err != nil {
+		geminiError(c, http.StatusBadRequest, fmt.Sprintf("Invalid image content: %v", err))
+		return
+	}
+
+	// Send the request, retrying and falling back to other models on failure
+	result, relayErr := relayChat(c, config, raycastChatParams{
+		Model:                        model,
+		Messages:                     raycastMessages,
+		SystemInstruction:            geminiText(body.SystemInstruction),
+		AdditionalSystemInstructions: toolInstructions,
+		Temperature:                  generation.Temperature,
+		MaxTokens:                    generation.MaxOutputTokens,
+	})
+	if relayErr != nil {
+		geminiError(c, relayErr.Status, relayErr.Message)
+		return
+	}
+	resp := result.Response
+	defer resp.Body.Close()
+
+	opts := chatResponseOptions{
+		Model:     result.Model,
+		Request:   result.Request,
+		WithTools: toolInstructions != "",
+	}
+
+	getRequestRecord(c.Request.Context()).setStream(stream)
+	if stream {
+		defer config.Metrics.StreamStarted(c.FullPath())()
+		handleGeminiStreamingResponse(c, resp, opts, generation.StopSequences, c.Query("alt") == "sse")
+	} else {
+		handleGeminiNonStreamingResponse(c, resp, opts, generation.StopSequences)
+	}
+}
+
+// handleGeminiNonStreamingResponse collects the Raycast reply into a single candidate
+func handleGeminiNonStreamingResponse(c *gin.Context, response *http.Response, opts chatResponseOptions, stopSequences []string) {
+	stopFilter := newStopSequenceFilter(stopSequences)
+	finishReason := ""
+	var reportedUsage *RaycastUsage
+
+	var fullText strings.Builder
+	err := readRaycastEvents(response.Body, func(data RaycastSSEData) bool {
+		if data.FinishReason != "" {
+			finishReason = data.FinishReason
+		}
+		if data.Usage != nil {
+			reportedUsage = data.Usage
+		}
+		fullText.WriteString(stopFilter.Feed(data.Text))
+		_, stopped := stopFilter.Stopped()
+		return !stopped
+	})
+	if err != nil {
+		if clientDisconnected(c) {
+			logCancelledRequest(c, opts.Model)
+			return
+		}
+		geminiError(c, http.StatusInternalServerError, fmt.Sprintf("Error reading response body: %v", err))
+		return
+	}
+	fullText.WriteString(stopFilter.Flush())
+
+	text := fullText.String()
+	usage := buildUsage(opts.Request, text, reportedUsage)
+	getRequestRecord(c.Request.Context()).setUsage(opts.Request, usage)
+	logReply(opts, text, usage)
+
+	var toolCalls []OpenAIToolCall
+	if opts.WithTools {
+		text, toolCalls = extractToolCalls(text)
+	}
+
+	parts := []GeminiPart{}
+	if text != "" {
+		parts = append(parts, GeminiPart{Text: text})
+	}
+	for _, call := range toolCalls {
+		parts = append(parts, geminiFunctionCallPart(call))
+	}
+
+	_, stopped := stopFilter.Stopped()
+	reply := newGeminiResponse(opts.Model, parts, geminiFinishReason(finishReason, stopped, len(toolCalls) > 0))
+	reply.UsageMetadata = geminiUsage(usage)
+	c.JSON(http.StatusOK, reply)
+}
+
+// handleGeminiStreamingResponse relays the Raycast stream as Gemini response
+// chunks. With ?alt=sse the chunks are sent as SSE events, otherwise as the
+// elements of a JSON array written progressively, like the Gemini API does.
+func handleGeminiStreamingResponse(c *gin.Context, response *http.Response, opts chatResponseOptions, stopSequences []string, sse bool) {
+	if sse {
+		c.Header("Content-Type", "text/event-stream")
+	} else {
+		c.Header("Content-Type", "application/json")
+	}
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		slog.Error("Streaming unsupported")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// Every chunk carries the same response ID, like the Gemini API
+	responseID := newGeminiResponseID()
+	chunks := 0
+
+	// writeChunk writes a single streaming chunk
+	writeChunk := func(chunk GeminiGenerateContentResponse) {
+		chunk.ResponseID = responseID
+		chunkData, err := json.Marshal(chunk)
+		if err != nil {
+			slog.Error("Error marshaling chunk", "error", err)
+			return
+		}
+		switch {
+		case sse:
+			fmt.Fprintf(c.Writer, "data: %s\r\n\r\n", string(chunkData))
+		case chunks == 0:
+			fmt.Fprintf(c.Writer, "[%s", string(chunkData))
+		default:
+			fmt.Fprintf(c.Writer, ",\r\n%s", string(chunkData))
+		}
+		chunks++
+		flusher.Flush()
+	}
+
+	record := getRequestRecord(c.Request.Context())
+	sendText := func(text string) {
+		if text == "" {
+			return
+		}
+		record.markFirstToken()
+		writeChunk(newGeminiResponse(opts.Model, []GeminiPart{{Text: text}}, ""))
+	}
+	sendToolCalls := func(calls []OpenAIToolCall) {
+		for _, call := range calls {
+			record.markFirstToken()
+			writeChunk(newGeminiResponse(opts.Model, []GeminiPart{geminiFunctionCallPart(call)}, ""))
+		}
+	}
+
+	var toolParser *toolCallStreamParser
+	if opts.WithTools {
+		toolParser = &toolCallStreamParser{}
+	}
+	emit := func(text string) {
+		if toolParser == nil {
+			sendText(text)
+			return
+		}
+		text, calls := toolParser.Feed(text)
+		sendText(text)
+		sendToolCalls(calls)
+	}
+
+	stopFilter := newStopSequenceFilter(stopSequences)
+	finishReason := ""
+	var completionText strings.Builder
+	var reportedUsage *RaycastUsage
+	err := readRaycastEvents(response.Body, func(data RaycastSSEData) bool {
+		if data.FinishReason != "" {
+			finishReason = data.FinishReason
+		}
+		if data.Usage != nil {
+			reportedUsage = data.Usage
+		}
+		text := stopFilter.Feed(data.Text)
+		completionText.WriteString(text)
+		emit(text)
+		_, stopped := stopFilter.Stopped()
+		return !stopped
+	})
+	if err != nil {
+		if clientDisconnected(c) {
+			logCancelledRequest(c, opts.Model)
+			return
+		}
+		slog.Error("Error reading from response", "error", err)
+	}
+
+	rest := stopFilter.Flush()
+	completionText.WriteString(rest)
+	emit(rest)
+	hasToolCalls := false
+	if toolParser != nil {
+		sendText(toolParser.Flush())
+		hasToolCalls = toolParser.HasToolCalls()
+	}
+
+	// The last chunk carries the finish reason and the usage
+	_, stopped := stopFilter.Stopped()
+	usage := buildUsage(opts.Request, completionText.String(), reportedUsage)
+	record.setUsage(opts.Request, usage)
+	logReply(opts, completionText.String(), usage)
+	final := newGeminiResponse(opts.Model, []GeminiPart{}, geminiFinishReason(finishReason, stopped, hasToolCalls))
+	final.UsageMetadata = geminiUsage(usage)
+	writeChunk(final)
+
+	if !sse {
+		fmt.Fprint(c.Writer, "]")
+		flusher.Flush()
+	}
+}
+
+// newGeminiResponse creates a response with a single candidate from the model
+func newGeminiResponse(modelId string, parts []GeminiPart, finishReason string) GeminiGenerateContentResponse {
+	return GeminiGenerateContentResponse{
+		Candidates: []GeminiCandidate{{
+			Content:      GeminiContent{Role: "model", Parts: parts},
+			FinishReason: finishReason,
+		}},
+		ModelVersion: modelId,
+		ResponseID:   newGeminiResponseID(),
+	}
+}
+
+// newGeminiResponseID generates a response ID
+func newGeminiResponseID() string {
+	return strings.ReplaceAll(uuid.New().String(), "-", "")
+}
+
+// geminiUsage converts usage into Gemini usage metadata
+func geminiUsage(usage OpenAIUsage) *GeminiUsageMetadata {
+	return &GeminiUsageMetadata{
+		PromptTokenCount:     usage.PromptTokens,
+		CandidatesTokenCount: usage.CompletionTokens,
+		TotalTokenCount:      usage.TotalTokens,
+	}
+}
+
+// convertGeminiContents converts Gemini contents into OpenAI messages so they
+// can go through the same conversion as chat completions
+func convertGeminiContents(contents []GeminiContent) ([]OpenAIMessage, error) {
+	var openaiMessages []OpenAIMessage
+
+	// Function responses usually refer to their call by name only
+	var pending pendingToolCalls
+
+	for _, content := range contents {
+		role := "user"
+		if content.Role == "model" {
+			role = "assistant"
+		}
+
+		var text strings.Builder
+		var images []interface{}
+		var toolCalls []OpenAIToolCall
+		for _, part := range content.Parts {
+			switch {
+			case part.FunctionCall != nil:
+				call := OpenAIToolCall{ID: part.FunctionCall.ID, Type: "function"}
+				call.Function.Name = part.FunctionCall.Name
+				call.Function.Arguments = "{}"
+				if len(part.FunctionCall.Args) > 0 {
+					call.Function.Arguments = string(part.FunctionCall.Args)
+				}
+				pending.add(&call)
+				toolCalls = append(toolCalls, call)
+			case part.FunctionResponse != nil:
+				id, name := pending.answer(part.FunctionResponse.ID, part.FunctionResponse.Name)
+				openaiMessages = append(openaiMessages, OpenAIMessage{
+					Role:       "tool",
+					Content:    string(part.FunctionResponse.Response),
+					Name:       name,
+					ToolCallID: id,
+				})
+			case part.InlineData != nil:
+				if !strings.HasPrefix(part.InlineData.MimeType, "image/") {
+					return nil, fmt.Errorf("Unsupported MIME type: %s", part.InlineData.MimeType)
+				}
+				images = append(images, imageURLPart("data:"+part.InlineData.MimeType+";base64,"+part.InlineData.Data))
+			case part.FileData != nil:
+				if part.FileData.MimeType != "" && !strings.HasPrefix(part.FileData.MimeType, "image/") {
+					return nil, fmt.Errorf("Unsupported MIME type: %s", part.FileData.MimeType)
+				}
+				images = append(images, imageURLPart(part.FileData.FileURI))
+			default:
+				text.WriteString(part.Text)
+			}
+		}
+
+		if text.Len() > 0 || len(images) > 0 || len(toolCalls) > 0 {
+			var content interface{} = text.String()
+			if len(images) > 0 {
+				// Images travel as OpenAI content parts alongside the text
+				content = append([]interface{}{
+					map[string]interface{}{"type": "text", "text": text.String()},
+				}, images...)
+			}
+			openaiMessages = append(openaiMessages, OpenAIMessage{
+				Role:      role,
+				Content:   content,
+				ToolCalls: toolCalls,
+			})
+		}
+	}
+	return openaiMessages, nil
+}
+
+// geminiText extracts the text parts of a content, such as the system instruction
+func geminiText(content *GeminiContent) string {
+	if content == nil {
+		return ""
+	}
+	var parts []string
+	for _, part := range content.Parts {
+		if part.Text != "" {
+			parts = append(parts, part.Text)
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// convertGeminiTools converts Gemini function declarations and the function
+// calling config into their OpenAI equivalents
+func convertGeminiTools(tools []GeminiTool, toolConfig *GeminiToolConfig) ([]OpenAITool, interface{}) {
+	var callingConfig GeminiFunctionCallingConfig
+	if toolConfig != nil && toolConfig.FunctionCallingConfig != nil {
+		callingConfig = *toolConfig.FunctionCallingConfig
+	}
+
+	openaiTools := make([]OpenAITool, 0, len(tools))
+	for _, tool := range tools {
+		for _, declaration := range tool.FunctionDeclarations {
+			// Only the allowed functions are offered to the model
+			if len(callingConfig.AllowedFunctionNames) > 0 && !slices.Contains(callingConfig.AllowedFunctionNames, declaration.Name) {
+				continue
+			}
+			parameters := declaration.ParametersJSONSchema
+			if parameters == nil {
+				parameters = declaration.Parameters
+			}
+			openaiTools = append(openaiTools, OpenAITool{
+				Type: "function",
+				Function: OpenAIToolFunction{
+					Name:        declaration.Name,
+					Description: declaration.Description,
+					Parameters:  parameters,
+				},
+			})
+		}
+	}
+
+	switch strings.ToUpper(callingConfig.Mode) {
+	case "ANY":
+		if len(callingConfig.AllowedFunctionNames) == 1 {
+			return openaiTools, map[string]interface{}{
+				"type":     "function",
+				"function": map[string]interface{}{"name": callingConfig.AllowedFunctionNames[0]},
+			}
+		}
+		return openaiTools, "required"
+	case "NONE":
+		return openaiTools, "none"
+	case "":
+		return openaiTools, nil
+	}
+	return openaiTools, "auto"
+}
+
+// geminiFunctionCallPart converts a parsed tool call into a functionCall part
+func geminiFunctionCallPart(call OpenAIToolCall) GeminiPart {
+	args := json.RawMessage(call.Function.Arguments)
+	if !json.Valid(args) {
+		args = json.RawMessage("{}")
+	}
+	return GeminiPart{FunctionCall: &GeminiFunctionCall{
+		ID:   call.ID,
+		Name: call.Function.Name,
+		Args: args,
+	}}
+}
+
+// geminiFinishReason maps the Raycast finish reason to a Gemini finish reason.
+// Gemini finishes with STOP on stop sequences and function calls alike.
+func geminiFinishReason(finishReason string, stopped bool, toolUse bool) string {
+	if stopped {
+		return "STOP"
+	}
+	switch mapFinishReason(finishReason, toolUse) {
+	case "length":
+		return "MAX_TOKENS"
+	case "content_filter":
+		return "SAFETY"
+	}
+	return "STOP"
+}
+
+// handleGeminiModels lists the models in Gemini format
+func handleGeminiModels(c *gin.Context, config Config) {
+	models, err := config.ModelCache.GetModels(config)
+	if err != nil {
+		geminiError(c, http.StatusInternalServerError, fmt.Sprintf("An error occurred while fetching models: %v", err))
+		return
+	}
+
+	geminiModels := []GeminiModel{}
+	for _, info := range listModels(c, config, models) {
+		geminiModels = append(geminiModels, newGeminiModel(info.ID))
+	}
+	c.JSON(http.StatusOK, gin.H{"models": geminiModels})
+}
+
+// handleGeminiModel returns a single model in Gemini format
+func handleGeminiModel(c *gin.Context, config Config) {
+	models, err := config.ModelCache.GetModels(config)
+	if err != nil {
+		geminiError(c, http.StatusInternalServerError, fmt.Sprintf("An error occurred while fetching models: %v", err))
+		return
+	}
+
+	id := c.Param("model")
+	for _, info := range listModels(c, config, models) {
+		if info.ID == id {
+			c.JSON(http.StatusOK, newGeminiModel(info.ID))
+			return
+		}
+	}
+	geminiError(c, http.StatusNotFound, fmt.Sprintf("Model is not found: models/%s", id))
+}
+
+// newGeminiModel describes a model in Gemini format
+func newGeminiModel(id string) GeminiModel {
+	return GeminiModel{
+		Name:                       "models/" + id,
+		BaseModelID:                id,
+		DisplayName:                id,
+		SupportedGenerationMethods: []string{geminiGenerateContent, geminiStreamGenerateContent},
+	}
+}
+
+// geminiStatus maps an HTTP status to a Google API error status
+func geminiStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return "INVALID_ARGUMENT"
+	case http.StatusUnauthorized:
+		return "UNAUTHENTICATED"
+	case http.StatusForbidden:
+		return "PERMISSION_DENIED"
+	case http.StatusNotFound:
+		return "NOT_FOUND"
+	case http.StatusTooManyRequests:
+		return "RESOURCE_EXHAUSTED"
+	case 499:
+		return "CANCELLED"
+	case http.StatusServiceUnavailable:
+		return "UNAVAILABLE"
+	}
+	return "INTERNAL"
+}
+
+// geminiError writes an error response in Gemini format
+func geminiError(c *gin.Context, status int, message string) {
+	var resp GeminiErrorResponse
+	resp.Error.Code = status
+	resp.Error.Message = message
+	resp.Error.Status = geminiStatus(status)
+	c.JSON(status, resp)
+}
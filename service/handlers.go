@@ -13,17 +13,15 @@
 package service
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"sort"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 )
 
 // handleChatCompletions handles OpenAI chat completions endpoint
@@ -35,6 +33,7 @@ func handleChatCompletions(c *gin.Context, config Config) {
 				Message string `json:"message"`
 				Type    string `json:"type"`
 				Details string `json:"details,omitempty"`
+				Code    string `json:"code,omitempty"`
 			}{
 				Message: "Invalid request body",
 				Type:    "invalid_request_error",
@@ -50,6 +49,7 @@ func handleChatCompletions(c *gin.Context, config Config) {
 				Message string `json:"message"`
 				Type    string `json:"type"`
 				Details string `json:"details,omitempty"`
+				Code    string `json:"code,omitempty"`
 			}{
 				Message: "Missing or invalid 'messages' field",
 				Type:    "invalid_request_error",
@@ -58,169 +58,92 @@ func handleChatCompletions(c *gin.Context, config Config) {
 		return
 	}
 
-	// Use default model if not specified
-	model := body.Model
-	if model == "" {
-		model = DefaultModel
-	}
-
-	// Use default temperature if not specified
-	temperature := body.Temperature
-	if temperature == 0 {
-		temperature = 0.5
+	n := body.N
+	if n == 0 {
+		n = 1
 	}
-
-	stream := body.Stream
-
-	// Get models from cache or fetch them if cache is expired
-	models, err := config.ModelCache.GetModels(config)
-	if err != nil {
-		log.Printf("Warning: Using models with possible error: %v", err)
+	if n < 0 || n > maxCompletionChoices {
+		message := fmt.Sprintf("Invalid 'n' field: %d choices requested, at most %d choices are allowed", n, maxCompletionChoices)
+		c.JSON(http.StatusBadRequest, newErrorResponse(message, "invalid_request_error", ""))
+		return
 	}
-
-	// Get provider info from the models
-	provider, modelName := getProviderInfo(model, models)
-	log.Printf("Using provider: %s, model: %s", provider, modelName)
-
-	// Create a unique thread ID for this conversation
-	threadId := uuid.New().String()
-
-	// Check if we have system_prompt in the extra data
-	systemPrompt := "markdown" // default system prompt
-	if value, exists := body.Extra["system"]; exists {
-		if sysPrompt, ok := value.(string); ok && sysPrompt != "" {
-			systemPrompt = sysPrompt
-			log.Printf("Using custom system prompt: %s", systemPrompt)
-		}
+	bestOf := body.BestOf
+	if bestOf == 0 {
+		bestOf = n
 	}
-
-	// Prepare Raycast request
-	raycastRequest := RaycastChatRequest{
-		AdditionalSystemInstructions: "", // This could be configurable
-		Debug:                        false,
-		Locale:                       "en-US",
-		Messages:                     convertMessages(body.Messages),
-		Model:                        modelName,
-		Provider:                     provider,
-		Source:                       "ai_chat",
-		SystemInstruction:            systemPrompt,
-		Temperature:                  temperature,
-		ThreadID:                     threadId,
-		Tools: []struct {
-			Name string `json:"name"`
-			Type string `json:"type"`
-		}{
-			// Uncomment to enable tools if needed
-			// {Name: "web_search", Type: "remote_tool"},
-			// {Name: "search_images", Type: "remote_tool"},
-		},
-	}
-
-	// 声明变量用于存储请求体
-	var requestBody []byte
-	var jsonErr error
-	
-	// Add max_tokens if specified
-	if body.MaxTokens > 0 {
-		// Add max_tokens field dynamically
-		requestMap := make(map[string]interface{})
-		requestBytes, _ := json.Marshal(raycastRequest)
-		json.Unmarshal(requestBytes, &requestMap)
-		requestMap["max_tokens"] = body.MaxTokens
-		requestBody, jsonErr = json.Marshal(requestMap)
-	} else {
-		// Use the original raycastRequest if no max_tokens
-		requestBody, jsonErr = json.Marshal(raycastRequest)
+	if bestOf > maxCompletionChoices {
+		message := fmt.Sprintf("Invalid 'best_of' field: %d candidates requested, at most %d are allowed", bestOf, maxCompletionChoices)
+		c.JSON(http.StatusBadRequest, newErrorResponse(message, "invalid_request_error", ""))
+		return
 	}
-
-	if jsonErr != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Error: struct {
-				Message string `json:"message"`
-				Type    string `json:"type"`
-				Details string `json:"details,omitempty"`
-			}{
-				Message: "Failed to marshal request",
-				Type:    "server_error",
-				Details: jsonErr.Error(),
-			},
-		})
+	if relayErr := checkBestOf(n, bestOf, body.Stream); relayErr != nil {
+		c.JSON(relayErr.Status, relayErr.toErrorResponse())
 		return
 	}
 
-	log.Printf("Sending request to Raycast: %s", string(requestBody))
+	// Describe the available tools to the model, if any
+	toolInstructions := buildToolInstructions(body.Tools, body.ToolChoice)
+	withTools := toolInstructions != ""
 
-	client := &http.Client{
-		Timeout: 5 * time.Minute, // Longer timeout for chat completions
-	}
-	req, err := http.NewRequest("POST", RaycastAPIURL, bytes.NewBuffer(requestBody))
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Error: struct {
-				Message string `json:"message"`
-				Type    string `json:"type"`
-				Details string `json:"details,omitempty"`
-			}{
-				Message: "Error creating request",
-				Type:    "server_error",
-				Details: err.Error(),
-			},
-		})
-		return
+	// System and developer messages become the Raycast system instruction,
+	// after the non-standard top-level system field if one was sent
+	systemPrompt, messages := extractSystemMessages(body.Messages)
+	if body.System != "" {
+		systemPrompt = joinNonEmpty("\n\n", body.System, systemPrompt)
 	}
 
-	for key, value := range getRaycastHeaders(config) {
-		req.Header.Set(key, value)
+	// Use default model if not specified
+	model := body.Model
+	if model == "" {
+		model = config.DefaultModel
 	}
 
-	resp, err := client.Do(req)
+	raycastMessages, err := convertMessages(config, messages)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{
-			Error: struct {
-				Message string `json:"message"`
-				Type    string `json:"type"`
-				Details string `json:"details,omitempty"`
-			}{
-				Message: fmt.Sprintf("Error sending request to Raycast: %v", err),
-				Type:    "relay_error",
-				Details: err.Error(),
-			},
-		})
+		c.JSON(http.StatusBadRequest, newErrorResponse("Invalid image content", "invalid_request_error", err.Error()))
+		return
+	}
+	if !admitFanOut(c, config, bestOf) {
 		return
 	}
-	defer resp.Body.Close()
-
-	log.Printf("Response status: %d", resp.StatusCode)
-
-	if resp.StatusCode != http.StatusOK {
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		errorText := string(bodyBytes)
 
-		// Try to parse error as JSON
-		var errorJson map[string]interface{}
-		if err := json.Unmarshal(bodyBytes, &errorJson); err == nil {
-			jsonBytes, _ := json.Marshal(errorJson)
-			errorText = string(jsonBytes)
+	// Send the request, retrying and falling back to other models on failure.
+	// Every candidate choice is a separate Raycast request in its own thread,
+	// sent concurrently.
+	params := raycastChatParams{
+		Model:                        model,
+		Messages:                     raycastMessages,
+		SystemInstruction:            systemPrompt,
+		AdditionalSystemInstructions: toolInstructions,
+		Temperature:                  body.Temperature,
+		MaxTokens:                    body.MaxTokens,
+	}
+	results := make([]relayResult, bestOf)
+	relayErrs := make([]*relayError, bestOf)
+	fanOut(bestOf, func(i int) {
+		results[i], relayErrs[i] = relayChat(c, config, params)
+	})
+	defer closeRelayResults(results)
+	for _, relayErr := range relayErrs {
+		if relayErr != nil {
+			c.JSON(relayErr.Status, relayErr.toErrorResponse())
+			return
 		}
+	}
 
-		c.JSON(resp.StatusCode, ErrorResponse{
-			Error: struct {
-				Message string `json:"message"`
-				Type    string `json:"type"`
-				Details string `json:"details,omitempty"`
-			}{
-				Message: fmt.Sprintf("Raycast API error: %d %s", resp.StatusCode, errorText),
-				Type:    "relay_error",
-			},
-		})
-		return
+	opts := chatResponseOptions{
+		Model:        results[0].Model,
+		WithTools:    withTools,
+		IncludeUsage: body.StreamOptions != nil && body.StreamOptions.IncludeUsage,
 	}
 
 	// Handle streaming response
-	if stream {
-		handleStreamingResponse(c, resp, model)
+	getRequestRecord(c.Request.Context()).setStream(body.Stream)
+	if body.Stream {
+		defer config.Metrics.StreamStarted(c.FullPath())()
+		handleStreamingResponse(c, results, opts)
 	} else {
-		handleNonStreamingResponse(c, resp, model)
+		handleNonStreamingResponse(c, results, n, opts)
 	}
 }
 
@@ -234,6 +157,7 @@ func handleModels(c *gin.Context, config Config) {
 				Message string `json:"message"`
 				Type    string `json:"type"`
 				Details string `json:"details,omitempty"`
+				Code    string `json:"code,omitempty"`
 			}{
 				Message: fmt.Sprintf("An error occurred while fetching models: %v", err),
 				Type:    "relay_error",
@@ -243,7 +167,7 @@ func handleModels(c *gin.Context, config Config) {
 		return
 	}
 
-	// Convert models to a slice that can be sorted
+	// Convert models to a slice
 	var modelSlice []struct {
 		ID      string `json:"id"`
 		Object  string `json:"object"`
@@ -251,25 +175,20 @@ func handleModels(c *gin.Context, config Config) {
 		OwnedBy string `json:"owned_by"`
 	}
 
-	for _, info := range models {
+	for _, info := range listModels(c, config, models) {
 		modelSlice = append(modelSlice, struct {
 			ID      string `json:"id"`
 			Object  string `json:"object"`
 			Created int64  `json:"created"`
 			OwnedBy string `json:"owned_by"`
 		}{
-			ID:      info.Model,
+			ID:      info.ID,
 			Object:  "model",
 			Created: time.Now().Unix(),
 			OwnedBy: info.Provider,
 		})
 	}
 
-	// Sort by ID
-	sort.Slice(modelSlice, func(i, j int) bool {
-		return modelSlice[i].ID < modelSlice[j].ID
-	})
-
 	// Create OpenAI format response
 	openaiModels := OpenAIModelResponse{
 		Object: "list",
@@ -283,6 +202,7 @@ func handleModels(c *gin.Context, config Config) {
 				Message string `json:"message"`
 				Type    string `json:"type"`
 				Details string `json:"details,omitempty"`
+				Code    string `json:"code,omitempty"`
 			}{
 				Message: "Error formatting JSON response",
 				Type:    "server_error",
@@ -300,6 +220,40 @@ func handleModels(c *gin.Context, config Config) {
 	c.Writer.Write(jsonData)
 }
 
+// listedModel is a model, or an alias of one, listed to the client
+type listedModel struct {
+	ID       string
+	Provider string
+}
+
+// listModels returns the models the client key may use along with the
+// aliases pointing to them, sorted by ID
+func listModels(c *gin.Context, config Config, models map[string]ModelCacheEntry) []listedModel {
+	var listed []listedModel
+	policy := getAPIKeyPolicy(c)
+	for _, info := range models {
+		// Only list the models the client key may use
+		if policy.AllowsModel(info.Model) {
+			listed = append(listed, listedModel{ID: info.Model, Provider: info.Provider})
+		}
+	}
+
+	// List aliases next to the real models, owned by the provider of their target
+	for alias, target := range config.ModelRoutes.Aliases() {
+		info, ok := config.ModelRoutes.Resolve(target, models)
+		if _, exists := models[alias]; exists || !ok || !policy.AllowsModel(info.Model) {
+			continue
+		}
+		listed = append(listed, listedModel{ID: alias, Provider: info.Provider})
+	}
+
+	// Sort by ID
+	sort.Slice(listed, func(i, j int) bool {
+		return listed[i].ID < listed[j].ID
+	})
+	return listed
+}
+
 // handleRefreshModels handles manual refresh of the model cache
 func handleRefreshModels(c *gin.Context, config Config) {
 	config.ModelCache.ForceCacheRefresh(config)
@@ -308,3 +262,89 @@ func handleRefreshModels(c *gin.Context, config Config) {
 		"message": "Model cache refreshed",
 	})
 }
+
+// handleTokenStatus reports the state of every Raycast bearer token
+func handleTokenStatus(c *gin.Context, config Config) {
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"data":   config.TokenPool.Status(),
+	})
+}
+
+// handleBreakerStatus reports the circuit breakers that have seen failures
+func handleBreakerStatus(c *gin.Context, config Config) {
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"data":   config.Breakers.Status(),
+	})
+}
+
+// handleListKeys lists the client API keys, without their secrets
+func handleListKeys(c *gin.Context, config Config) {
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"data":   config.Keys.List(),
+	})
+}
+
+// handleCreateKey creates a client API key. The key is only shown in this response.
+func handleCreateKey(c *gin.Context, config Config) {
+	var policy APIKeyPolicy
+	if err := c.ShouldBindJSON(&policy); err != nil {
+		c.JSON(http.StatusBadRequest, newErrorResponse("Invalid request body", "invalid_request_error", err.Error()))
+		return
+	}
+
+	info, key, err := config.Keys.Create(policy)
+	if err != nil {
+		keyStoreError(c, err)
+		return
+	}
+	slog.Info("API key created", "id", info.ID, "name", info.Name)
+	c.JSON(http.StatusCreated, gin.H{
+		"key":  key,
+		"data": info,
+	})
+}
+
+// handleUpdateKey changes the name, expiry, models or limits of a client API key
+func handleUpdateKey(c *gin.Context, config Config) {
+	var update APIKeyUpdate
+	if err := c.ShouldBindJSON(&update); err != nil {
+		c.JSON(http.StatusBadRequest, newErrorResponse("Invalid request body", "invalid_request_error", err.Error()))
+		return
+	}
+
+	info, err := config.Keys.Update(c.Param("id"), update)
+	if err != nil {
+		keyStoreError(c, err)
+		return
+	}
+	slog.Info("API key updated", "id", info.ID, "name", info.Name)
+	c.JSON(http.StatusOK, gin.H{"data": info})
+}
+
+// handleRevokeKey revokes a client API key
+func handleRevokeKey(c *gin.Context, config Config) {
+	info, err := config.Keys.Revoke(c.Param("id"))
+	if err != nil {
+		keyStoreError(c, err)
+		return
+	}
+	slog.Info("API key revoked", "id", info.ID, "name", info.Name)
+	c.JSON(http.StatusOK, gin.H{"data": info})
+}
+
+// keyStoreError writes the error of a key management operation
+func keyStoreError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errAPIKeyNotFound):
+		c.JSON(http.StatusNotFound, newErrorResponse(err.Error(), "not_found_error", ""))
+	case errors.Is(err, errAPIKeyReadOnly), errors.Is(err, errKeyStoreNoFile):
+		c.JSON(http.StatusConflict, newErrorResponse(err.Error(), "invalid_request_error", ""))
+	case errors.Is(err, errKeyStoreWrite):
+		c.JSON(http.StatusInternalServerError, newErrorResponse("Failed to save the key store", "server_error", err.Error()))
+	default:
+		c.JSON(http.StatusBadRequest, newErrorResponse(err.Error(), "invalid_request_error", ""))
+	}
+}
@@ -0,0 +1,160 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 22:18:05
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 22:18:05
+ * @FilePath: /raycast2api/service/health.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Readiness states
+const (
+	StatusReady        = "ready"
+	StatusNotReady     = "not_ready"
+	StatusShuttingDown = "shutting_down"
+)
+
+// UpstreamProbe checks that Raycast is reachable and accepts a token by
+// fetching the model list. Results are cached so that frequent readiness
+// probes do not hammer Raycast.
+type UpstreamProbe struct {
+	last  *UpstreamCheck
+	mutex sync.Mutex // Held during a check, so concurrent probes share it
+}
+
+// UpstreamCheck is the outcome of an upstream probe
+type UpstreamCheck struct {
+	OK        bool      `json:"ok"`
+	CheckedAt time.Time `json:"checked_at"`
+	LatencyMs int64     `json:"latency_ms"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// Check returns the cached outcome, probing Raycast when it is older than
+// ReadinessCacheTTL. A successful probe also refreshes the model cache.
+func (p *UpstreamProbe) Check(config Config) UpstreamCheck {
+	if p == nil {
+		return probeUpstream(config)
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.last == nil || time.Since(p.last.CheckedAt) >= ReadinessCacheTTL {
+		check := probeUpstream(config)
+		p.last = &check
+	}
+	return *p.last
+}
+
+// probeUpstream fetches the model list from Raycast
+func probeUpstream(config Config) UpstreamCheck {
+	start := time.Now()
+	models, err := fetchModelsFromAPI(config)
+	check := UpstreamCheck{OK: err == nil, CheckedAt: start, LatencyMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		check.Error = strings.TrimSpace(err.Error())
+		return check
+	}
+	config.ModelCache.update(config, models)
+	return check
+}
+
+// ReadinessReport describes whether the relay can serve requests and why
+type ReadinessReport struct {
+	Status            string            `json:"status"`
+	Reasons           []string          `json:"reasons,omitempty"`
+	Upstream          *UpstreamCheck    `json:"upstream,omitempty"`
+	Tokens            *TokenPoolSummary `json:"tokens,omitempty"`
+	ModelCache        *ModelCacheStatus `json:"model_cache,omitempty"`
+	LastUpstreamError *UpstreamError    `json:"last_upstream_error,omitempty"`
+	InFlight          int64             `json:"in_flight"`
+}
+
+// checkReadiness builds the readiness report. The relay is ready when it is
+// not shutting down, a token is available and Raycast accepted the last probe.
+func checkReadiness(config Config) ReadinessReport {
+	report := ReadinessReport{Status: StatusReady, InFlight: config.Drain.InFlight()}
+	if config.Drain.Draining() {
+		report.Status = StatusShuttingDown
+		report.Reasons = append(report.Reasons, "the relay is shutting down")
+		return report
+	}
+
+	tokens := config.TokenPool.Summary()
+	report.Tokens = &tokens
+	if tokens.Available == 0 {
+		report.Reasons = append(report.Reasons, "every Raycast token is cooling down")
+	}
+
+	upstream := config.Upstream.Check(config)
+	report.Upstream = &upstream
+	if !upstream.OK {
+		// The error may quote upstream response bodies, so it is only shown
+		// in the verbose report, which needs the admin key
+		report.Reasons = append(report.Reasons, "Raycast probe failed")
+	}
+
+	// The probe may have refreshed the cache, so read it afterwards
+	modelCache := config.ModelCache.Status()
+	report.ModelCache = &modelCache
+	report.LastUpstreamError = config.TokenPool.LastError()
+
+	if len(report.Reasons) > 0 {
+		report.Status = StatusNotReady
+	}
+	return report
+}
+
+// handleReady is the readiness probe: 200 when the relay can serve, 503 otherwise
+func handleReady(c *gin.Context, config Config) {
+	report := checkReadiness(config)
+	status := http.StatusOK
+	if report.Status != StatusReady {
+		status = http.StatusServiceUnavailable
+	}
+	response := gin.H{"status": report.Status}
+	if len(report.Reasons) > 0 {
+		response["reasons"] = report.Reasons
+	}
+	c.JSON(status, response)
+}
+
+// handleHealth is the liveness probe. With ?verbose=1 it reports the full
+// readiness state instead, with a 503 when the relay cannot serve. The report
+// reveals the token pool and upstream errors, so it requires the admin key.
+func handleHealth(c *gin.Context, config Config) {
+	if verbose, _ := strconv.ParseBool(c.Query("verbose")); !verbose {
+		if config.Drain.Draining() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": StatusShuttingDown})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+		return
+	}
+	if !validateAdminKey(c, config) {
+		c.JSON(http.StatusUnauthorized, newErrorResponse("Invalid admin key, the verbose health report requires the admin key", "authentication_error", ""))
+		return
+	}
+
+	report := checkReadiness(config)
+	status := http.StatusOK
+	if report.Status != StatusReady {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, report)
+}
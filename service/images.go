@@ -0,0 +1,257 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 15:20:11
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 15:20:11
+ * @FilePath: /raycast2api/service/images.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// extractImageURLs returns the URLs of the image_url parts of a message content
+func extractImageURLs(content interface{}) []string {
+	parts, ok := content.([]interface{})
+	if !ok {
+		return nil
+	}
+
+	var urls []string
+	for _, part := range parts {
+		partMap, ok := part.(map[string]interface{})
+		if !ok || partMap["type"] != "image_url" {
+			continue
+		}
+		// image_url is an object with a url field, older clients send a plain string
+		switch imageURL := partMap["image_url"].(type) {
+		case string:
+			urls = append(urls, imageURL)
+		case map[string]interface{}:
+			if url, ok := imageURL["url"].(string); ok {
+				urls = append(urls, url)
+			}
+		}
+	}
+	return urls
+}
+
+// imageURLPart creates an image_url content part, for APIs whose images are
+// converted into OpenAI content parts
+func imageURLPart(url string) interface{} {
+	return map[string]interface{}{
+		"type":      "image_url",
+		"image_url": map[string]interface{}{"url": url},
+	}
+}
+
+// loadImageAttachment resolves a data URL into an image attachment, enforcing
+// the size limit. http(s) URLs are only downloaded by resolveImages, once the
+// model is known to accept images, and only when remote images are enabled.
+func loadImageAttachment(config Config, url string) (RaycastAttachment, error) {
+	if strings.HasPrefix(url, "data:") {
+		return decodeDataURL(url, config.MaxImageBytes)
+	}
+	if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+		if !config.AllowRemoteImages {
+			return RaycastAttachment{}, fmt.Errorf("remote image URLs are disabled, send the image as a data URL")
+		}
+		return RaycastAttachment{Type: "image", remote: &remoteImage{url: url}}, nil
+	}
+	return RaycastAttachment{}, fmt.Errorf("unsupported image URL, expected a data URL or an http(s) URL")
+}
+
+// decodeDataURL decodes a base64 data URL such as data:image/png;base64,...
+func decodeDataURL(url string, maxBytes int64) (RaycastAttachment, error) {
+	header, data, ok := strings.Cut(strings.TrimPrefix(url, "data:"), ",")
+	if !ok || !strings.HasSuffix(header, ";base64") {
+		return RaycastAttachment{}, fmt.Errorf("image data URL must be base64 encoded")
+	}
+
+	mimeType := strings.TrimSuffix(header, ";base64")
+	if !strings.HasPrefix(mimeType, "image/") {
+		return RaycastAttachment{}, fmt.Errorf("unsupported image type %q", mimeType)
+	}
+
+	if int64(base64.StdEncoding.DecodedLen(len(data))) > maxBytes+2 {
+		return RaycastAttachment{}, fmt.Errorf("image exceeds the %d byte limit", maxBytes)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return RaycastAttachment{}, fmt.Errorf("invalid base64 image data: %w", err)
+	}
+	if int64(len(decoded)) > maxBytes {
+		return RaycastAttachment{}, fmt.Errorf("image exceeds the %d byte limit", maxBytes)
+	}
+
+	return RaycastAttachment{
+		Type:     "image",
+		MimeType: mimeType,
+		Data:     base64.StdEncoding.EncodeToString(decoded),
+	}, nil
+}
+
+// remoteImage is an http(s) image URL, downloaded at most once even when the
+// request is sent several times, e.g. to fallback models
+type remoteImage struct {
+	url        string
+	once       sync.Once
+	attachment RaycastAttachment
+	err        error
+}
+
+// load downloads the image on the first call and returns the same result after
+func (r *remoteImage) load(ctx context.Context, maxBytes int64) (RaycastAttachment, error) {
+	r.once.Do(func() {
+		r.attachment, r.err = fetchImage(ctx, r.url, maxBytes)
+	})
+	return r.attachment, r.err
+}
+
+// resolveImages downloads the remote images of the messages. The messages are
+// copied, as the same messages can be shared by concurrent requests.
+func resolveImages(ctx context.Context, maxBytes int64, messages []RaycastMessage) ([]RaycastMessage, error) {
+	resolved := make([]RaycastMessage, len(messages))
+	for i, msg := range messages {
+		resolved[i] = msg
+		if len(msg.Content.Attachments) == 0 {
+			continue
+		}
+		attachments := make([]RaycastAttachment, len(msg.Content.Attachments))
+		for j, attachment := range msg.Content.Attachments {
+			if attachment.remote != nil {
+				var err error
+				if attachment, err = attachment.remote.load(ctx, maxBytes); err != nil {
+					return nil, fmt.Errorf("message %d: %w", i, err)
+				}
+			}
+			attachments[j] = attachment
+		}
+		resolved[i].Content.Attachments = attachments
+	}
+	return resolved, nil
+}
+
+// Networks images cannot be fetched from, besides the loopback, private,
+// link-local (including cloud metadata) and multicast addresses
+var blockedImageNetworks = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // "This" network
+	netip.MustParsePrefix("100.64.0.0/10"), // Carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),  // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"), // Benchmarking
+	netip.MustParsePrefix("64:ff9b::/96"),  // NAT64, which can map to any IPv4 address
+}
+
+// checkImageAddress refuses connections to internal addresses. It runs on the
+// resolved address of every connection, so DNS names and redirects pointing
+// inside the network are refused as well.
+func checkImageAddress(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	ip := addrPort.Addr().Unmap()
+	blocked := ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsMulticast()
+	for _, prefix := range blockedImageNetworks {
+		blocked = blocked || prefix.Contains(ip)
+	}
+	if blocked {
+		return fmt.Errorf("image address %s is not public", ip)
+	}
+	return nil
+}
+
+// imageClient downloads remote images. It does not use a proxy, so that the
+// address check applies to the image host itself.
+var imageClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: checkImageAddress,
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// errImageFetch is returned to clients whose image could not be downloaded.
+// The cause is only logged, so that the relay does not reveal what it reached.
+var errImageFetch = errors.New("image URL could not be fetched")
+
+// fetchImage downloads an image and encodes it as an attachment
+func fetchImage(ctx context.Context, url string, maxBytes int64) (RaycastAttachment, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return RaycastAttachment{}, errImageFetch
+	}
+	resp, err := imageClient.Do(req)
+	if err != nil {
+		slog.Warn("Error fetching image", "url", url, "error", err)
+		return RaycastAttachment{}, errImageFetch
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		slog.Warn("Error fetching image", "url", url, "status", resp.StatusCode)
+		return RaycastAttachment{}, errImageFetch
+	}
+	if resp.ContentLength > maxBytes {
+		return RaycastAttachment{}, fmt.Errorf("image exceeds the %d byte limit", maxBytes)
+	}
+
+	// Read one byte past the limit to detect oversized bodies without a length
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		slog.Warn("Error reading image", "url", url, "error", err)
+		return RaycastAttachment{}, errImageFetch
+	}
+	if int64(len(data)) > maxBytes {
+		return RaycastAttachment{}, fmt.Errorf("image exceeds the %d byte limit", maxBytes)
+	}
+
+	mimeType := strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	if !strings.HasPrefix(mimeType, "image/") {
+		mimeType = http.DetectContentType(data)
+	}
+	if !strings.HasPrefix(mimeType, "image/") {
+		slog.Warn("Image URL did not return an image", "url", url, "mime_type", mimeType)
+		return RaycastAttachment{}, fmt.Errorf("image URL did not return an image")
+	}
+
+	return RaycastAttachment{
+		Type:     "image",
+		MimeType: mimeType,
+		Data:     base64.StdEncoding.EncodeToString(data),
+	}, nil
+}
+
+// hasAttachments reports whether any message carries attachments
+func hasAttachments(messages []RaycastMessage) bool {
+	for _, msg := range messages {
+		if len(msg.Content.Attachments) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,730 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 18:31:44
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 18:31:44
+ * @FilePath: /raycast2api/service/keys.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// APIKeyPolicy describes a client API key and what it may do
+type APIKeyPolicy struct {
+	Name              string     `json:"name"`                     // Identity used in logs and metrics
+	Key               string     `json:"key,omitempty"`            // Key value, only set when loading
+	AllowedModels     []string   `json:"allowed_models,omitempty"` // Glob patterns, all models when empty
+	DeniedModels      []string   `json:"denied_models,omitempty"`  // Glob patterns, checked before the allowed ones
+	RequestsPerMinute int        `json:"rpm,omitempty"`            // 0 means unlimited
+	TokensPerDay      int        `json:"tpd,omitempty"`            // 0 means unlimited, resets at midnight UTC
+	ExpiresAt         *time.Time `json:"expires_at,omitempty"`     // The key is rejected from then on
+}
+
+// anonymousPolicy applies to every request when no client keys are configured
+var anonymousPolicy = APIKeyPolicy{Name: "anonymous"}
+
+// AllowsModel reports whether the key may use a model
+func (p APIKeyPolicy) AllowsModel(model string) bool {
+	for _, pattern := range p.DeniedModels {
+		if matchModelPattern(pattern, model) {
+			return false
+		}
+	}
+	if len(p.AllowedModels) == 0 {
+		return true
+	}
+	for _, pattern := range p.AllowedModels {
+		if matchModelPattern(pattern, model) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchModelPattern matches a model against a glob pattern such as gpt-4*
+func matchModelPattern(pattern, model string) bool {
+	matched, err := path.Match(strings.ToLower(pattern), strings.ToLower(model))
+	return err == nil && matched
+}
+
+// KeyStore holds the client API keys with their policies and usage. Keys
+// from the environment are read-only; keys created through the admin API are
+// persisted to the store file, if one is configured.
+type KeyStore struct {
+	keys  map[string]*apiKeyState // Keyed by the SHA-256 of the key
+	path  string                  // Store file of the admin managed keys
+	mutex sync.Mutex
+}
+
+// Sources of client keys
+const (
+	APIKeySourceConfig = "config" // API_KEY or API_KEYS_FILE
+	APIKeySourceAdmin  = "admin"  // Created through /admin/keys
+)
+
+// apiKeyState tracks a single client key and its usage
+type apiKeyState struct {
+	storedAPIKey
+	source     string
+	requests   []time.Time // Requests admitted during the last minute
+	tokenDay   string      // UTC day tokensUsed belongs to
+	tokensUsed int
+}
+
+// storedAPIKey is a client key as persisted in the store file. Only the hash
+// of the key is kept, plus a short prefix to recognise it.
+type storedAPIKey struct {
+	ID        string     `json:"id"`
+	KeyHash   string     `json:"key_hash"`
+	KeyPrefix string     `json:"key_prefix,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	APIKeyPolicy
+}
+
+// APIKeyInfo describes a client key for the admin API, without its secret
+type APIKeyInfo struct {
+	ID         string     `json:"id"`
+	Source     string     `json:"source"`
+	KeyPrefix  string     `json:"key_prefix,omitempty"`
+	CreatedAt  *time.Time `json:"created_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	Active     bool       `json:"active"`
+	TokensUsed int        `json:"tokens_used_today"`
+	APIKeyPolicy
+}
+
+// APIKeyUpdate changes the settings of a client key, nil fields are kept.
+// An empty ExpiresAt removes the expiry.
+type APIKeyUpdate struct {
+	Name              *string   `json:"name"`
+	ExpiresAt         *string   `json:"expires_at"`
+	AllowedModels     *[]string `json:"allowed_models"`
+	DeniedModels      *[]string `json:"denied_models"`
+	RequestsPerMinute *int      `json:"rpm"`
+	TokensPerDay      *int      `json:"tpd"`
+}
+
+// Errors of the key management API
+var (
+	errAPIKeyNotFound = errors.New("API key not found")
+	errAPIKeyReadOnly = errors.New("API key comes from the configuration and cannot be changed")
+	errKeyStoreWrite  = errors.New("error writing key store")
+	errKeyStoreNoFile = errors.New("no key store file is configured, set KEY_STORE_FILE to create keys that survive a restart")
+)
+
+// rateLimitStatus is the outcome of admitting a request
+type rateLimitStatus struct {
+	Limited string // "requests" or "tokens" when the request is rejected
+
+	RequestLimit      int
+	RequestsRemaining int
+	RequestsReset     time.Duration
+	TokenLimit        int
+	TokensUsed        int
+	TokensRemaining   int
+	TokensReset       time.Duration
+}
+
+// hashAPIKey returns the hex SHA-256 of a key, so keys are never compared
+// or stored in clear
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKey generates a client key and its id
+func newAPIKey() (key, id string, err error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	idBytes := make([]byte, 6)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", "", err
+	}
+	return "sk-" + hex.EncodeToString(secret), "key_" + hex.EncodeToString(idBytes), nil
+}
+
+// NewKeyStore creates a key store from the configured policies, adding the
+// admin managed keys of the store file when a path is given
+func NewKeyStore(policies []APIKeyPolicy, path string) (*KeyStore, error) {
+	store := &KeyStore{keys: make(map[string]*apiKeyState), path: path}
+	if path != "" {
+		if err := store.load(); err != nil {
+			return nil, err
+		}
+	}
+	if err := store.SetConfigKeys(policies); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// load reads the admin managed keys of the store file
+func (s *KeyStore) load() error {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading key store: %w", err)
+	}
+	var file struct {
+		Keys []storedAPIKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("error parsing key store: %w", err)
+	}
+	for _, stored := range file.Keys {
+		if _, ok := s.keys[stored.KeyHash]; ok {
+			return fmt.Errorf("key store entry %s duplicates another key", stored.ID)
+		}
+		if s.nameTaken(stored.Name, stored.ID) {
+			return fmt.Errorf("key store entry %s reuses the name %q", stored.ID, stored.Name)
+		}
+		s.keys[stored.KeyHash] = &apiKeyState{storedAPIKey: stored, source: APIKeySourceAdmin}
+	}
+	return nil
+}
+
+// SetConfigKeys replaces the keys coming from the configuration. Keys that
+// stay keep their usage; admin managed keys are left untouched.
+func (s *KeyStore) SetConfigKeys(policies []APIKeyPolicy) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	keys := make(map[string]*apiKeyState, len(s.keys))
+	for hash, state := range s.keys {
+		if state.source == APIKeySourceAdmin {
+			keys[hash] = state
+		}
+	}
+	for _, policy := range policies {
+		hash := hashAPIKey(policy.Key)
+		policy.Key = ""
+		if state, ok := keys[hash]; ok {
+			return fmt.Errorf("API key %q is already managed through the admin API as %s", policy.Name, state.ID)
+		}
+		for _, state := range keys {
+			if state.source == APIKeySourceAdmin && state.Name == policy.Name {
+				return fmt.Errorf("API key name %q is already used by %s", policy.Name, state.ID)
+			}
+		}
+		state := &apiKeyState{
+			storedAPIKey: storedAPIKey{ID: policy.Name, KeyHash: hash, APIKeyPolicy: policy},
+			source:       APIKeySourceConfig,
+		}
+		if previous, ok := s.keys[hash]; ok {
+			state.requests, state.tokenDay, state.tokensUsed = previous.requests, previous.tokenDay, previous.tokensUsed
+		}
+		keys[hash] = state
+	}
+	s.keys = keys
+	return nil
+}
+
+// loadAPIKeys reads client keys from the comma separated API_KEY list and an
+// optional JSON file of policies. Keys from the list are unrestricted. The
+// keys are checked by checkAPIKeys once all sources are known.
+func loadAPIKeys(list, file string) ([]APIKeyPolicy, error) {
+	var policies []APIKeyPolicy
+	for _, key := range strings.Split(list, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			policies = append(policies, APIKeyPolicy{Key: key})
+		}
+	}
+
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading API key file: %w", err)
+		}
+		var filePolicies []APIKeyPolicy
+		if err := json.Unmarshal(data, &filePolicies); err != nil {
+			return nil, fmt.Errorf("error parsing API key file: %w", err)
+		}
+		policies = append(policies, filePolicies...)
+	}
+	return policies, nil
+}
+
+// checkAPIKeys names the unnamed keys and validates the keys and policies
+func checkAPIKeys(policies []APIKeyPolicy) error {
+	seenKeys := make(map[string]bool)
+	seenNames := make(map[string]bool)
+	for i := range policies {
+		policy := &policies[i]
+		if policy.Key == "" {
+			return fmt.Errorf("API key %d has no key", i+1)
+		}
+		if seenKeys[policy.Key] {
+			return fmt.Errorf("API key %d is a duplicate", i+1)
+		}
+		if policy.Name == "" {
+			policy.Name = fmt.Sprintf("key-%d", i+1)
+		}
+		if seenNames[policy.Name] {
+			return fmt.Errorf("API key name %q is not unique", policy.Name)
+		}
+		if err := policy.validate(); err != nil {
+			return err
+		}
+		seenKeys[policy.Key] = true
+		seenNames[policy.Name] = true
+	}
+	return nil
+}
+
+// validate checks the limits and model patterns of a policy
+func (p APIKeyPolicy) validate() error {
+	if p.Name == anonymousPolicy.Name {
+		return fmt.Errorf("API key name %q is reserved", p.Name)
+	}
+	if p.RequestsPerMinute < 0 || p.TokensPerDay < 0 {
+		return fmt.Errorf("API key %q has a negative limit", p.Name)
+	}
+	for _, pattern := range slices.Concat(p.AllowedModels, p.DeniedModels) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("API key %q has an invalid model pattern %q", p.Name, pattern)
+		}
+	}
+	return nil
+}
+
+// Size returns the number of client keys, revoked ones included so that
+// revoking every key does not open the relay
+func (s *KeyStore) Size() int {
+	if s == nil {
+		return 0
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.keys)
+}
+
+// activeKey returns the state of a key that may be used right now
+func (s *KeyStore) activeKey(key string, now time.Time) (*apiKeyState, bool) {
+	state, ok := s.keys[hashAPIKey(key)]
+	if !ok || !state.active(now) {
+		return nil, false
+	}
+	return state, true
+}
+
+// active reports whether a key is neither revoked nor expired
+func (state *apiKeyState) active(now time.Time) bool {
+	if state.RevokedAt != nil {
+		return false
+	}
+	return state.ExpiresAt == nil || now.Before(*state.ExpiresAt)
+}
+
+// Authenticate returns the policy of a key. Without configured keys every
+// request is let through with the anonymous policy.
+func (s *KeyStore) Authenticate(key string) (APIKeyPolicy, bool) {
+	if s.Size() == 0 {
+		return anonymousPolicy, true
+	}
+	if key == "" {
+		return APIKeyPolicy{}, false
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state, ok := s.activeKey(key, time.Now())
+	if !ok {
+		return APIKeyPolicy{}, false
+	}
+	return state.APIKeyPolicy, true
+}
+
+// Admit applies the rate limits of a key and counts the requests when they
+// are allowed through. count is the number of upstream requests made, more
+// than one when a request fans out.
+func (s *KeyStore) Admit(key string, count int) rateLimitStatus {
+	if s.Size() == 0 {
+		return rateLimitStatus{}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	state, ok := s.activeKey(key, now)
+	if !ok {
+		return rateLimitStatus{}
+	}
+
+	state.pruneRequests(now)
+	state.resetTokenDay(now)
+
+	var status rateLimitStatus
+	if limit := state.RequestsPerMinute; limit > 0 {
+		status.RequestLimit = limit
+		status.RequestsRemaining = limit - len(state.requests)
+		status.RequestsReset = time.Minute
+		if len(state.requests) > 0 {
+			status.RequestsReset = state.requests[0].Add(time.Minute).Sub(now)
+		}
+		if status.RequestsRemaining < count {
+			// Wait until enough of the counted requests leave the window
+			if i := min(count-status.RequestsRemaining, len(state.requests)) - 1; i >= 0 {
+				status.RequestsReset = state.requests[i].Add(time.Minute).Sub(now)
+			}
+			status.RequestsRemaining = max(status.RequestsRemaining, 0)
+			status.Limited = "requests"
+		}
+	}
+	if limit := state.TokensPerDay; limit > 0 {
+		status.TokenLimit = limit
+		status.TokensUsed = state.tokensUsed
+		status.TokensRemaining = max(limit-state.tokensUsed, 0)
+		status.TokensReset = now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour).Sub(now)
+		if status.TokensRemaining == 0 && status.Limited == "" {
+			status.Limited = "tokens"
+		}
+	}
+
+	if status.Limited == "" && status.RequestLimit > 0 {
+		for range count {
+			state.requests = append(state.requests, now)
+		}
+		status.RequestsRemaining -= count
+	}
+	return status
+}
+
+// AddTokens counts the tokens used by a request of a key
+func (s *KeyStore) AddTokens(key string, tokens int) {
+	if tokens <= 0 || s.Size() == 0 {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state, ok := s.keys[hashAPIKey(key)]
+	if !ok {
+		return
+	}
+	state.resetTokenDay(time.Now())
+	state.tokensUsed += tokens
+}
+
+// List describes every client key, sorted by source and creation
+func (s *KeyStore) List() []APIKeyInfo {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	infos := make([]APIKeyInfo, 0, len(s.keys))
+	for _, state := range s.keys {
+		infos = append(infos, state.info(now))
+	}
+	slices.SortFunc(infos, func(a, b APIKeyInfo) int {
+		if a.Source != b.Source {
+			return strings.Compare(a.Source, b.Source)
+		}
+		if a.CreatedAt != nil && b.CreatedAt != nil && !a.CreatedAt.Equal(*b.CreatedAt) {
+			return a.CreatedAt.Compare(*b.CreatedAt)
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return infos
+}
+
+// info describes a key for the admin API
+func (state *apiKeyState) info(now time.Time) APIKeyInfo {
+	info := APIKeyInfo{
+		ID:           state.ID,
+		Source:       state.source,
+		KeyPrefix:    state.KeyPrefix,
+		RevokedAt:    state.RevokedAt,
+		Active:       state.active(now),
+		APIKeyPolicy: state.APIKeyPolicy,
+	}
+	if !state.CreatedAt.IsZero() {
+		createdAt := state.CreatedAt
+		info.CreatedAt = &createdAt
+	}
+	if state.tokenDay == now.UTC().Format(time.DateOnly) {
+		info.TokensUsed = state.tokensUsed
+	}
+	return info
+}
+
+// Create adds a new key with the given policy and returns it. The key value
+// is only ever returned here.
+func (s *KeyStore) Create(policy APIKeyPolicy) (APIKeyInfo, string, error) {
+	// Keys that would vanish on restart are refused rather than handed out
+	if s.path == "" {
+		return APIKeyInfo{}, "", errKeyStoreNoFile
+	}
+	key, id, err := newAPIKey()
+	if err != nil {
+		return APIKeyInfo{}, "", fmt.Errorf("error generating API key: %w", err)
+	}
+	if policy.Name == "" {
+		policy.Name = id
+	}
+	policy.Key = ""
+	if err := policy.validate(); err != nil {
+		return APIKeyInfo{}, "", err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.nameTaken(policy.Name, "") {
+		return APIKeyInfo{}, "", fmt.Errorf("API key name %q is not unique", policy.Name)
+	}
+
+	now := time.Now().UTC()
+	state := &apiKeyState{
+		storedAPIKey: storedAPIKey{
+			ID:           id,
+			KeyHash:      hashAPIKey(key),
+			KeyPrefix:    key[:7],
+			CreatedAt:    now,
+			APIKeyPolicy: policy,
+		},
+		source: APIKeySourceAdmin,
+	}
+	s.keys[state.KeyHash] = state
+	if err := s.save(); err != nil {
+		delete(s.keys, state.KeyHash)
+		return APIKeyInfo{}, "", err
+	}
+	return state.info(now), key, nil
+}
+
+// Update changes the name, expiry, models or limits of an admin managed key
+func (s *KeyStore) Update(id string, update APIKeyUpdate) (APIKeyInfo, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state, err := s.managedKey(id)
+	if err != nil {
+		return APIKeyInfo{}, err
+	}
+
+	policy := state.APIKeyPolicy
+	if update.Name != nil {
+		policy.Name = *update.Name
+		if policy.Name == "" || s.nameTaken(policy.Name, id) {
+			return APIKeyInfo{}, fmt.Errorf("API key name %q is empty or not unique", policy.Name)
+		}
+	}
+	if update.ExpiresAt != nil {
+		policy.ExpiresAt = nil
+		if *update.ExpiresAt != "" {
+			expiresAt, err := time.Parse(time.RFC3339, *update.ExpiresAt)
+			if err != nil {
+				return APIKeyInfo{}, fmt.Errorf("invalid expires_at, expected an RFC 3339 time: %w", err)
+			}
+			policy.ExpiresAt = &expiresAt
+		}
+	}
+	if update.AllowedModels != nil {
+		policy.AllowedModels = *update.AllowedModels
+	}
+	if update.DeniedModels != nil {
+		policy.DeniedModels = *update.DeniedModels
+	}
+	if update.RequestsPerMinute != nil {
+		policy.RequestsPerMinute = *update.RequestsPerMinute
+	}
+	if update.TokensPerDay != nil {
+		policy.TokensPerDay = *update.TokensPerDay
+	}
+	if err := policy.validate(); err != nil {
+		return APIKeyInfo{}, err
+	}
+
+	previous := state.APIKeyPolicy
+	state.APIKeyPolicy = policy
+	if err := s.save(); err != nil {
+		state.APIKeyPolicy = previous
+		return APIKeyInfo{}, err
+	}
+	return state.info(time.Now()), nil
+}
+
+// Revoke disables an admin managed key for good
+func (s *KeyStore) Revoke(id string) (APIKeyInfo, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	state, err := s.managedKey(id)
+	if err != nil {
+		return APIKeyInfo{}, err
+	}
+
+	if state.RevokedAt == nil {
+		now := time.Now().UTC()
+		state.RevokedAt = &now
+		if err := s.save(); err != nil {
+			state.RevokedAt = nil
+			return APIKeyInfo{}, err
+		}
+	}
+	return state.info(time.Now()), nil
+}
+
+// managedKey finds an admin managed key by id
+func (s *KeyStore) managedKey(id string) (*apiKeyState, error) {
+	for _, state := range s.keys {
+		if state.ID != id {
+			continue
+		}
+		if state.source != APIKeySourceAdmin {
+			return nil, errAPIKeyReadOnly
+		}
+		return state, nil
+	}
+	return nil, errAPIKeyNotFound
+}
+
+// nameTaken reports whether another key already uses a name
+func (s *KeyStore) nameTaken(name, exceptID string) bool {
+	for _, state := range s.keys {
+		if state.Name == name && state.ID != exceptID {
+			return true
+		}
+	}
+	return false
+}
+
+// save writes the admin managed keys to the store file. The file is replaced
+// atomically and only readable by the owner.
+func (s *KeyStore) save() error {
+	var file struct {
+		Keys []storedAPIKey `json:"keys"`
+	}
+	file.Keys = []storedAPIKey{}
+	for _, state := range s.keys {
+		if state.source == APIKeySourceAdmin {
+			file.Keys = append(file.Keys, state.storedAPIKey)
+		}
+	}
+	slices.SortFunc(file.Keys, func(a, b storedAPIKey) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("%w: %v", errKeyStoreWrite, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return fmt.Errorf("%w: %v", errKeyStoreWrite, err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("%w: %v", errKeyStoreWrite, err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("%w: %v", errKeyStoreWrite, err)
+	}
+	return nil
+}
+
+// pruneRequests drops requests older than the one minute window
+func (state *apiKeyState) pruneRequests(now time.Time) {
+	cutoff := now.Add(-time.Minute)
+	i := 0
+	for i < len(state.requests) && !state.requests[i].After(cutoff) {
+		i++
+	}
+	state.requests = state.requests[i:]
+}
+
+// resetTokenDay starts a new daily token budget at midnight UTC
+func (state *apiKeyState) resetTokenDay(now time.Time) {
+	day := now.UTC().Format(time.DateOnly)
+	if state.tokenDay != day {
+		state.tokenDay = day
+		state.tokensUsed = 0
+	}
+}
+
+// setHeaders sets the OpenAI style x-ratelimit-* headers
+func (status rateLimitStatus) setHeaders(c *gin.Context) {
+	if status.RequestLimit > 0 {
+		c.Header("x-ratelimit-limit-requests", strconv.Itoa(status.RequestLimit))
+		c.Header("x-ratelimit-remaining-requests", strconv.Itoa(status.RequestsRemaining))
+		c.Header("x-ratelimit-reset-requests", formatRateLimitReset(status.RequestsReset))
+	}
+	if status.TokenLimit > 0 {
+		c.Header("x-ratelimit-limit-tokens", strconv.Itoa(status.TokenLimit))
+		c.Header("x-ratelimit-remaining-tokens", strconv.Itoa(status.TokensRemaining))
+		c.Header("x-ratelimit-reset-tokens", formatRateLimitReset(status.TokensReset))
+	}
+	if status.Limited != "" {
+		reset := status.RequestsReset
+		if status.Limited == "tokens" {
+			reset = status.TokensReset
+		}
+		c.Header("Retry-After", strconv.Itoa(int(reset.Seconds())+1))
+	}
+}
+
+// message returns the error message of a rejected request
+func (status rateLimitStatus) message(keyName string) string {
+	if status.Limited == "tokens" {
+		return fmt.Sprintf("Rate limit reached for %s on tokens per day: Limit %d, Used %d. Please try again in %s.",
+			keyName, status.TokenLimit, status.TokensUsed, formatRateLimitReset(status.TokensReset))
+	}
+	return fmt.Sprintf("Rate limit reached for %s on requests per minute: Limit %d. Please try again in %s.",
+		keyName, status.RequestLimit, formatRateLimitReset(status.RequestsReset))
+}
+
+// formatRateLimitReset formats a reset delay the way OpenAI does, e.g. 1s or 6m0s
+func formatRateLimitReset(d time.Duration) string {
+	if d < time.Second {
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	}
+	return d.Round(time.Second).String()
+}
+
+// apiKeyPolicyContextKey is the gin context key holding the client key policy
+const apiKeyPolicyContextKey = "api_key_policy"
+
+// getAPIKeyPolicy returns the policy of the client key of the request
+func getAPIKeyPolicy(c *gin.Context) APIKeyPolicy {
+	if policy, ok := c.Get(apiKeyPolicyContextKey); ok {
+		return policy.(APIKeyPolicy)
+	}
+	return anonymousPolicy
+}
+
+// checkModelAccess rejects models the client key may not use
+func checkModelAccess(c *gin.Context, model string) *relayError {
+	policy := getAPIKeyPolicy(c)
+	if policy.AllowsModel(model) {
+		return nil
+	}
+	return &relayError{
+		Status:  http.StatusForbidden,
+		Message: fmt.Sprintf("API key %s is not allowed to use model %s", policy.Name, model),
+		Type:    "permission_error",
+	}
+}
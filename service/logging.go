@@ -0,0 +1,187 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 17:52:08
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 17:52:08
+ * @FilePath: /raycast2api/service/logging.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Redaction modes for prompts and completions in the logs
+const (
+	LogRedactionMetadata  = "metadata"  // Only lengths and counts
+	LogRedactionTruncated = "truncated" // The first LogTruncateLength characters
+	LogRedactionFull      = "full"      // Everything, for local debugging only
+
+	LogTruncateLength = 200
+)
+
+// logRedaction is the active redaction mode, set by setupLogging. It is
+// atomic because the configuration can be reloaded while requests are logged.
+var logRedaction atomic.Value
+
+// getLogRedaction returns the active redaction mode
+func getLogRedaction() string {
+	if redaction, ok := logRedaction.Load().(string); ok {
+		return redaction
+	}
+	return LogRedactionMetadata
+}
+
+// parseLogLevel parses LOG_LEVEL, accepting debug, info, warn and error
+func parseLogLevel(value string) (slog.Level, error) {
+	var level slog.Level
+	if value == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return level, fmt.Errorf("invalid log level %q", value)
+	}
+	return level, nil
+}
+
+// parseLogRedaction parses LOG_REDACTION, defaulting to metadata
+func parseLogRedaction(value string) (string, error) {
+	switch value {
+	case "":
+		return LogRedactionMetadata, nil
+	case LogRedactionMetadata, LogRedactionTruncated, LogRedactionFull:
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid log redaction %q, expected metadata, truncated or full", value)
+}
+
+// newLogHandler creates the slog handler for a level and format
+func newLogHandler(w io.Writer, level, format string) (slog.Handler, error) {
+	logLevel, err := parseLogLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	options := &slog.HandlerOptions{Level: logLevel}
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.NewTextHandler(w, options), nil
+	case "json":
+		return slog.NewJSONHandler(w, options), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q, expected text or json", format)
+}
+
+// setupLogging installs the default structured logger. The standard log
+// package is routed through it as well.
+func setupLogging(w io.Writer, level, format, redaction string) error {
+	handler, err := newLogHandler(w, level, format)
+	if err != nil {
+		return err
+	}
+	redaction, err = parseLogRedaction(redaction)
+	if err != nil {
+		return err
+	}
+
+	logRedaction.Store(redaction)
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// fatal logs an error and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// contentAttr logs user content (prompts, completions, raw payloads)
+// according to the redaction mode. The length is always included.
+func contentAttr(key, text string) slog.Attr {
+	length := utf8.RuneCountInString(text)
+	switch getLogRedaction() {
+	case LogRedactionFull:
+		return slog.Group(key, "chars", length, "text", text)
+	case LogRedactionTruncated:
+		if length > LogTruncateLength {
+			runes := []rune(text)
+			text = string(runes[:LogTruncateLength]) + "…"
+		}
+		return slog.Group(key, "chars", length, "text", text)
+	}
+	return slog.Group(key, "chars", length)
+}
+
+// logReply logs the completion of a chat request
+func logReply(opts chatResponseOptions, text string, usage OpenAIUsage) {
+	slog.Debug("Reply completed",
+		"model", opts.Model,
+		"thread_id", opts.Request.ThreadID,
+		"prompt_tokens", usage.PromptTokens,
+		"completion_tokens", usage.CompletionTokens,
+		contentAttr("completion", text),
+	)
+}
+
+// requestLogger logs every request once it has been served
+func requestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		attrs := []any{
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"duration_ms", time.Since(start).Milliseconds(),
+			"client_ip", c.ClientIP(),
+			"api_key", c.GetString(apiKeyIDContextKey),
+		}
+		if record := getRequestRecord(c.Request.Context()); record != nil {
+			record.mutex.Lock()
+			if calls := record.answeredCalls(); len(calls) > 0 {
+				call := calls[0]
+				attrs = append(attrs, "model", call.model, "provider", call.provider,
+					"upstream_token", call.token, "stream", record.stream)
+			}
+			if len(record.upstream) > 1 {
+				attrs = append(attrs, "upstream_requests", len(record.upstream))
+			}
+			promptTokens, completionTokens := 0, 0
+			for _, call := range record.upstream {
+				promptTokens += call.promptTokens
+				completionTokens += call.completionTokens
+			}
+			if completionTokens > 0 {
+				attrs = append(attrs, "prompt_tokens", promptTokens,
+					"completion_tokens", completionTokens)
+			}
+			record.mutex.Unlock()
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, "errors", c.Errors.String())
+		}
+
+		level := slog.LevelInfo
+		switch {
+		case c.Writer.Status() >= 500:
+			level = slog.LevelError
+		case c.Writer.Status() >= 400:
+			level = slog.LevelWarn
+		}
+		slog.Log(c.Request.Context(), level, "Request served", attrs...)
+	}
+}
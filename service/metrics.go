@@ -0,0 +1,421 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 17:15:52
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 17:15:52
+ * @FilePath: /raycast2api/service/metrics.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds the Prometheus collectors of the relay
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests          *prometheus.CounterVec
+	requestDuration   *prometheus.HistogramVec
+	timeToFirstToken  *prometheus.HistogramVec
+	upstreamResponses *prometheus.CounterVec
+	tokens            *prometheus.CounterVec
+	cancelled         *prometheus.CounterVec
+	modelCache        *prometheus.CounterVec
+	activeStreams     *prometheus.GaugeVec
+	retries           *prometheus.CounterVec
+	fallbacks         *prometheus.CounterVec
+}
+
+// latencyBuckets covers everything from a quick first token to a long generation
+var latencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2, 4, 8, 15, 30, 60, 120, 300}
+
+// NewMetrics creates the collectors on a dedicated registry
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "raycast2api_requests_total",
+			Help: "Requests handled by the relay.",
+		}, []string{"endpoint", "model", "provider", "api_key", "upstream_token", "stream", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "raycast2api_request_duration_seconds",
+			Help:    "Total time to serve a completion request.",
+			Buckets: latencyBuckets,
+		}, []string{"endpoint", "model", "provider", "stream"}),
+		timeToFirstToken: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "raycast2api_time_to_first_token_seconds",
+			Help:    "Time until the first generated text was sent to a streaming client.",
+			Buckets: latencyBuckets,
+		}, []string{"endpoint", "model", "provider"}),
+		upstreamResponses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "raycast2api_upstream_responses_total",
+			Help: "Responses received from Raycast by status code, \"error\" for transport failures.",
+		}, []string{"model", "provider", "upstream_token", "code"}),
+		tokens: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "raycast2api_tokens_total",
+			Help: "Prompt and completion tokens processed.",
+		}, []string{"direction", "model", "provider", "api_key", "upstream_token"}),
+		cancelled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "raycast2api_cancelled_requests_total",
+			Help: "Requests abandoned by the client, which cancelled the upstream request.",
+		}, []string{"endpoint", "model", "provider"}),
+		modelCache: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "raycast2api_model_cache_total",
+			Help: "Model cache lookups by result: hit, refresh or error.",
+		}, []string{"result"}),
+		activeStreams: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "raycast2api_active_streams",
+			Help: "Streaming responses currently in flight.",
+		}, []string{"endpoint"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "raycast2api_upstream_retries_total",
+			Help: "Raycast requests retried after a failed attempt.",
+		}, []string{"model", "provider"}),
+		fallbacks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "raycast2api_fallbacks_total",
+			Help: "Requests handed to a fallback model after the requested one failed.",
+		}, []string{"model", "fallback"}),
+	}
+
+	m.registry.MustRegister(
+		m.requests, m.requestDuration, m.timeToFirstToken, m.upstreamResponses,
+		m.tokens, m.cancelled, m.modelCache, m.activeStreams, m.retries, m.fallbacks,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Handler returns the /metrics HTTP handler
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// ModelCacheResult counts a model cache lookup
+func (m *Metrics) ModelCacheResult(result string) {
+	if m == nil {
+		return
+	}
+	m.modelCache.WithLabelValues(result).Inc()
+}
+
+// UpstreamResponse counts a response, or a transport error, from Raycast
+func (m *Metrics) UpstreamResponse(model, provider, tokenID string, resp *http.Response, err error) {
+	if m == nil {
+		return
+	}
+	code := "error"
+	if err == nil && resp != nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	m.upstreamResponses.WithLabelValues(model, provider, tokenID, code).Inc()
+}
+
+// Retry counts a retried Raycast request
+func (m *Metrics) Retry(model, provider string) {
+	if m == nil {
+		return
+	}
+	m.retries.WithLabelValues(model, provider).Inc()
+}
+
+// Fallback counts a request handed to a fallback model
+func (m *Metrics) Fallback(model, fallback string) {
+	if m == nil {
+		return
+	}
+	m.fallbacks.WithLabelValues(model, fallback).Inc()
+}
+
+// StreamStarted counts an active stream until the returned function is called
+func (m *Metrics) StreamStarted(endpoint string) func() {
+	if m == nil {
+		return func() {}
+	}
+	gauge := m.activeStreams.WithLabelValues(endpoint)
+	gauge.Inc()
+	return gauge.Dec
+}
+
+// observe records the metrics of a finished request
+func (m *Metrics) observe(record *requestRecord, status int) {
+	if m == nil {
+		return
+	}
+	record.mutex.Lock()
+	defer record.mutex.Unlock()
+
+	// The request is labelled with the first upstream call that answered, the
+	// tokens are counted against the model and token of each call
+	var primary upstreamCall
+	if calls := record.answeredCalls(); len(calls) > 0 {
+		primary = calls[0]
+	}
+	stream := strconv.FormatBool(record.stream)
+	m.requests.WithLabelValues(record.endpoint, primary.model, primary.provider,
+		record.apiKeyID, primary.token, stream, strconv.Itoa(status)).Inc()
+
+	// Latency and tokens only make sense for requests that reached Raycast
+	if primary.provider == "" {
+		return
+	}
+	m.requestDuration.WithLabelValues(record.endpoint, primary.model, primary.provider, stream).
+		Observe(time.Since(record.start).Seconds())
+	if !record.firstToken.IsZero() {
+		m.timeToFirstToken.WithLabelValues(record.endpoint, primary.model, primary.provider).
+			Observe(record.firstToken.Sub(record.start).Seconds())
+	}
+	for _, call := range record.upstreamTotals() {
+		if call.promptTokens > 0 {
+			m.tokens.WithLabelValues("prompt", call.model, call.provider, record.apiKeyID, call.token).
+				Add(float64(call.promptTokens))
+		}
+		if call.completionTokens > 0 {
+			m.tokens.WithLabelValues("completion", call.model, call.provider, record.apiKeyID, call.token).
+				Add(float64(call.completionTokens))
+		}
+	}
+	if record.cancelled {
+		m.cancelled.WithLabelValues(record.endpoint, primary.model, primary.provider).Inc()
+	}
+}
+
+// requestRecord collects what happened while serving a request. It travels
+// in the request context so the upstream call and the response handlers can
+// fill it in, and is reported once the request is done.
+type requestRecord struct {
+	mutex      sync.Mutex
+	id         string // Ties together the usage records of the request
+	start      time.Time
+	endpoint   string
+	apiKeyID   string
+	stream     bool
+	upstream   []upstreamCall // In the order they were first made
+	firstToken time.Time
+	cancelled  bool
+}
+
+// upstreamCall is a Raycast request made while serving a request. Requests
+// with several choices make one call per choice, each in its own thread.
+type upstreamCall struct {
+	threadID         string
+	model            string
+	provider         string
+	token            string
+	promptTokens     int
+	completionTokens int
+	failed           bool // Raycast did not answer with a 200
+}
+
+// requestRecordKey is the context key of the request record
+type requestRecordKey struct{}
+
+// getRequestRecord returns the record of the request, or nil outside a request
+func getRequestRecord(ctx context.Context) *requestRecord {
+	record, _ := ctx.Value(requestRecordKey{}).(*requestRecord)
+	return record
+}
+
+// setUpstream records the model and token used for an upstream request. A
+// retry of the same request replaces the call it retries.
+func (r *requestRecord) setUpstream(request RaycastChatRequest, tokenID string) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	call := r.upstreamCall(request)
+	call.model = request.Model
+	call.provider = request.Provider
+	call.token = tokenID
+	call.failed = false
+}
+
+// failUpstream marks an upstream request that Raycast did not answer, so a
+// model that failed over to a fallback is not reported as serving the request
+func (r *requestRecord) failUpstream(request RaycastChatRequest) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.upstreamCall(request).failed = true
+}
+
+// answeredCalls returns the upstream calls that Raycast answered. When none
+// did, the request failed and its last attempt is returned instead, so the
+// failure is still reported against a model. The caller holds the mutex.
+func (r *requestRecord) answeredCalls() []upstreamCall {
+	var answered []upstreamCall
+	for _, call := range r.upstream {
+		if !call.failed {
+			answered = append(answered, call)
+		}
+	}
+	if len(answered) == 0 && len(r.upstream) > 0 {
+		return r.upstream[len(r.upstream)-1:]
+	}
+	return answered
+}
+
+// upstreamCall returns the call of an upstream request, adding it when it is
+// new. The caller holds the mutex.
+func (r *requestRecord) upstreamCall(request RaycastChatRequest) *upstreamCall {
+	for i := range r.upstream {
+		if r.upstream[i].threadID == request.ThreadID {
+			return &r.upstream[i]
+		}
+	}
+	r.upstream = append(r.upstream, upstreamCall{
+		threadID: request.ThreadID,
+		model:    request.Model,
+		provider: request.Provider,
+	})
+	return &r.upstream[len(r.upstream)-1]
+}
+
+// upstreamTotals adds up the tokens of the upstream calls made with the same
+// model and token, in the order of the calls. The caller holds the mutex.
+func (r *requestRecord) upstreamTotals() []upstreamCall {
+	var totals []upstreamCall
+	for _, call := range r.answeredCalls() {
+		i := slices.IndexFunc(totals, func(total upstreamCall) bool {
+			return total.model == call.model && total.provider == call.provider && total.token == call.token
+		})
+		if i < 0 {
+			call.threadID = ""
+			totals = append(totals, call)
+			continue
+		}
+		totals[i].promptTokens += call.promptTokens
+		totals[i].completionTokens += call.completionTokens
+	}
+	return totals
+}
+
+// setStream records whether the response is streamed
+func (r *requestRecord) setStream(stream bool) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.stream = stream
+}
+
+// markFirstToken records the time the first text was sent to the client
+func (r *requestRecord) markFirstToken() {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.firstToken.IsZero() {
+		r.firstToken = time.Now()
+	}
+}
+
+// setUsage records the token usage of the reply to an upstream request
+func (r *requestRecord) setUsage(request RaycastChatRequest, usage OpenAIUsage) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	call := r.upstreamCall(request)
+	call.promptTokens = usage.PromptTokens
+	call.completionTokens = usage.CompletionTokens
+}
+
+// totalTokens returns the prompt and completion tokens of every reply
+func (r *requestRecord) totalTokens() int {
+	if r == nil {
+		return 0
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	total := 0
+	for _, call := range r.upstream {
+		total += call.promptTokens + call.completionTokens
+	}
+	return total
+}
+
+// markCancelled records that the client abandoned the request
+func (r *requestRecord) markCancelled() {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.cancelled = true
+}
+
+// trackRequests attaches a request record to every request and reports it
+// to the metrics and the usage ledger once the request has been served
+func trackRequests(config Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		record := &requestRecord{
+			id:       uuid.New().String(),
+			start:    time.Now(),
+			endpoint: c.FullPath(),
+			apiKeyID: c.GetString(apiKeyIDContextKey),
+		}
+		if record.endpoint == "" {
+			record.endpoint = "unmatched"
+		}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestRecordKey{}, record))
+
+		c.Next()
+
+		config.Metrics.observe(record, c.Writer.Status())
+		for _, usage := range record.usageRecords(c.Writer.Status()) {
+			config.Usage.Record(usage)
+		}
+	}
+}
+
+// usageRecords turns a finished request into usage ledger records, one for
+// every model and upstream token it used. Only requests that reached Raycast
+// are billable.
+func (r *requestRecord) usageRecords(status int) []UsageRecord {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var records []UsageRecord
+	for _, call := range r.upstreamTotals() {
+		if call.provider == "" {
+			continue
+		}
+		records = append(records, UsageRecord{
+			Timestamp:        r.start.UTC(),
+			RequestID:        r.id,
+			Endpoint:         r.endpoint,
+			KeyID:            r.apiKeyID,
+			Model:            call.model,
+			Provider:         call.provider,
+			UpstreamToken:    call.token,
+			Stream:           r.stream,
+			Status:           status,
+			PromptTokens:     call.promptTokens,
+			CompletionTokens: call.completionTokens,
+			LatencyMs:        time.Since(r.start).Milliseconds(),
+		})
+	}
+	return records
+}
@@ -16,7 +16,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"strings"
 	"sync"
@@ -37,7 +37,8 @@ func (mc *ModelCache) GetModels(config Config) (map[string]ModelCacheEntry, erro
 	mc.mutex.RLock()
 	if time.Now().Before(mc.expiresAt) && len(mc.models) > 0 {
 		defer mc.mutex.RUnlock()
-		log.Println("Using cached models")
+		slog.Debug("Using cached models")
+		config.Metrics.ModelCacheResult("hit")
 		return mc.models, nil
 	}
 	mc.mutex.RUnlock()
@@ -45,34 +46,69 @@ func (mc *ModelCache) GetModels(config Config) (map[string]ModelCacheEntry, erro
 	// Cache has expired or is empty, fetch new data
 	models, err := fetchModelsFromAPI(config)
 	if err != nil {
-		log.Printf("Error fetching models: %v, using defaults or cached data", err)
+		slog.Warn("Error fetching models, using defaults or cached data", "error", err)
+		config.Metrics.ModelCacheResult("error")
 		mc.mutex.RLock()
 		defer mc.mutex.RUnlock()
 
 		// If we have cached models, return them even if expired
 		if len(mc.models) > 0 {
-			log.Println("Using expired cached models as fallback")
+			slog.Warn("Using expired cached models as fallback")
 			return mc.models, nil
 		}
 
 		// If no cached models, create a default entry
 		defaultModels := map[string]ModelCacheEntry{
-			DefaultModel: {
-				Provider: DefaultProvider,
-				Model:    DefaultModel,
+			config.DefaultModel: {
+				Provider: config.DefaultProvider,
+				Model:    config.DefaultModel,
+				Vision:   guessVisionSupport(config.DefaultModel),
 			},
 		}
 		return defaultModels, err
 	}
 
 	// Update the cache with new data
+	mc.update(config, models)
+	return models, nil
+}
+
+// update stores freshly fetched models in the cache
+func (mc *ModelCache) update(config Config, models map[string]ModelCacheEntry) {
 	mc.mutex.Lock()
 	defer mc.mutex.Unlock()
 	mc.models = models
-	mc.expiresAt = time.Now().Add(ModelCacheTTL)
-	log.Printf("Model cache updated with %d models, expires at %v", len(models), mc.expiresAt)
+	mc.updatedAt = time.Now()
+	mc.expiresAt = mc.updatedAt.Add(config.ModelCacheTTL)
+	config.Metrics.ModelCacheResult("refresh")
+	slog.Info("Model cache updated", "models", len(models), "expires_at", mc.expiresAt)
+}
 
-	return models, nil
+// ModelCacheStatus describes the model cache for health checks
+type ModelCacheStatus struct {
+	Models     int        `json:"models"`
+	UpdatedAt  *time.Time `json:"updated_at,omitempty"`
+	AgeSeconds int64      `json:"age_seconds,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	Expired    bool       `json:"expired"`
+}
+
+// Status describes the content and age of the cache
+func (mc *ModelCache) Status() ModelCacheStatus {
+	mc.mutex.RLock()
+	defer mc.mutex.RUnlock()
+
+	status := ModelCacheStatus{
+		Models:  len(mc.models),
+		Expired: !time.Now().Before(mc.expiresAt),
+	}
+	if !mc.updatedAt.IsZero() {
+		updatedAt, expiresAt := mc.updatedAt, mc.expiresAt
+		status.UpdatedAt = &updatedAt
+		status.AgeSeconds = int64(time.Since(updatedAt).Seconds())
+		status.ExpiresAt = &expiresAt
+	}
+	return status
 }
 
 // ForceCacheRefresh forces a refresh of the model cache
@@ -87,21 +123,21 @@ func (mc *ModelCache) ForceCacheRefresh(config Config) {
 
 // fetchModelsFromAPI fetches model information from Raycast API
 func fetchModelsFromAPI(config Config) (map[string]ModelCacheEntry, error) {
-	log.Println("Fetching models from Raycast API...")
+	slog.Debug("Fetching models from Raycast API")
 
 	client := &http.Client{
 		Timeout: 10 * time.Second,
 	}
-	req, err := http.NewRequest("GET", RaycastModelsURL, nil)
+	req, err := http.NewRequest("GET", config.RaycastModelsURL(), nil)
 	if err != nil {
 		return nil, fmt.Errorf("error creating request: %w", err)
 	}
 
-	for key, value := range getRaycastHeaders(config) {
-		req.Header.Set(key, value)
-	}
+	token := config.TokenPool.Acquire()
+	applyRaycastHeaders(req, config, token)
 
 	resp, err := client.Do(req)
+	config.TokenPool.Report(token.ID, resp, err)
 	if err != nil {
 		return nil, fmt.Errorf("error fetching models: %w", err)
 	}
@@ -123,8 +159,9 @@ func fetchModelsFromAPI(config Config) (map[string]ModelCacheEntry, error) {
 
 	var response struct {
 		Models []struct {
-			Provider string `json:"provider"`
-			Model    string `json:"model"`
+			Provider  string                 `json:"provider"`
+			Model     string                 `json:"model"`
+			Abilities map[string]interface{} `json:"abilities,omitempty"`
 		} `json:"models"`
 	}
 
@@ -134,21 +171,56 @@ func fetchModelsFromAPI(config Config) (map[string]ModelCacheEntry, error) {
 
 	models := make(map[string]ModelCacheEntry)
 	for _, model := range response.Models {
+		// Prefer the advertised abilities, fall back to the model name
+		vision := guessVisionSupport(model.Model)
+		if model.Abilities != nil {
+			ability, ok := model.Abilities["vision"]
+			vision = ok && ability != nil && ability != false
+		}
+
 		models[model.Model] = ModelCacheEntry{
 			Provider: model.Provider,
 			Model:    model.Model,
+			Vision:   vision,
 		}
 	}
 
-	log.Printf("Fetched %d models from Raycast API", len(models))
+	slog.Debug("Fetched models from Raycast API", "models", len(models))
 	return models, nil
 }
 
-// getProviderInfo gets provider info for a model
-func getProviderInfo(modelID string, models map[string]ModelCacheEntry) (string, string) {
+// Model name prefixes known to accept images, used when Raycast does not
+// report the abilities of a model
+var visionModelPrefixes = []string{
+	"gpt-4o", "gpt-4.1", "gpt-4-turbo", "o1", "o3", "o4",
+	"claude-3", "claude-sonnet-4", "claude-opus-4",
+	"gemini", "grok-2-vision", "meta-llama/llama-4", "pixtral", "mistral-small",
+}
+
+// Models matching a vision prefix that do not accept images
+var nonVisionModels = map[string]bool{
+	"o1-mini":    true,
+	"o1-preview": true,
+	"o3-mini":    true,
+}
+
+// guessVisionSupport guesses from the model name whether it accepts images
+func guessVisionSupport(modelID string) bool {
+	if nonVisionModels[modelID] {
+		return false
+	}
+	for _, prefix := range visionModelPrefixes {
+		if strings.HasPrefix(modelID, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// supportsVision reports whether a model accepts image attachments
+func supportsVision(modelID string, models map[string]ModelCacheEntry) bool {
 	if model, ok := models[modelID]; ok {
-		return model.Provider, model.Model
+		return model.Vision
 	}
-	// Fallback to defaults
-	return DefaultProvider, DefaultModel
+	return guessVisionSupport(modelID)
 }
@@ -0,0 +1,494 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-17 00:21:36
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-17 00:21:36
+ * @FilePath: /raycast2api/service/ollama.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ollamaDefaultTag is the tag Ollama gives to models named without one
+const ollamaDefaultTag = ":latest"
+
+// isOllamaPath reports whether a request path belongs to the Ollama API,
+// whose clients expect errors in Ollama format
+func isOllamaPath(path string) bool {
+	return strings.HasPrefix(path, "/api/")
+}
+
+// handleOllamaChat handles the Ollama /api/chat endpoint
+func handleOllamaChat(c *gin.Context, config Config) {
+	start := time.Now()
+	var body OllamaChatRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		ollamaError(c, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	// Use default model if not specified
+	model := strings.TrimSuffix(body.Model, ollamaDefaultTag)
+	if model == "" {
+		model = config.DefaultModel
+	}
+
+	// Ollama clients send an empty conversation to load the model
+	if len(body.Messages) == 0 {
+		ollamaLoaded(c, model, true)
+		return
+	}
+
+	// Describe the available tools to the model, if any
+	toolInstructions := buildToolInstructions(body.Tools, nil)
+
+	systemPrompt, messages := extractSystemMessages(convertOllamaMessages(body.Messages))
+	raycastMessages, err := convertMessages(config, messages)
+	if err != nil {
+		ollamaError(c, http.StatusBadRequest, fmt.Sprintf("Invalid image content: %v", err))
+		return
+	}
+
+	options := OllamaOptions{}
+	if body.Options != nil {
+		options = *body.Options
+	}
+
+	// Send the request, retrying and falling back to other models on failure
+	result, relayErr := relayChat(c, config, raycastChatParams{
+		Model:                        model,
+		Messages:                     raycastMessages,
+		SystemInstruction:            systemPrompt,
+		AdditionalSystemInstructions: toolInstructions,
+		Temperature:                  options.Temperature,
+		MaxTokens:                    options.NumPredict,
+	})
+	if relayErr != nil {
+		ollamaError(c, relayErr.Status, relayErr.Message)
+		return
+	}
+	defer result.Response.Body.Close()
+
+	run := ollamaRun{
+		Chat:  true,
+		Start: start,
+		Stops: options.Stop,
+		Options: chatResponseOptions{
+			Model:     result.Model,
+			Request:   result.Request,
+			WithTools: toolInstructions != "",
+		},
+	}
+	run.reply(c, config, result.Response, body.Stream == nil || *body.Stream)
+}
+
+// handleOllamaGenerate handles the Ollama /api/generate endpoint. The prompt
+// is sent to Raycast as a single-turn chat.
+func handleOllamaGenerate(c *gin.Context, config Config) {
+	start := time.Now()
+	var body OllamaGenerateRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		ollamaError(c, http.StatusBadRequest, fmt.Sprintf("Invalid request body: %v", err))
+		return
+	}
+
+	// Use default model if not specified
+	model := strings.TrimSuffix(body.Model, ollamaDefaultTag)
+	if model == "" {
+		model = config.DefaultModel
+	}
+
+	// Ollama clients send an empty prompt to load the model
+	if body.Prompt == "" && len(body.Images) == 0 {
+		ollamaLoaded(c, model, false)
+		return
+	}
+
+	// With a suffix, the model is asked to fill in the middle
+	prompt, systemPrompt := body.Prompt, body.System
+	if body.Suffix != "" {
+		prompt = "<prefix>" + body.Prompt + "</prefix>\n<suffix>" + body.Suffix + "</suffix>"
+		systemPrompt = joinNonEmpty("\n\n", body.System, fillInMiddleInstruction)
+	}
+
+	raycastMessages, err := convertMessages(config, []OpenAIMessage{
+		{Role: "user", Content: ollamaContent(prompt, body.Images)},
+	})
+	if err != nil {
+		ollamaError(c, http.StatusBadRequest, fmt.Sprintf("Invalid image content: %v", err))
+		return
+	}
+
+	options := OllamaOptions{}
+	if body.Options != nil {
+		options = *body.Options
+	}
+
+	// Send the request, retrying and falling back to other models on failure
+	result, relayErr := relayChat(c, config, raycastChatParams{
+		Model:             model,
+		Messages:          raycastMessages,
+		SystemInstruction: systemPrompt,
+		Temperature:       options.Temperature,
+		MaxTokens:         options.NumPredict,
+	})
+	if relayErr != nil {
+		ollamaError(c, relayErr.Status, relayErr.Message)
+		return
+	}
+	defer result.Response.Body.Close()
+
+	run := ollamaRun{
+		Start: start,
+		Stops: options.Stop,
+		Options: chatResponseOptions{
+			Model:   result.Model,
+			Request: result.Request,
+		},
+	}
+	run.reply(c, config, result.Response, body.Stream == nil || *body.Stream)
+}
+
+// ollamaLoaded answers a request that only loads the model, which is a no-op
+// as Raycast models are always available
+func ollamaLoaded(c *gin.Context, model string, chat bool) {
+	reply := ollamaRun{Chat: chat}.chunk(model+ollamaDefaultTag, "", nil)
+	reply.Done = true
+	reply.DoneReason = "load"
+	c.JSON(http.StatusOK, reply)
+}
+
+// convertOllamaMessages converts Ollama messages into OpenAI messages so they
+// can go through the same conversion as chat completions
+func convertOllamaMessages(messages []OllamaMessage) []OpenAIMessage {
+	openaiMessages := make([]OpenAIMessage, 0, len(messages))
+
+	// Ollama tool calls carry no ID, and tool messages at most a function name
+	var pending pendingToolCalls
+	for _, msg := range messages {
+		if msg.Role == "tool" {
+			id, name := pending.answer("", msg.ToolName)
+			openaiMessages = append(openaiMessages, OpenAIMessage{
+				Role:       "tool",
+				Content:    msg.Content,
+				Name:       name,
+				ToolCallID: id,
+			})
+			continue
+		}
+
+		var toolCalls []OpenAIToolCall
+		for _, toolCall := range msg.ToolCalls {
+			call := OpenAIToolCall{Type: "function"}
+			call.Function.Name = toolCall.Function.Name
+			call.Function.Arguments = "{}"
+			if len(toolCall.Function.Arguments) > 0 {
+				call.Function.Arguments = string(toolCall.Function.Arguments)
+			}
+			pending.add(&call)
+			toolCalls = append(toolCalls, call)
+		}
+		openaiMessages = append(openaiMessages, OpenAIMessage{
+			Role:      msg.Role,
+			Content:   ollamaContent(msg.Content, msg.Images),
+			ToolCalls: toolCalls,
+		})
+	}
+	return openaiMessages
+}
+
+// ollamaContent converts a text and its images into an OpenAI message content
+func ollamaContent(text string, images []string) interface{} {
+	if len(images) == 0 {
+		return text
+	}
+	// Images travel as OpenAI content parts alongside the text
+	parts := []interface{}{
+		map[string]interface{}{"type": "text", "text": text},
+	}
+	for _, image := range images {
+		parts = append(parts, imageURLPart(ollamaImageURL(image)))
+	}
+	return parts
+}
+
+// ollamaImageURL turns a base64 image into a data URL. Ollama sends images
+// without their type, so it is detected from the first bytes.
+func ollamaImageURL(data string) string {
+	head := data
+	if len(head) > 684 {
+		head = head[:684] // 512 bytes, all http.DetectContentType looks at
+	}
+	decoded, _ := base64.StdEncoding.DecodeString(head)
+	return "data:" + http.DetectContentType(decoded) + ";base64," + data
+}
+
+// ollamaRun renders a Raycast reply in Ollama format, as an assistant message
+// for /api/chat or as generated text for /api/generate
+type ollamaRun struct {
+	Chat    bool      // Whether the reply is a chat message
+	Start   time.Time // Start of the request, for the reported durations
+	Stops   []string
+	Options chatResponseOptions
+}
+
+// chunk creates a reply chunk carrying text or tool calls
+func (r ollamaRun) chunk(model, text string, calls []OpenAIToolCall) OllamaResponse {
+	reply := OllamaResponse{Model: model, CreatedAt: time.Now().UTC()}
+	if !r.Chat {
+		reply.Response = &text
+		return reply
+	}
+	reply.Message = &OllamaMessage{Role: "assistant", Content: text}
+	for _, call := range calls {
+		reply.Message.ToolCalls = append(reply.Message.ToolCalls, ollamaToolCall(call))
+	}
+	return reply
+}
+
+// finish marks the final chunk as done, with the finish reason and the
+// token counts and durations Ollama clients use to show the speed
+func (r ollamaRun) finish(reply *OllamaResponse, finishReason string, usage OpenAIUsage, firstToken time.Time) {
+	now := time.Now()
+	if firstToken.IsZero() {
+		firstToken = now
+	}
+	reply.Done = true
+	reply.DoneReason = "stop"
+	if mapFinishReason(finishReason, false) == "length" {
+		reply.DoneReason = "length"
+	}
+	reply.TotalDuration = now.Sub(r.Start).Nanoseconds()
+	reply.PromptEvalCount = usage.PromptTokens
+	reply.PromptEvalDuration = firstToken.Sub(r.Start).Nanoseconds()
+	reply.EvalCount = usage.CompletionTokens
+	reply.EvalDuration = now.Sub(firstToken).Nanoseconds()
+}
+
+// reply relays the Raycast reply, streamed as NDJSON chunks unless the client
+// turned streaming off
+func (r ollamaRun) reply(c *gin.Context, config Config, response *http.Response, stream bool) {
+	getRequestRecord(c.Request.Context()).setStream(stream)
+	if stream {
+		defer config.Metrics.StreamStarted(c.FullPath())()
+		r.stream(c, response)
+	} else {
+		r.respond(c, response)
+	}
+}
+
+// respond collects the Raycast reply into a single Ollama response
+func (r ollamaRun) respond(c *gin.Context, response *http.Response) {
+	stopFilter := newStopSequenceFilter(r.Stops)
+	finishReason := ""
+	var reportedUsage *RaycastUsage
+	var firstToken time.Time
+
+	var fullText strings.Builder
+	err := readRaycastEvents(response.Body, func(data RaycastSSEData) bool {
+		if data.FinishReason != "" {
+			finishReason = data.FinishReason
+		}
+		if data.Usage != nil {
+			reportedUsage = data.Usage
+		}
+		if data.Text != "" && firstToken.IsZero() {
+			firstToken = time.Now()
+		}
+		fullText.WriteString(stopFilter.Feed(data.Text))
+		_, stopped := stopFilter.Stopped()
+		return !stopped
+	})
+	if err != nil {
+		if clientDisconnected(c) {
+			logCancelledRequest(c, r.Options.Model)
+			return
+		}
+		ollamaError(c, http.StatusInternalServerError, fmt.Sprintf("Error reading response body: %v", err))
+		return
+	}
+	fullText.WriteString(stopFilter.Flush())
+
+	text := fullText.String()
+	usage := buildUsage(r.Options.Request, text, reportedUsage)
+	getRequestRecord(c.Request.Context()).setUsage(r.Options.Request, usage)
+	logReply(r.Options, text, usage)
+
+	var toolCalls []OpenAIToolCall
+	if r.Options.WithTools {
+		text, toolCalls = extractToolCalls(text)
+	}
+
+	reply := r.chunk(r.Options.Model+ollamaDefaultTag, text, toolCalls)
+	r.finish(&reply, finishReason, usage, firstToken)
+	c.JSON(http.StatusOK, reply)
+}
+
+// stream relays the Raycast stream as newline-delimited JSON chunks
+func (r ollamaRun) stream(c *gin.Context, response *http.Response) {
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		slog.Error("Streaming unsupported")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// writeChunk writes a single streaming chunk
+	writeChunk := func(chunk OllamaResponse) {
+		chunkData, err := json.Marshal(chunk)
+		if err != nil {
+			slog.Error("Error marshaling chunk", "error", err)
+			return
+		}
+		fmt.Fprintf(c.Writer, "%s\n", string(chunkData))
+		flusher.Flush()
+	}
+
+	model := r.Options.Model + ollamaDefaultTag
+	record := getRequestRecord(c.Request.Context())
+	var firstToken time.Time
+	markFirstToken := func() {
+		record.markFirstToken()
+		if firstToken.IsZero() {
+			firstToken = time.Now()
+		}
+	}
+	sendText := func(text string) {
+		if text == "" {
+			return
+		}
+		markFirstToken()
+		writeChunk(r.chunk(model, text, nil))
+	}
+	sendToolCalls := func(calls []OpenAIToolCall) {
+		if len(calls) == 0 {
+			return
+		}
+		markFirstToken()
+		writeChunk(r.chunk(model, "", calls))
+	}
+
+	var toolParser *toolCallStreamParser
+	if r.Options.WithTools {
+		toolParser = &toolCallStreamParser{}
+	}
+	emit := func(text string) {
+		if toolParser == nil {
+			sendText(text)
+			return
+		}
+		text, calls := toolParser.Feed(text)
+		sendText(text)
+		sendToolCalls(calls)
+	}
+
+	stopFilter := newStopSequenceFilter(r.Stops)
+	finishReason := ""
+	var completionText strings.Builder
+	var reportedUsage *RaycastUsage
+	err := readRaycastEvents(response.Body, func(data RaycastSSEData) bool {
+		if data.FinishReason != "" {
+			finishReason = data.FinishReason
+		}
+		if data.Usage != nil {
+			reportedUsage = data.Usage
+		}
+		text := stopFilter.Feed(data.Text)
+		completionText.WriteString(text)
+		emit(text)
+		_, stopped := stopFilter.Stopped()
+		return !stopped
+	})
+	if err != nil {
+		if clientDisconnected(c) {
+			logCancelledRequest(c, r.Options.Model)
+			return
+		}
+		slog.Error("Error reading from response", "error", err)
+	}
+
+	rest := stopFilter.Flush()
+	completionText.WriteString(rest)
+	emit(rest)
+	if toolParser != nil {
+		sendText(toolParser.Flush())
+	}
+
+	// The last chunk carries the finish reason and the statistics
+	usage := buildUsage(r.Options.Request, completionText.String(), reportedUsage)
+	record.setUsage(r.Options.Request, usage)
+	logReply(r.Options, completionText.String(), usage)
+	final := r.chunk(model, "", nil)
+	r.finish(&final, finishReason, usage, firstToken)
+	writeChunk(final)
+}
+
+// ollamaToolCall converts a parsed tool call into Ollama format, where the
+// arguments are a JSON object
+func ollamaToolCall(call OpenAIToolCall) OllamaToolCall {
+	var toolCall OllamaToolCall
+	toolCall.Function.Name = call.Function.Name
+	toolCall.Function.Arguments = json.RawMessage(call.Function.Arguments)
+	if !json.Valid(toolCall.Function.Arguments) {
+		toolCall.Function.Arguments = json.RawMessage("{}")
+	}
+	return toolCall
+}
+
+// handleOllamaTags lists the models in Ollama format, every model tagged latest
+func handleOllamaTags(c *gin.Context, config Config) {
+	models, err := config.ModelCache.GetModels(config)
+	if err != nil {
+		ollamaError(c, http.StatusInternalServerError, fmt.Sprintf("An error occurred while fetching models: %v", err))
+		return
+	}
+
+	modifiedAt := time.Now().UTC()
+	if updatedAt := config.ModelCache.Status().UpdatedAt; updatedAt != nil {
+		modifiedAt = updatedAt.UTC()
+	}
+
+	ollamaModels := []OllamaModel{}
+	for _, info := range listModels(c, config, models) {
+		name := info.ID + ollamaDefaultTag
+		digest := sha256.Sum256([]byte(name)) // Stable, clients use it to tell models apart
+		ollamaModels = append(ollamaModels, OllamaModel{
+			Name:       name,
+			Model:      name,
+			ModifiedAt: modifiedAt,
+			Digest:     hex.EncodeToString(digest[:]),
+			Details: OllamaModelDetails{
+				Family:   info.Provider,
+				Families: []string{info.Provider},
+			},
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"models": ollamaModels})
+}
+
+// ollamaError writes an error response in Ollama format
+func ollamaError(c *gin.Context, status int, message string) {
+	c.JSON(status, OllamaErrorResponse{Error: message})
+}
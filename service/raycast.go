@@ -0,0 +1,248 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 11:02:18
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 11:02:18
+ * @FilePath: /raycast2api/service/raycast.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// relayError describes a failure to obtain a response from Raycast. Each API
+// facade renders it in its own error format.
+type relayError struct {
+	Status  int
+	Message string
+	Type    string
+	Code    string // Machine readable code, e.g. model_not_found
+	Details string
+}
+
+// Error implements the error interface
+func (e *relayError) Error() string {
+	return e.Message
+}
+
+// toErrorResponse converts the error into the OpenAI error format
+func (e *relayError) toErrorResponse() ErrorResponse {
+	resp := newErrorResponse(e.Message, e.Type, e.Details)
+	resp.Error.Code = e.Code
+	return resp
+}
+
+// statusClientClosedRequest is the non-standard status used for requests the
+// client abandoned, as popularised by nginx
+const statusClientClosedRequest = 499
+
+// clientDisconnected reports whether the client has gone away, in which case
+// the upstream request has been cancelled along with it
+func clientDisconnected(c *gin.Context) bool {
+	return c.Request.Context().Err() != nil
+}
+
+// logCancelledRequest logs a request abandoned by the client mid-response
+func logCancelledRequest(c *gin.Context, model string) {
+	getRequestRecord(c.Request.Context()).markCancelled()
+	slog.Info("Client disconnected, cancelled upstream request", "model", model, "method", c.Request.Method, "path", c.Request.URL.Path)
+}
+
+// raycastChatParams holds the API independent parts of a chat request
+type raycastChatParams struct {
+	Model                        string
+	Messages                     []RaycastMessage
+	SystemInstruction            string
+	AdditionalSystemInstructions string
+	Temperature                  float64
+	MaxTokens                    int
+}
+
+// buildRaycastRequest resolves the model and prepares a Raycast chat request.
+// Remote images are downloaded here, once the model is known to accept them.
+func buildRaycastRequest(ctx context.Context, config Config, params raycastChatParams) (RaycastChatRequest, *relayError) {
+	// Use default model if not specified
+	model := params.Model
+	if model == "" {
+		model = config.DefaultModel
+	}
+
+	// Use default temperature if not specified
+	temperature := params.Temperature
+	if temperature == 0 {
+		temperature = config.DefaultTemperature
+	}
+
+	// Fall back to the configured default system prompt, if any
+	systemInstruction := params.SystemInstruction
+	if systemInstruction == "" {
+		systemInstruction = config.DefaultSystemPrompt
+	}
+
+	// Get models from cache or fetch them if cache is expired
+	models, err := config.ModelCache.GetModels(config)
+	if err != nil {
+		slog.Warn("Using models with possible error", "error", err)
+	}
+
+	// Route aliases and rules to a Raycast model
+	entry, ok := config.ModelRoutes.Resolve(model, models)
+	if !ok {
+		// Without the Raycast model list, the model may well exist
+		if err != nil {
+			return RaycastChatRequest{}, &relayError{
+				Status:  http.StatusServiceUnavailable,
+				Message: fmt.Sprintf("The Raycast model list is unavailable, the model `%s` cannot be checked", model),
+				Type:    "relay_error",
+				Details: err.Error(),
+			}
+		}
+		return RaycastChatRequest{}, modelNotFoundError(model)
+	}
+	provider, modelName := entry.Provider, entry.Model
+
+	// Images can only be sent to vision capable models
+	if hasAttachments(params.Messages) && !supportsVision(modelName, models) {
+		return RaycastChatRequest{}, &relayError{
+			Status:  http.StatusBadRequest,
+			Message: fmt.Sprintf("Model %s does not support image inputs", modelName),
+			Type:    "invalid_request_error",
+		}
+	}
+	messages, err := resolveImages(ctx, config.MaxImageBytes, params.Messages)
+	if err != nil {
+		return RaycastChatRequest{}, &relayError{
+			Status:  http.StatusBadRequest,
+			Message: err.Error(),
+			Type:    "invalid_request_error",
+		}
+	}
+
+	return RaycastChatRequest{
+		AdditionalSystemInstructions: params.AdditionalSystemInstructions,
+		Debug:                        false,
+		Locale:                       config.Locale,
+		Messages:                     messages,
+		Model:                        modelName,
+		Provider:                     provider,
+		Source:                       "ai_chat",
+		SystemInstruction:            systemInstruction,
+		Temperature:                  temperature,
+		ThreadID:                     uuid.New().String(), // Unique thread ID for this conversation
+		Tools: []RaycastTool{
+			// Uncomment to enable tools if needed
+			// {Name: "web_search", Type: "remote_tool"},
+			// {Name: "search_images", Type: "remote_tool"},
+		},
+		MaxTokens: params.MaxTokens,
+	}, nil
+}
+
+// sendRaycastRequest sends a chat request to Raycast and returns the response
+// once it has answered with 200. The caller must close the response body.
+// The upstream request is cancelled as soon as ctx is, so pass the client
+// request context to stop generating when the client disconnects.
+func sendRaycastRequest(ctx context.Context, config Config, raycastRequest RaycastChatRequest) (*http.Response, *relayError) {
+	requestBody, err := json.Marshal(raycastRequest)
+	if err != nil {
+		return nil, &relayError{
+			Status:  http.StatusInternalServerError,
+			Message: "Failed to marshal request",
+			Type:    "server_error",
+			Details: err.Error(),
+		}
+	}
+
+	slog.Debug("Sending request to Raycast",
+		"provider", raycastRequest.Provider,
+		"model", raycastRequest.Model,
+		"thread_id", raycastRequest.ThreadID,
+		"messages", len(raycastRequest.Messages),
+		contentAttr("body", string(requestBody)),
+	)
+
+	client := &http.Client{
+		Timeout: 5 * time.Minute, // Longer timeout for chat completions
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", config.RaycastAPIURL(), bytes.NewBuffer(requestBody))
+	if err != nil {
+		return nil, &relayError{
+			Status:  http.StatusInternalServerError,
+			Message: "Error creating request",
+			Type:    "server_error",
+			Details: err.Error(),
+		}
+	}
+
+	token := config.TokenPool.Acquire()
+	applyRaycastHeaders(req, config, token)
+	record := getRequestRecord(ctx)
+	record.setUpstream(raycastRequest, token.ID)
+
+	resp, err := client.Do(req)
+	if ctx.Err() != nil {
+		// Not the token's fault, so leave its health alone
+		if resp != nil {
+			resp.Body.Close()
+		}
+		slog.Info("Client disconnected before Raycast answered, cancelled upstream request", "model", raycastRequest.Model)
+		return nil, &relayError{
+			Status:  statusClientClosedRequest,
+			Message: "Client closed the request",
+			Type:    "client_cancelled",
+			Details: ctx.Err().Error(),
+		}
+	}
+	config.TokenPool.Report(token.ID, resp, err)
+	config.Metrics.UpstreamResponse(raycastRequest.Model, raycastRequest.Provider, token.ID, resp, err)
+	if err != nil {
+		record.failUpstream(raycastRequest)
+		return nil, &relayError{
+			Status:  http.StatusInternalServerError,
+			Message: fmt.Sprintf("Error sending request to Raycast: %v", err),
+			Type:    "relay_error",
+			Details: err.Error(),
+		}
+	}
+
+	slog.Debug("Raycast responded", "model", raycastRequest.Model, "status", resp.StatusCode, "token", token.ID)
+
+	if resp.StatusCode != http.StatusOK {
+		record.failUpstream(raycastRequest)
+		defer resp.Body.Close()
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		errorText := string(bodyBytes)
+
+		// Try to parse error as JSON
+		var errorJson map[string]interface{}
+		if err := json.Unmarshal(bodyBytes, &errorJson); err == nil {
+			jsonBytes, _ := json.Marshal(errorJson)
+			errorText = string(jsonBytes)
+		}
+		slog.Warn("Raycast API error", "model", raycastRequest.Model, "status", resp.StatusCode, "token", token.ID, contentAttr("body", errorText))
+
+		return nil, &relayError{
+			Status:  resp.StatusCode,
+			Message: fmt.Sprintf("Raycast API error: %d %s", resp.StatusCode, errorText),
+			Type:    "relay_error",
+		}
+	}
+
+	return resp, nil
+}
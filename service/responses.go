@@ -0,0 +1,760 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 23:31:24
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 23:31:24
+ * @FilePath: /raycast2api/service/responses.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ResponseStore keeps the most recent Responses API responses in memory, so
+// that conversations can continue from them with previous_response_id
+type ResponseStore struct {
+	responses map[string]storedResponse
+	order     []string // IDs from the oldest to the newest response
+	capacity  int      // Responses kept, 0 disables the store
+	size      int      // Encoded size of the responses kept, at most ResponseStoreMaxBytes
+	mutex     sync.Mutex
+}
+
+// storedResponse is a response along with the conversation that led to it
+type storedResponse struct {
+	Response OpenAIResponse
+	Messages []OpenAIMessage // Whole conversation, the reply included
+	KeyID    string          // Client key that created the response, the only one allowed to use it
+	size     int             // Encoded size, set by Put
+}
+
+// storedImagePlaceholder replaces the data URL images of stored conversations
+const storedImagePlaceholder = "[image not kept by the relay]"
+
+// withoutImageData replaces the data URL images of a conversation with a text
+// placeholder. They can be megabytes each, too much to keep for every stored
+// response; remote image URLs are short and kept.
+func withoutImageData(messages []OpenAIMessage) []OpenAIMessage {
+	stripped := make([]OpenAIMessage, len(messages))
+	for i, message := range messages {
+		stripped[i] = message
+		parts, ok := message.Content.([]interface{})
+		if !ok {
+			continue
+		}
+		content := make([]interface{}, len(parts))
+		for j, part := range parts {
+			content[j] = part
+			if urls := extractImageURLs([]interface{}{part}); len(urls) == 1 && strings.HasPrefix(urls[0], "data:") {
+				content[j] = map[string]interface{}{"type": "text", "text": storedImagePlaceholder}
+			}
+		}
+		stripped[i].Content = content
+	}
+	return stripped
+}
+
+// NewResponseStore creates a response store keeping up to capacity responses
+func NewResponseStore(capacity int) *ResponseStore {
+	return &ResponseStore{
+		responses: make(map[string]storedResponse),
+		capacity:  capacity,
+	}
+}
+
+// SetCapacity changes how many responses are kept, dropping the oldest ones
+func (s *ResponseStore) SetCapacity(capacity int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.capacity = capacity
+	s.evict()
+}
+
+// evict drops the oldest responses beyond the capacity or the size limit. The
+// caller holds the mutex.
+func (s *ResponseStore) evict() {
+	for len(s.order) > s.capacity || s.size > ResponseStoreMaxBytes {
+		s.size -= s.responses[s.order[0]].size
+		delete(s.responses, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+// Put stores a response. Images sent as data URLs are not kept, a conversation
+// continued from the response sees a placeholder instead.
+func (s *ResponseStore) Put(stored storedResponse) {
+	stored.Messages = withoutImageData(stored.Messages)
+	data, err := json.Marshal(stored)
+	if err != nil {
+		slog.Error("Error encoding stored response", "response_id", stored.Response.ID, "error", err)
+		return
+	}
+	stored.size = len(data)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.capacity == 0 {
+		return
+	}
+	if stored.size > ResponseStoreMaxBytes {
+		slog.Warn("Response too large to store for previous_response_id", "response_id", stored.Response.ID, "bytes", stored.size)
+		return
+	}
+	s.responses[stored.Response.ID] = stored
+	s.order = append(s.order, stored.Response.ID)
+	s.size += stored.size
+	s.evict()
+}
+
+// Get returns a response created with the given client key
+func (s *ResponseStore) Get(id, keyID string) (storedResponse, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stored, ok := s.responses[id]
+	if !ok || stored.KeyID != keyID {
+		return storedResponse{}, false
+	}
+	return stored, true
+}
+
+// Delete removes a response created with the given client key
+func (s *ResponseStore) Delete(id, keyID string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stored, ok := s.responses[id]
+	if !ok || stored.KeyID != keyID {
+		return false
+	}
+	delete(s.responses, id)
+	s.size -= stored.size
+	s.order = slices.DeleteFunc(s.order, func(other string) bool { return other == id })
+	return true
+}
+
+// handleResponses handles the OpenAI Responses API endpoint. The input items
+// are converted into chat messages and go through the same Raycast request
+// builder as chat completions.
+func handleResponses(c *gin.Context, config Config) {
+	var body OpenAIResponsesRequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, newErrorResponse("Invalid request body", "invalid_request_error", err.Error()))
+		return
+	}
+	keyID := c.GetString(apiKeyIDContextKey)
+
+	// Continue the conversation of a previous response
+	var messages []OpenAIMessage
+	if body.PreviousResponseID != "" {
+		previous, ok := config.Responses.Get(body.PreviousResponseID, keyID)
+		if !ok {
+			responseNotFound(c, body.PreviousResponseID, "previous_response_not_found")
+			return
+		}
+		messages = slices.Clone(previous.Messages)
+	}
+
+	input, err := convertResponsesInput(body.Input)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, newErrorResponse("Invalid 'input' field", "invalid_request_error", err.Error()))
+		return
+	}
+	if len(input) == 0 {
+		c.JSON(http.StatusBadRequest, newErrorResponse("Missing or invalid 'input' field", "invalid_request_error", ""))
+		return
+	}
+	messages = append(messages, input...)
+
+	// Describe the available tools to the model, if any
+	tools, toolChoice := convertResponsesTools(body.Tools, body.ToolChoice)
+	toolInstructions := buildToolInstructions(tools, toolChoice)
+
+	// Instructions only apply to this response and are not carried over to
+	// the next one, unlike system and developer messages of the input
+	systemPrompt, chatMessages := extractSystemMessages(messages)
+	systemPrompt = joinNonEmpty("\n\n", body.Instructions, systemPrompt)
+
+	// Use default model if not specified
+	model := body.Model
+	if model == "" {
+		model = config.DefaultModel
+	}
+
+	raycastMessages, err := convertMessages(config, chatMessages)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, newErrorResponse("Invalid image content", "invalid_request_error", err.Error()))
+		return
+	}
+
+	// Send the request, retrying and falling back to other models on failure
+	result, relayErr := relayChat(c, config, raycastChatParams{
+		Model:                        model,
+		Messages:                     raycastMessages,
+		SystemInstruction:            systemPrompt,
+		AdditionalSystemInstructions: toolInstructions,
+		Temperature:                  body.Temperature,
+		MaxTokens:                    body.MaxOutputTokens,
+	})
+	if relayErr != nil {
+		c.JSON(relayErr.Status, relayErr.toErrorResponse())
+		return
+	}
+	resp := result.Response
+	defer resp.Body.Close()
+
+	run := responseRun{
+		Request:   body,
+		ID:        newResponseItemID("resp"),
+		CreatedAt: time.Now().Unix(),
+		KeyID:     keyID,
+		Messages:  messages,
+		Store:     config.Responses,
+		Options: chatResponseOptions{
+			Model:     result.Model,
+			Request:   result.Request,
+			WithTools: toolInstructions != "",
+		},
+	}
+
+	getRequestRecord(c.Request.Context()).setStream(body.Stream)
+	if body.Stream {
+		defer config.Metrics.StreamStarted(c.FullPath())()
+		run.stream(c, resp)
+	} else {
+		run.respond(c, resp)
+	}
+}
+
+// handleGetResponse returns a stored response
+func handleGetResponse(c *gin.Context, config Config) {
+	stored, ok := config.Responses.Get(c.Param("id"), c.GetString(apiKeyIDContextKey))
+	if !ok {
+		responseNotFound(c, c.Param("id"), "")
+		return
+	}
+	c.JSON(http.StatusOK, stored.Response)
+}
+
+// handleDeleteResponse deletes a stored response
+func handleDeleteResponse(c *gin.Context, config Config) {
+	if !config.Responses.Delete(c.Param("id"), c.GetString(apiKeyIDContextKey)) {
+		responseNotFound(c, c.Param("id"), "")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":      c.Param("id"),
+		"object":  "response.deleted",
+		"deleted": true,
+	})
+}
+
+// responseNotFound writes the error for an unknown or expired response
+func responseNotFound(c *gin.Context, id, code string) {
+	resp := newErrorResponse(fmt.Sprintf("Response with id '%s' not found.", id), "invalid_request_error", "")
+	resp.Error.Code = code
+	c.JSON(http.StatusNotFound, resp)
+}
+
+// newResponseItemID generates an ID such as resp_... or msg_...
+func newResponseItemID(prefix string) string {
+	return prefix + "_" + strings.ReplaceAll(uuid.New().String(), "-", "")
+}
+
+// convertResponsesInput converts the input of a Responses API request, a
+// string or an array of items, into chat messages
+func convertResponsesInput(input interface{}) ([]OpenAIMessage, error) {
+	switch input := input.(type) {
+	case string:
+		return []OpenAIMessage{{Role: "user", Content: input}}, nil
+	case []interface{}:
+		var messages []OpenAIMessage
+		for i, raw := range input {
+			item, ok := raw.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("input item %d is not an object", i)
+			}
+			itemType, _ := item["type"].(string)
+			switch itemType {
+			case "", "message":
+				role, _ := item["role"].(string)
+				if role == "" {
+					return nil, fmt.Errorf("input item %d: role is required", i)
+				}
+				content, err := convertResponsesContent(item["content"])
+				if err != nil {
+					return nil, fmt.Errorf("input item %d: %w", i, err)
+				}
+				messages = append(messages, OpenAIMessage{Role: role, Content: content})
+			case "function_call":
+				call := OpenAIToolCall{Type: "function"}
+				call.ID, _ = item["call_id"].(string)
+				call.Function.Name, _ = item["name"].(string)
+				call.Function.Arguments, _ = item["arguments"].(string)
+				// Calls of the same turn belong to one assistant message
+				if n := len(messages); n > 0 && messages[n-1].Role == "assistant" {
+					messages[n-1].ToolCalls = append(messages[n-1].ToolCalls, call)
+				} else {
+					messages = append(messages, OpenAIMessage{Role: "assistant", Content: "", ToolCalls: []OpenAIToolCall{call}})
+				}
+			case "function_call_output":
+				callID, _ := item["call_id"].(string)
+				messages = append(messages, OpenAIMessage{
+					Role:       "tool",
+					Content:    responsesOutputText(item["output"]),
+					ToolCallID: callID,
+				})
+			default:
+				// Reasoning and built-in tool items have no Raycast equivalent
+				slog.Debug("Skipping unsupported input item", "type", itemType)
+			}
+		}
+		return messages, nil
+	}
+	return nil, errors.New("expected a string or an array of input items")
+}
+
+// convertResponsesContent converts the content of an input message into
+// chat message content, with images as image_url parts
+func convertResponsesContent(content interface{}) (interface{}, error) {
+	switch content := content.(type) {
+	case string:
+		return content, nil
+	case []interface{}:
+		parts := make([]interface{}, 0, len(content))
+		for _, raw := range content {
+			part, ok := raw.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			switch part["type"] {
+			case "input_text", "output_text", "text":
+				parts = append(parts, map[string]interface{}{"type": "text", "text": part["text"]})
+			case "refusal":
+				parts = append(parts, map[string]interface{}{"type": "text", "text": part["refusal"]})
+			case "input_image":
+				url, _ := part["image_url"].(string)
+				if url == "" {
+					return nil, errors.New("input_image parts need an image_url, file IDs are not supported")
+				}
+				parts = append(parts, map[string]interface{}{
+					"type":      "image_url",
+					"image_url": map[string]interface{}{"url": url},
+				})
+			default:
+				return nil, fmt.Errorf("unsupported content part type %v", part["type"])
+			}
+		}
+		return parts, nil
+	}
+	return nil, errors.New("content must be a string or an array of content parts")
+}
+
+// responsesOutputText extracts the text of a function call output
+func responsesOutputText(output interface{}) string {
+	switch output := output.(type) {
+	case string:
+		return output
+	case []interface{}:
+		var parts []string
+		for _, raw := range output {
+			if part, ok := raw.(map[string]interface{}); ok {
+				if text, ok := part["text"].(string); ok {
+					parts = append(parts, text)
+				}
+			}
+		}
+		return strings.Join(parts, "\n")
+	case nil:
+		return ""
+	}
+	data, _ := json.Marshal(output)
+	return string(data)
+}
+
+// convertResponsesTools converts function tools and tool choice into their
+// chat completions equivalents. Built-in tools are not available on Raycast.
+func convertResponsesTools(tools []OpenAIResponsesTool, choice interface{}) ([]OpenAITool, interface{}) {
+	openaiTools := make([]OpenAITool, 0, len(tools))
+	for _, tool := range tools {
+		if tool.Type != "function" {
+			slog.Debug("Skipping unsupported tool", "type", tool.Type)
+			continue
+		}
+		openaiTools = append(openaiTools, OpenAITool{
+			Type: "function",
+			Function: OpenAIToolFunction{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
+	}
+
+	// A named function is {"type": "function", "name": ...}, without nesting
+	if choiceMap, ok := choice.(map[string]interface{}); ok && choiceMap["type"] == "function" {
+		return openaiTools, map[string]interface{}{
+			"type":     "function",
+			"function": map[string]interface{}{"name": choiceMap["name"]},
+		}
+	}
+	return openaiTools, choice
+}
+
+// responseRun renders the Raycast reply of a Responses API request
+type responseRun struct {
+	Request   OpenAIResponsesRequest
+	ID        string
+	CreatedAt int64
+	KeyID     string
+	Messages  []OpenAIMessage // Conversation sent to Raycast, kept for chaining
+	Store     *ResponseStore
+	Options   chatResponseOptions
+}
+
+// stored reports whether the response is kept for previous_response_id
+func (r responseRun) stored() bool {
+	return r.Request.Store == nil || *r.Request.Store
+}
+
+// newResponse creates the response object with the given status and output
+func (r responseRun) newResponse(status string, output []interface{}) OpenAIResponse {
+	response := OpenAIResponse{
+		ID:                r.ID,
+		Object:            "response",
+		CreatedAt:         r.CreatedAt,
+		Status:            status,
+		Model:             r.Options.Model,
+		Output:            output,
+		Temperature:       r.Options.Request.Temperature,
+		ToolChoice:        r.Request.ToolChoice,
+		Tools:             r.Request.Tools,
+		ParallelToolCalls: true,
+		Store:             r.stored(),
+		Metadata:          r.Request.Metadata,
+	}
+	if response.Output == nil {
+		response.Output = []interface{}{}
+	}
+	if response.ToolChoice == nil {
+		response.ToolChoice = "auto"
+	}
+	if response.Tools == nil {
+		response.Tools = []OpenAIResponsesTool{}
+	}
+	if response.Metadata == nil {
+		response.Metadata = map[string]string{}
+	}
+	if r.Request.Instructions != "" {
+		response.Instructions = &r.Request.Instructions
+	}
+	if r.Request.PreviousResponseID != "" {
+		response.PreviousResponseID = &r.Request.PreviousResponseID
+	}
+	if r.Request.MaxOutputTokens > 0 {
+		response.MaxOutputTokens = &r.Request.MaxOutputTokens
+	}
+	return response
+}
+
+// responseReply is the Raycast reply, split into text and tool calls
+type responseReply struct {
+	CompletionText string // Text as generated, tool call blocks included
+	Text           string // Text without the tool call blocks
+	ToolCalls      []OpenAIToolCall
+	FinishReason   string
+	Usage          *RaycastUsage
+}
+
+// finish completes the response, records its usage and stores it
+func (r responseRun) finish(c *gin.Context, reply responseReply, output []interface{}) OpenAIResponse {
+	usage := buildUsage(r.Options.Request, reply.CompletionText, reply.Usage)
+	getRequestRecord(c.Request.Context()).setUsage(r.Options.Request, usage)
+	logReply(r.Options, reply.CompletionText, usage)
+
+	response := r.newResponse("completed", output)
+	switch mapFinishReason(reply.FinishReason, len(reply.ToolCalls) > 0) {
+	case "length":
+		response.Status = "incomplete"
+		response.IncompleteDetails = &OpenAIIncompleteDetails{Reason: "max_output_tokens"}
+	case "content_filter":
+		response.Status = "incomplete"
+		response.IncompleteDetails = &OpenAIIncompleteDetails{Reason: "content_filter"}
+	}
+	response.Usage = &OpenAIResponsesUsage{
+		InputTokens:  usage.PromptTokens,
+		OutputTokens: usage.CompletionTokens,
+		TotalTokens:  usage.TotalTokens,
+	}
+
+	// Keep the conversation so that the next request can continue it
+	if r.stored() {
+		r.Store.Put(storedResponse{
+			Response: response,
+			Messages: append(slices.Clip(r.Messages), OpenAIMessage{
+				Role:      "assistant",
+				Content:   reply.Text,
+				ToolCalls: reply.ToolCalls,
+			}),
+			KeyID: r.KeyID,
+		})
+	}
+	return response
+}
+
+// newOutputMessage creates a completed assistant message item
+func newOutputMessage(id, text string) OpenAIResponseOutputMessage {
+	return OpenAIResponseOutputMessage{
+		Type:    "message",
+		ID:      id,
+		Status:  "completed",
+		Role:    "assistant",
+		Content: []OpenAIResponseOutputText{newOutputText(text)},
+	}
+}
+
+// newOutputText creates an output_text content part
+func newOutputText(text string) OpenAIResponseOutputText {
+	return OpenAIResponseOutputText{Type: "output_text", Text: text, Annotations: []string{}}
+}
+
+// newFunctionCallItem converts a parsed tool call into a function_call item
+func newFunctionCallItem(call OpenAIToolCall) OpenAIResponseFunctionCall {
+	return OpenAIResponseFunctionCall{
+		Type:      "function_call",
+		ID:        newResponseItemID("fc"),
+		CallID:    call.ID,
+		Name:      call.Function.Name,
+		Arguments: call.Function.Arguments,
+		Status:    "completed",
+	}
+}
+
+// respond collects the Raycast reply into a response object
+func (r responseRun) respond(c *gin.Context, response *http.Response) {
+	var reply responseReply
+	var completionText strings.Builder
+	err := readRaycastEvents(response.Body, func(data RaycastSSEData) bool {
+		if data.FinishReason != "" {
+			reply.FinishReason = data.FinishReason
+		}
+		if data.Usage != nil {
+			reply.Usage = data.Usage
+		}
+		completionText.WriteString(data.Text)
+		return true
+	})
+	if err != nil {
+		if clientDisconnected(c) {
+			logCancelledRequest(c, r.Options.Model)
+			return
+		}
+		c.JSON(http.StatusInternalServerError, newErrorResponse("Error reading response body", "server_error", err.Error()))
+		return
+	}
+
+	reply.CompletionText = completionText.String()
+	reply.Text = reply.CompletionText
+	if r.Options.WithTools {
+		reply.Text, reply.ToolCalls = extractToolCalls(reply.CompletionText)
+	}
+
+	output := []interface{}{}
+	if reply.Text != "" || len(reply.ToolCalls) == 0 {
+		output = append(output, newOutputMessage(newResponseItemID("msg"), reply.Text))
+	}
+	for _, call := range reply.ToolCalls {
+		output = append(output, newFunctionCallItem(call))
+	}
+
+	c.JSON(http.StatusOK, r.finish(c, reply, output))
+}
+
+// stream relays the Raycast stream as typed Responses API events
+func (r responseRun) stream(c *gin.Context, response *http.Response) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		slog.Error("Streaming unsupported")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// writeEvent sends a single typed SSE event
+	sequence := 0
+	writeEvent := func(event string, data gin.H) {
+		data["type"] = event
+		data["sequence_number"] = sequence
+		sequence++
+		eventData, err := json.Marshal(data)
+		if err != nil {
+			slog.Error("Error marshaling event", "event", event, "error", err)
+			return
+		}
+		fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", event, string(eventData))
+		flusher.Flush()
+	}
+
+	writeEvent("response.created", gin.H{"response": r.newResponse("in_progress", nil)})
+	writeEvent("response.in_progress", gin.H{"response": r.newResponse("in_progress", nil)})
+
+	record := getRequestRecord(c.Request.Context())
+
+	// Output items are opened lazily; text after a tool call starts a new message
+	output := []interface{}{}
+	var message *OpenAIResponseOutputMessage
+	var messageText, replyText strings.Builder
+	openMessage := func() {
+		if message != nil {
+			return
+		}
+		message = &OpenAIResponseOutputMessage{
+			Type:    "message",
+			ID:      newResponseItemID("msg"),
+			Status:  "in_progress",
+			Role:    "assistant",
+			Content: []OpenAIResponseOutputText{},
+		}
+		writeEvent("response.output_item.added", gin.H{"output_index": len(output), "item": message})
+		writeEvent("response.content_part.added", gin.H{
+			"item_id":       message.ID,
+			"output_index":  len(output),
+			"content_index": 0,
+			"part":          newOutputText(""),
+		})
+	}
+	closeMessage := func() {
+		if message == nil {
+			return
+		}
+		text := messageText.String()
+		writeEvent("response.output_text.done", gin.H{
+			"item_id":       message.ID,
+			"output_index":  len(output),
+			"content_index": 0,
+			"text":          text,
+		})
+		writeEvent("response.content_part.done", gin.H{
+			"item_id":       message.ID,
+			"output_index":  len(output),
+			"content_index": 0,
+			"part":          newOutputText(text),
+		})
+		item := newOutputMessage(message.ID, text)
+		writeEvent("response.output_item.done", gin.H{"output_index": len(output), "item": item})
+		output = append(output, item)
+		message = nil
+		messageText.Reset()
+	}
+	sendText := func(text string) {
+		if text == "" {
+			return
+		}
+		record.markFirstToken()
+		openMessage()
+		messageText.WriteString(text)
+		replyText.WriteString(text)
+		writeEvent("response.output_text.delta", gin.H{
+			"item_id":       message.ID,
+			"output_index":  len(output),
+			"content_index": 0,
+			"delta":         text,
+		})
+	}
+	var toolCalls []OpenAIToolCall
+	sendToolCalls := func(calls []OpenAIToolCall) {
+		for _, call := range calls {
+			record.markFirstToken()
+			closeMessage()
+			item := newFunctionCallItem(call)
+			added := item
+			added.Status, added.Arguments = "in_progress", ""
+			writeEvent("response.output_item.added", gin.H{"output_index": len(output), "item": added})
+			writeEvent("response.function_call_arguments.delta", gin.H{
+				"item_id":      item.ID,
+				"output_index": len(output),
+				"delta":        item.Arguments,
+			})
+			writeEvent("response.function_call_arguments.done", gin.H{
+				"item_id":      item.ID,
+				"output_index": len(output),
+				"arguments":    item.Arguments,
+			})
+			writeEvent("response.output_item.done", gin.H{"output_index": len(output), "item": item})
+			output = append(output, item)
+			toolCalls = append(toolCalls, call)
+		}
+	}
+
+	var toolParser *toolCallStreamParser
+	if r.Options.WithTools {
+		toolParser = &toolCallStreamParser{}
+	}
+
+	var reply responseReply
+	var completionText strings.Builder
+	err := readRaycastEvents(response.Body, func(data RaycastSSEData) bool {
+		if data.FinishReason != "" {
+			reply.FinishReason = data.FinishReason
+		}
+		if data.Usage != nil {
+			reply.Usage = data.Usage
+		}
+		completionText.WriteString(data.Text)
+
+		if toolParser == nil {
+			sendText(data.Text)
+			return true
+		}
+		text, calls := toolParser.Feed(data.Text)
+		sendText(text)
+		sendToolCalls(calls)
+		return true
+	})
+	if err != nil {
+		if clientDisconnected(c) {
+			logCancelledRequest(c, r.Options.Model)
+			return
+		}
+		slog.Error("Error reading from response", "error", err)
+	}
+	if toolParser != nil {
+		sendText(toolParser.Flush())
+	}
+
+	// A reply without any output still has an empty message
+	if len(output) == 0 {
+		openMessage()
+	}
+	closeMessage()
+
+	reply.CompletionText = completionText.String()
+	reply.Text = replyText.String()
+	reply.ToolCalls = toolCalls
+	final := r.finish(c, reply, output)
+
+	event := "response.completed"
+	if final.Status == "incomplete" {
+		event = "response.incomplete"
+	}
+	writeEvent(event, gin.H{"response": final})
+}
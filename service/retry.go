@@ -0,0 +1,178 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 19:58:40
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 19:58:40
+ * @FilePath: /raycast2api/service/retry.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Upstream failures are retried with jittered exponential backoff, then the
+// next model of the fallback chain is tried. All of this happens before any
+// byte is sent to the client, so it is invisible apart from the latency and
+// the model reported in the response.
+
+// retryable reports whether another attempt may succeed: transport errors,
+// rate limits, rejected tokens (the pool hands out another one) and 5xx
+func (e *relayError) retryable() bool {
+	if e.Type != "relay_error" {
+		return false
+	}
+	switch e.Status {
+	case http.StatusUnauthorized, http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return e.Status >= 500
+}
+
+// retryDelay returns the backoff before retry number attempt (starting at 1):
+// the base delay doubled on every attempt, capped, with equal jitter
+func retryDelay(config Config, attempt int) time.Duration {
+	delay := config.RetryBaseDelay << (attempt - 1)
+	if delay <= 0 || delay > config.RetryMaxDelay {
+		delay = config.RetryMaxDelay
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// sleepContext waits for d, returning false if ctx is cancelled first
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// parseModelFallbacks parses MODEL_FALLBACKS, a semicolon separated list of
+// model=fallback1,fallback2 chains
+func parseModelFallbacks(value string) (map[string][]string, error) {
+	fallbacks := make(map[string][]string)
+	for _, chain := range strings.Split(value, ";") {
+		if strings.TrimSpace(chain) == "" {
+			continue
+		}
+		model, list, ok := strings.Cut(chain, "=")
+		model = strings.TrimSpace(model)
+		if !ok || model == "" {
+			return nil, fmt.Errorf("invalid fallback chain %q, expected model=fallback1,fallback2", chain)
+		}
+		for _, fallback := range strings.Split(list, ",") {
+			if fallback = strings.TrimSpace(fallback); fallback != "" && fallback != model {
+				fallbacks[model] = append(fallbacks[model], fallback)
+			}
+		}
+	}
+	return fallbacks, nil
+}
+
+// modelChain returns the model followed by its fallbacks
+func modelChain(config Config, model string) []string {
+	return append([]string{model}, config.ModelFallbacks[model]...)
+}
+
+// relayResult is the upstream response obtained by relayChat
+type relayResult struct {
+	Request  RaycastChatRequest // Request that was answered
+	Response *http.Response     // Response, which the caller must close
+	Model    string             // Model serving the reply: the requested one or a fallback
+}
+
+// closeRelayResults closes the responses of the results that were obtained
+func closeRelayResults(results []relayResult) {
+	for _, result := range results {
+		if result.Response != nil {
+			result.Response.Body.Close()
+		}
+	}
+}
+
+// relayChat sends a chat request to Raycast, retrying failed attempts and
+// walking the fallback chain of the model
+func relayChat(c *gin.Context, config Config, params raycastChatParams) (relayResult, *relayError) {
+	ctx := c.Request.Context()
+
+	var lastErr *relayError
+	for i, model := range modelChain(config, params.Model) {
+		// Fallbacks must exist, be able to handle the request and be usable
+		// by the client key; the requested model fails right away otherwise
+		modelParams := params
+		modelParams.Model = model
+		request, relayErr := buildRaycastRequest(ctx, config, modelParams)
+		if relayErr == nil {
+			relayErr = checkModelAccess(c, request.Model)
+		}
+		if relayErr != nil {
+			if i == 0 {
+				return relayResult{}, relayErr
+			}
+			slog.Debug("Skipping fallback model", "model", model, "error", relayErr.Message)
+			continue
+		}
+
+		// Models whose breaker is open fail fast, or hand over to the next fallback
+		if !config.Breakers.Allow(request.Provider, request.Model) {
+			lastErr = config.Breakers.openError(request.Provider, request.Model)
+			slog.Debug("Circuit breaker open, skipping model", "model", request.Model)
+			continue
+		}
+
+		if i > 0 {
+			slog.Warn("Falling back to another model", "model", params.Model, "fallback", model, "error", lastErr.Message)
+			config.Metrics.Fallback(params.Model, model)
+		}
+
+		for attempt := 0; attempt <= config.MaxRetries; attempt++ {
+			if attempt > 0 {
+				delay := retryDelay(config, attempt)
+				slog.Info("Retrying Raycast request", "model", request.Model, "attempt", attempt, "delay", delay, "error", lastErr.Message)
+				if !sleepContext(ctx, delay) {
+					return relayResult{}, &relayError{
+						Status:  statusClientClosedRequest,
+						Message: "Client closed the request",
+						Type:    "client_cancelled",
+						Details: ctx.Err().Error(),
+					}
+				}
+				// Stop retrying a model whose breaker opened meanwhile
+				if !config.Breakers.Allow(request.Provider, request.Model) {
+					lastErr = config.Breakers.openError(request.Provider, request.Model)
+					break
+				}
+				config.Metrics.Retry(request.Model, request.Provider)
+			}
+
+			resp, relayErr := sendRaycastRequest(ctx, config, request)
+			config.Breakers.Report(request.Provider, request.Model, relayErr)
+			if relayErr == nil {
+				return relayResult{Request: request, Response: resp, Model: model}, nil
+			}
+			lastErr = relayErr
+			if !relayErr.retryable() {
+				return relayResult{}, relayErr
+			}
+		}
+	}
+
+	return relayResult{}, lastErr
+}
@@ -13,20 +13,22 @@
 package service
 
 import (
-	"log"
 	"net/http"
-	"time"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
 // setupMiddlewares configures all middlewares for the router
-func setupMiddlewares(router *gin.Engine, config Config) {
+func setupMiddlewares(router *gin.Engine, store *ConfigStore) {
+	// Log every request, including the ones rejected below
+	router.Use(requestLogger())
+
 	// Handle CORS preflight requests
 	router.Use(func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, PATCH, DELETE, OPTIONS")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, x-api-key, anthropic-version, x-goog-api-key")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(http.StatusOK)
@@ -36,51 +38,203 @@ func setupMiddlewares(router *gin.Engine, config Config) {
 		c.Next()
 	})
 
-	// API key validation middleware
+	// Count requests in flight and turn new ones away while shutting down
 	router.Use(func(c *gin.Context) {
-		if !validateAPIKey(c, config) {
-			c.JSON(http.StatusUnauthorized, ErrorResponse{
-				Error: struct {
-					Message string `json:"message"`
-					Type    string `json:"type"`
-					Details string `json:"details,omitempty"`
-				}{
-					Message: "Invalid API key",
-					Type:    "authentication_error",
-				},
-			})
+		drain := store.Get().Drain
+		if drain.Refusing() && c.Request.URL.Path != "/health" && c.Request.URL.Path != "/ready" {
+			c.Header("Connection", "close")
+			if c.Request.URL.Path == "/v1/messages" {
+				anthropicError(c, http.StatusServiceUnavailable, "overloaded_error", "Server is shutting down")
+			} else if isGeminiPath(c.Request.URL.Path) {
+				geminiError(c, http.StatusServiceUnavailable, "Server is shutting down")
+			} else if isOllamaPath(c.Request.URL.Path) {
+				ollamaError(c, http.StatusServiceUnavailable, "Server is shutting down")
+			} else {
+				c.JSON(http.StatusServiceUnavailable, newErrorResponse("Server is shutting down", "server_shutting_down", ""))
+			}
 			c.Abort()
 			return
 		}
+
+		drain.begin()
+		defer drain.end()
 		c.Next()
 	})
 
-	// Log request middleware
+	// API key validation middleware
 	router.Use(func(c *gin.Context) {
-		timestamp := time.Now().Format(time.RFC3339)
-		log.Printf("[%s] %s %s", timestamp, c.Request.Method, c.Request.URL.Path)
+		// The admin API, usage and metrics are protected by the admin key
+		// instead, and the probes are open to the orchestrator
+		switch path := c.Request.URL.Path; {
+		case strings.HasPrefix(path, "/admin/"), path == "/metrics", path == "/v1/usage", path == "/health", path == "/ready":
+			c.Next()
+			return
+		}
+		config := store.Get()
+		policy, ok := validateAPIKey(c, config)
+		if !ok {
+			if isGeminiPath(c.Request.URL.Path) {
+				geminiError(c, http.StatusUnauthorized, "Invalid API key")
+			} else if isOllamaPath(c.Request.URL.Path) {
+				ollamaError(c, http.StatusUnauthorized, "Invalid API key")
+			} else {
+				c.JSON(http.StatusUnauthorized, ErrorResponse{
+					Error: struct {
+						Message string `json:"message"`
+						Type    string `json:"type"`
+						Details string `json:"details,omitempty"`
+						Code    string `json:"code,omitempty"`
+					}{
+						Message: "Invalid API key",
+						Type:    "authentication_error",
+					},
+				})
+			}
+			c.Abort()
+			return
+		}
+		c.Set(apiKeyIDContextKey, policy.Name)
+		c.Set(apiKeyPolicyContextKey, policy)
+
+		// Apply the per-key rate limits
+		key := getRequestAPIKey(c)
+		status := config.Keys.Admit(key, 1)
+		status.setHeaders(c)
+		if status.Limited != "" {
+			if c.Request.URL.Path == "/v1/messages" {
+				anthropicError(c, http.StatusTooManyRequests, "rate_limit_error", status.message(policy.Name))
+			} else if isGeminiPath(c.Request.URL.Path) {
+				geminiError(c, http.StatusTooManyRequests, status.message(policy.Name))
+			} else if isOllamaPath(c.Request.URL.Path) {
+				ollamaError(c, http.StatusTooManyRequests, status.message(policy.Name))
+			} else {
+				c.JSON(http.StatusTooManyRequests, newErrorResponse(status.message(policy.Name), "rate_limit_exceeded", status.Limited))
+			}
+			c.Abort()
+			return
+		}
+
 		c.Next()
+
+		// Count the tokens of the reply against the daily budget of the key
+		config.Keys.AddTokens(key, getRequestRecord(c.Request.Context()).totalTokens())
 	})
+
+	// Request metrics middleware, the metrics and ledger survive reloads
+	router.Use(trackRequests(store.Get()))
+
 }
 
-// setupRoutes configures all routes for the application
-func Router(config *Config) *gin.Engine {
-	router := gin.Default()
-	setupMiddlewares(router, *config) // Dereference when passing to setupMiddlewares
+// adminAuth validates the admin key for the admin API
+func adminAuth(store *ConfigStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !validateAdminKey(c, store.Get()) {
+			c.JSON(http.StatusUnauthorized, newErrorResponse("Invalid admin key", "authentication_error", ""))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// Router configures all routes for the application. Every request is served
+// with a snapshot of the configuration taken from the store.
+func Router(store *ConfigStore) *gin.Engine {
+	router := gin.New()
+	router.Use(gin.Recovery())
+	setupMiddlewares(router, store)
 	router.POST("/v1/chat/completions", func(c *gin.Context) {
-		handleChatCompletions(c, *config) // Dereference when passing to handlers
+		handleChatCompletions(c, store.Get())
+	})
+
+	router.POST("/v1/completions", func(c *gin.Context) {
+		handleCompletions(c, store.Get())
+	})
+
+	router.POST("/v1/responses", func(c *gin.Context) {
+		handleResponses(c, store.Get())
+	})
+	router.GET("/v1/responses/:id", func(c *gin.Context) {
+		handleGetResponse(c, store.Get())
+	})
+	router.DELETE("/v1/responses/:id", func(c *gin.Context) {
+		handleDeleteResponse(c, store.Get())
+	})
+
+	router.POST("/v1/messages", func(c *gin.Context) {
+		handleAnthropicMessages(c, store.Get())
+	})
+
+	// Gemini API, the method is part of the model segment: {model}:generateContent
+	router.POST("/v1beta/models/:model", func(c *gin.Context) {
+		handleGeminiModelAction(c, store.Get())
+	})
+	router.GET("/v1beta/models", func(c *gin.Context) {
+		handleGeminiModels(c, store.Get())
+	})
+	router.GET("/v1beta/models/:model", func(c *gin.Context) {
+		handleGeminiModel(c, store.Get())
+	})
+
+	// Ollama API, for local tools that only speak Ollama
+	router.POST("/api/chat", func(c *gin.Context) {
+		handleOllamaChat(c, store.Get())
+	})
+	router.POST("/api/generate", func(c *gin.Context) {
+		handleOllamaGenerate(c, store.Get())
+	})
+	router.GET("/api/tags", func(c *gin.Context) {
+		handleOllamaTags(c, store.Get())
 	})
 
 	router.GET("/v1/models", func(c *gin.Context) {
-		handleModels(c, *config) // Dereference when passing to handlers
+		handleModels(c, store.Get())
 	})
 
 	router.GET("/v1/refresh-models", func(c *gin.Context) {
-		handleRefreshModels(c, *config) // Dereference when passing to handlers
+		handleRefreshModels(c, store.Get())
+	})
+
+	// Metrics are public unless an admin key is configured
+	router.GET("/metrics", func(c *gin.Context) {
+		config := store.Get()
+		if config.AdminKey != "" && !validateAdminKey(c, config) {
+			c.JSON(http.StatusUnauthorized, newErrorResponse("Invalid admin key", "authentication_error", ""))
+			return
+		}
+		config.Metrics.Handler().ServeHTTP(c.Writer, c.Request)
 	})
 
+	router.GET("/v1/usage", adminAuth(store), func(c *gin.Context) {
+		handleUsage(c, store.Get())
+	})
+
+	admin := router.Group("/admin", adminAuth(store))
+	admin.GET("/tokens", func(c *gin.Context) {
+		handleTokenStatus(c, store.Get())
+	})
+	admin.GET("/breakers", func(c *gin.Context) {
+		handleBreakerStatus(c, store.Get())
+	})
+	admin.GET("/keys", func(c *gin.Context) {
+		handleListKeys(c, store.Get())
+	})
+	admin.POST("/keys", func(c *gin.Context) {
+		handleCreateKey(c, store.Get())
+	})
+	admin.PATCH("/keys/:id", func(c *gin.Context) {
+		handleUpdateKey(c, store.Get())
+	})
+	admin.DELETE("/keys/:id", func(c *gin.Context) {
+		handleRevokeKey(c, store.Get())
+	})
+
+	// Liveness and readiness probes, both fail once the relay is shutting down
 	router.GET("/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+		handleHealth(c, store.Get())
+	})
+	router.GET("/ready", func(c *gin.Context) {
+		handleReady(c, store.Get())
 	})
 
 	return router
@@ -0,0 +1,297 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-17 11:05:42
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-17 11:05:42
+ * @FilePath: /raycast2api/service/router_test.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/missuo/raycast2api/mockraycast"
+)
+
+// newTestRelay starts the full router in front of a mock Raycast backend
+func newTestRelay(t *testing.T) (*httptest.Server, *mockraycast.Server) {
+	t.Helper()
+	relay, mock, _ := newTestRelayConfig(t)
+	return relay, mock
+}
+
+// newTestRelayConfig is newTestRelay that also returns the configuration the
+// router serves with. Settings can be changed with t.Setenv beforehand.
+func newTestRelayConfig(t *testing.T) (*httptest.Server, *mockraycast.Server, *Config) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	mock := mockraycast.NewServer()
+	t.Cleanup(mock.Close)
+
+	t.Setenv("RAYCAST_BEARER_TOKEN", "test-token")
+	t.Setenv("RAYCAST_BASE_URL", mock.URL)
+	t.Setenv("API_KEY", "")
+	t.Setenv("LOG_LEVEL", "error")
+	config, err := loadConfig("", nil)
+	if err != nil {
+		t.Fatalf("loading config: %v", err)
+	}
+
+	relay := httptest.NewServer(Router(NewConfigStore(config)))
+	t.Cleanup(relay.Close)
+	return relay, mock, config
+}
+
+// postJSON sends a JSON request body to the relay
+func postJSON(t *testing.T, url, body string) *http.Response {
+	t.Helper()
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestRouterModels(t *testing.T) {
+	relay, _ := newTestRelay(t)
+
+	resp, err := http.Get(relay.URL + "/v1/models")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200", resp.StatusCode)
+	}
+
+	var list struct {
+		Object string `json:"object"`
+		Data   []struct {
+			ID      string `json:"id"`
+			OwnedBy string `json:"owned_by"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if list.Object != "list" {
+		t.Errorf("object %q, want list", list.Object)
+	}
+	var ids []string
+	for _, model := range list.Data {
+		ids = append(ids, model.ID)
+	}
+	for _, model := range mockraycast.DefaultModels {
+		if !slices.Contains(ids, model.Model) {
+			t.Errorf("model %s missing from %v", model.Model, ids)
+		}
+	}
+}
+
+func TestRouterChatCompletion(t *testing.T) {
+	relay, mock := newTestRelay(t)
+
+	resp := postJSON(t, relay.URL+"/v1/chat/completions", `{
+		"model": "gpt-4o",
+		"messages": [
+			{"role": "system", "content": "Be brief."},
+			{"role": "user", "content": "Hello relay"}
+		]
+	}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200", resp.StatusCode)
+	}
+
+	var completion OpenAIChatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&completion); err != nil {
+		t.Fatal(err)
+	}
+	if len(completion.Choices) != 1 {
+		t.Fatalf("%d choices, want 1", len(completion.Choices))
+	}
+	choice := completion.Choices[0]
+	if choice.Message.Content == nil || *choice.Message.Content != "Echo: Hello relay" {
+		t.Errorf("content %v, want Echo: Hello relay", choice.Message.Content)
+	}
+	if choice.FinishReason != "stop" {
+		t.Errorf("finish_reason %q, want stop", choice.FinishReason)
+	}
+	if completion.Model != "gpt-4o" {
+		t.Errorf("model %q, want gpt-4o", completion.Model)
+	}
+	if completion.Usage.PromptTokens == 0 || completion.Usage.CompletionTokens == 0 {
+		t.Errorf("usage %+v, want prompt and completion tokens", completion.Usage)
+	}
+
+	// The system message becomes the Raycast system instruction
+	requests := mock.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("%d upstream requests, want 1", len(requests))
+	}
+	upstream := requests[0]
+	if upstream.Model != "gpt-4o" || upstream.Provider != "openai" {
+		t.Errorf("upstream model %s/%s, want openai/gpt-4o", upstream.Provider, upstream.Model)
+	}
+	if upstream.SystemInstruction != "Be brief." {
+		t.Errorf("system instruction %q, want Be brief.", upstream.SystemInstruction)
+	}
+	if len(upstream.Messages) != 1 || upstream.Messages[0].Content.Text != "Hello relay" {
+		t.Errorf("upstream messages %+v, want the user message only", upstream.Messages)
+	}
+	if upstream.Token != "test-token" {
+		t.Errorf("upstream token %q, want test-token", upstream.Token)
+	}
+}
+
+func TestRouterChatCompletionStream(t *testing.T) {
+	relay, mock := newTestRelay(t)
+	mock.Reply = mockraycast.TextReply("Streamed from the mock")
+
+	resp := postJSON(t, relay.URL+"/v1/chat/completions", `{
+		"model": "gpt-4o",
+		"stream": true,
+		"stream_options": {"include_usage": true},
+		"messages": [{"role": "user", "content": "Hello relay"}]
+	}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200", resp.StatusCode)
+	}
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/event-stream") {
+		t.Errorf("content type %q, want text/event-stream", contentType)
+	}
+
+	var text strings.Builder
+	var finishReason string
+	var usage *OpenAIUsage
+	done := false
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			done = true
+			break
+		}
+		var chunk OpenAIChatChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("invalid chunk %s: %v", data, err)
+		}
+		if chunk.Object != "chat.completion.chunk" {
+			t.Errorf("object %q, want chat.completion.chunk", chunk.Object)
+		}
+		for _, choice := range chunk.Choices {
+			text.WriteString(choice.Delta.Content)
+			if choice.FinishReason != nil {
+				finishReason = *choice.FinishReason
+			}
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !done {
+		t.Error("stream did not end with [DONE]")
+	}
+	if text.String() != "Streamed from the mock" {
+		t.Errorf("streamed text %q, want Streamed from the mock", text.String())
+	}
+	if finishReason != "stop" {
+		t.Errorf("finish_reason %q, want stop", finishReason)
+	}
+	if usage == nil || usage.CompletionTokens == 0 {
+		t.Errorf("usage %+v, want a usage chunk with completion tokens", usage)
+	}
+}
+
+func TestRouterChatCompletionFallback(t *testing.T) {
+	t.Setenv("MODEL_FALLBACKS", "gpt-4o=gpt-4.1")
+	t.Setenv("RAYCAST_MAX_RETRIES", "0")
+	relay, mock, config := newTestRelayConfig(t)
+	mock.Reply = func(req mockraycast.ChatRequest) mockraycast.Reply {
+		if req.Model == "gpt-4o" {
+			return mockraycast.Reply{Status: http.StatusServiceUnavailable, Body: `{"error":"overloaded"}`}
+		}
+		return mockraycast.EchoReply(req)
+	}
+
+	resp := postJSON(t, relay.URL+"/v1/chat/completions", `{
+		"model": "gpt-4o",
+		"messages": [{"role": "user", "content": "Hello relay"}]
+	}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200", resp.StatusCode)
+	}
+	io.Copy(io.Discard, resp.Body)
+
+	requests := mock.Requests()
+	if len(requests) != 2 || requests[0].Model != "gpt-4o" || requests[1].Model != "gpt-4.1" {
+		t.Fatalf("upstream requests %+v, want gpt-4o then gpt-4.1", requests)
+	}
+
+	// Only the fallback that answered is billed
+	records, err := config.Usage.Records(UsageFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("%d ledger records, want 1: %+v", len(records), records)
+	}
+	record := records[0]
+	if record.Model != "gpt-4.1" || record.Status != http.StatusOK {
+		t.Errorf("ledger record %s/%d, want gpt-4.1/200", record.Model, record.Status)
+	}
+	if record.PromptTokens == 0 || record.CompletionTokens == 0 {
+		t.Errorf("ledger record %+v, want prompt and completion tokens", record)
+	}
+	if record.RequestID == "" {
+		t.Error("ledger record without a request id")
+	}
+
+	// The request metrics are labelled with the fallback too
+	metrics, err := http.Get(relay.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer metrics.Body.Close()
+	body, err := io.ReadAll(metrics.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"raycast2api_requests_total{", "raycast2api_request_duration_seconds_count{", "raycast2api_tokens_total{"} {
+		var lines []string
+		for _, line := range strings.Split(string(body), "\n") {
+			if strings.HasPrefix(line, name) {
+				lines = append(lines, line)
+			}
+		}
+		if len(lines) == 0 {
+			t.Errorf("no %s metrics", name)
+		}
+		for _, line := range lines {
+			if !strings.Contains(line, `model="gpt-4.1"`) {
+				t.Errorf("metric %s, want the gpt-4.1 label", line)
+			}
+		}
+	}
+}
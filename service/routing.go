@@ -0,0 +1,186 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 20:51:36
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 20:51:36
+ * @FilePath: /raycast2api/service/routing.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ModelRouter maps the model names sent by clients to Raycast models:
+// aliases first, then rewrite rules in order, then the name as is
+type ModelRouter struct {
+	aliases      map[string]string // Alias to model, matched case-insensitively
+	rules        []modelRule
+	strict       bool            // Reject unknown models instead of using the default model
+	defaultModel ModelCacheEntry // Model serving unknown names when not strict
+}
+
+// modelRule rewrites model names matching a glob or a regular expression
+type modelRule struct {
+	pattern string
+	regexp  *regexp.Regexp // nil for glob rules
+	target  string         // May reference regexp groups as $1
+}
+
+// ModelRuleSettings is a rewrite rule as configured. Match is a glob, or a
+// regular expression when prefixed with re:, whose groups can be used in Model.
+type ModelRuleSettings struct {
+	Match string `yaml:"match" toml:"match"`
+	Model string `yaml:"model" toml:"model"`
+}
+
+// parseModelAliases parses MODEL_ALIASES, a comma separated list of alias=model
+func parseModelAliases(value string) (map[string]string, error) {
+	aliases := make(map[string]string)
+	for _, entry := range strings.Split(value, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		alias, model, ok := strings.Cut(entry, "=")
+		alias, model = strings.TrimSpace(alias), strings.TrimSpace(model)
+		if !ok || alias == "" || model == "" {
+			return nil, fmt.Errorf("invalid model alias %q, expected alias=model", entry)
+		}
+		aliases[alias] = model
+	}
+	return aliases, nil
+}
+
+// parseModelRules parses MODEL_RULES, a semicolon separated list of
+// pattern=model. Regular expressions may contain commas, hence semicolons.
+func parseModelRules(value string) ([]ModelRuleSettings, error) {
+	var rules []ModelRuleSettings
+	for _, entry := range strings.Split(value, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		// Split on the last = so that patterns may contain one
+		i := strings.LastIndex(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid model rule %q, expected pattern=model", entry)
+		}
+		rules = append(rules, ModelRuleSettings{
+			Match: strings.TrimSpace(entry[:i]),
+			Model: strings.TrimSpace(entry[i+1:]),
+		})
+	}
+	return rules, nil
+}
+
+// NewModelRouter creates a model router. Unknown models resolve to
+// defaultModel, or fail when strict.
+func NewModelRouter(aliases map[string]string, rules []ModelRuleSettings, strict bool, defaultModel ModelCacheEntry) (*ModelRouter, error) {
+	router := &ModelRouter{aliases: make(map[string]string), strict: strict, defaultModel: defaultModel}
+	for alias, model := range aliases {
+		if alias == "" || model == "" {
+			return nil, fmt.Errorf("invalid model alias %q=%q, alias and model are required", alias, model)
+		}
+		router.aliases[alias] = model
+	}
+
+	for i, settings := range rules {
+		rule := modelRule{pattern: settings.Match, target: settings.Model}
+		if rule.pattern == "" || rule.target == "" {
+			return nil, fmt.Errorf("model rule %d: match and model are required", i+1)
+		}
+		if expr, ok := strings.CutPrefix(rule.pattern, "re:"); ok {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("model rule %d: invalid regular expression: %w", i+1, err)
+			}
+			rule.regexp = re
+		} else if _, err := path.Match(rule.pattern, ""); err != nil {
+			return nil, fmt.Errorf("model rule %d: invalid pattern %q: %w", i+1, rule.pattern, err)
+		}
+		router.rules = append(router.rules, rule)
+	}
+
+	return router, nil
+}
+
+// route applies the aliases and rules to a model name
+func (r *ModelRouter) route(model string) string {
+	if r == nil {
+		return model
+	}
+	if target, ok := r.aliases[model]; ok {
+		return target
+	}
+	// Aliases differing only in case match in a fixed order
+	for _, alias := range slices.Sorted(maps.Keys(r.aliases)) {
+		if strings.EqualFold(alias, model) {
+			return r.aliases[alias]
+		}
+	}
+	for _, rule := range r.rules {
+		if rule.regexp != nil {
+			if match := rule.regexp.FindStringSubmatchIndex(model); match != nil {
+				return string(rule.regexp.ExpandString(nil, rule.target, model, match))
+			}
+			continue
+		}
+		if matchModelPattern(rule.pattern, model) {
+			return rule.target
+		}
+	}
+	return model
+}
+
+// Resolve finds the Raycast model serving a client model name. Unknown models
+// resolve to the default model, or fail in strict mode.
+func (r *ModelRouter) Resolve(model string, models map[string]ModelCacheEntry) (ModelCacheEntry, bool) {
+	name := r.route(model)
+	if entry, ok := models[name]; ok {
+		return entry, true
+	}
+	// Clients are not always careful with case
+	for _, id := range slices.Sorted(maps.Keys(models)) {
+		if strings.EqualFold(id, name) {
+			return models[id], true
+		}
+	}
+
+	if r == nil {
+		return ModelCacheEntry{Provider: DefaultProvider, Model: DefaultModel}, true
+	}
+	if r.strict {
+		return ModelCacheEntry{}, false
+	}
+	slog.Warn("Unknown model, using the default model", "model", model, "default", r.defaultModel.Model)
+	return r.defaultModel, true
+}
+
+// Aliases returns the aliases with the model each one points to
+func (r *ModelRouter) Aliases() map[string]string {
+	if r == nil {
+		return nil
+	}
+	return r.aliases
+}
+
+// modelNotFoundError is the OpenAI error for an unknown model
+func modelNotFoundError(model string) *relayError {
+	return &relayError{
+		Status:  http.StatusNotFound,
+		Message: fmt.Sprintf("The model `%s` does not exist or you do not have access to it.", model),
+		Type:    "invalid_request_error",
+		Code:    "model_not_found",
+	}
+}
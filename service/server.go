@@ -0,0 +1,161 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 21:52:30
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 21:52:30
+ * @FilePath: /raycast2api/service/server.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Drain tracks the graceful shutdown of the relay: whether it is draining,
+// whether it still accepts requests and how many are still in flight
+type Drain struct {
+	draining atomic.Bool
+	refusing atomic.Bool
+	inFlight atomic.Int64
+}
+
+// Start marks the relay as draining, the health probes fail from now on so
+// that load balancers stop sending requests
+func (d *Drain) Start() {
+	if d != nil {
+		d.draining.Store(true)
+	}
+}
+
+// Draining reports whether the relay is shutting down
+func (d *Drain) Draining() bool {
+	return d != nil && d.draining.Load()
+}
+
+// Refuse turns new requests away, once load balancers had time to notice
+// the shutdown
+func (d *Drain) Refuse() {
+	if d != nil {
+		d.refusing.Store(true)
+	}
+}
+
+// Refusing reports whether new requests are turned away
+func (d *Drain) Refusing() bool {
+	return d != nil && d.refusing.Load()
+}
+
+// InFlight returns the number of requests being served
+func (d *Drain) InFlight() int64 {
+	if d == nil {
+		return 0
+	}
+	return d.inFlight.Load()
+}
+
+// begin and end count a request in flight
+func (d *Drain) begin() {
+	if d != nil {
+		d.inFlight.Add(1)
+	}
+}
+
+func (d *Drain) end() {
+	if d != nil {
+		d.inFlight.Add(-1)
+	}
+}
+
+// Serve runs the relay until SIGINT or SIGTERM, then shuts down gracefully.
+// /health and /ready report the shutdown right away, but requests are still
+// served for ShutdownDelay, so that load balancers can stop routing to the
+// relay. Then new requests are refused, while requests in flight, streams
+// included, get ShutdownTimeout to finish. Requests still running after that
+// are cancelled, which cancels their upstream requests.
+func Serve(store *ConfigStore) error {
+	// Cancelling the base context cancels every request and its upstream request
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	server := &http.Server{
+		Addr:        ":" + store.Get().Port,
+		Handler:     Router(store),
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
+	}
+
+	// Reload the configuration on SIGHUP and config file changes
+	go store.Watch(baseCtx)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	var sig os.Signal
+	select {
+	case err := <-serveErr:
+		return err
+	case sig = <-stop:
+	}
+
+	config := store.Get()
+	config.Drain.Start()
+	if config.ShutdownDelay > 0 {
+		slog.Info("Shutting down, failing health probes before draining",
+			"signal", sig.String(),
+			"delay", config.ShutdownDelay,
+		)
+		// A second signal skips the delay
+		select {
+		case <-time.After(config.ShutdownDelay):
+		case <-stop:
+		}
+	}
+
+	config.Drain.Refuse()
+	slog.Info("Shutting down, draining in-flight requests",
+		"signal", sig.String(),
+		"in_flight", config.Drain.InFlight(),
+		"timeout", config.ShutdownTimeout,
+	)
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.Warn("Shutdown timeout reached, cancelling the remaining requests", "in_flight", config.Drain.InFlight())
+		cancelRequests()
+
+		// Let the cancelled requests record their usage before closing
+		deadline := time.Now().Add(ShutdownCancelGrace)
+		for config.Drain.InFlight() > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		err = server.Close()
+	}
+
+	// Close the kept-alive connections to Raycast
+	http.DefaultClient.CloseIdleConnections()
+
+	slog.Info("Shutdown complete", "duration", time.Since(start).Round(time.Millisecond))
+	return err
+}
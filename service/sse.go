@@ -0,0 +1,217 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 22:41:12
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 22:41:12
+ * @FilePath: /raycast2api/service/sse.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// maxSSELineSize bounds a single line of the Raycast stream
+const maxSSELineSize = 4 << 20
+
+// sseEvent is a server-sent event
+type sseEvent struct {
+	Event string // Event type, empty for the default message type
+	Data  string // Data lines joined with \n
+	ID    string
+}
+
+// sseDecoder decodes a server-sent event stream incrementally, following the
+// WHATWG event stream format: lines end with LF, CRLF or CR, multiple data
+// lines form one event, comments and unknown fields are ignored, and a blank
+// line dispatches the event.
+type sseDecoder struct {
+	scanner *bufio.Scanner
+	lastID  string
+}
+
+// newSSEDecoder creates a decoder reading the stream from r
+func newSSEDecoder(r io.Reader) *sseDecoder {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxSSELineSize)
+	scanner.Split(scanSSELines)
+	return &sseDecoder{scanner: scanner}
+}
+
+// scanSSELines is a bufio.SplitFunc splitting on LF, CRLF or CR
+func scanSSELines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		if data[i] == '\n' {
+			return i + 1, data[:i], nil
+		}
+		// A CR may be followed by the LF of a CRLF in the next read
+		if i+1 == len(data) && !atEOF {
+			return 0, nil, nil
+		}
+		if i+1 < len(data) && data[i+1] == '\n' {
+			return i + 2, data[:i], nil
+		}
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// Next returns the next event with data. At the end of the stream it returns
+// io.EOF; an event cut short by the end of the stream is still returned, as a
+// truncated Raycast stream should not lose its last chunk.
+func (d *sseDecoder) Next() (sseEvent, error) {
+	var event sseEvent
+	var data strings.Builder
+	hasData := false
+
+	// dispatch returns the event being built, or false when it has no data
+	dispatch := func() (sseEvent, bool) {
+		event.ID = d.lastID
+		event.Data = data.String()
+		ok := hasData
+		hasData = false
+		data.Reset()
+		return event, ok
+	}
+
+	for d.scanner.Scan() {
+		line := d.scanner.Text()
+		if line == "" {
+			if dispatched, ok := dispatch(); ok {
+				return dispatched, nil
+			}
+			event = sseEvent{}
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue // Comment
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "data":
+			if hasData {
+				data.WriteByte('\n')
+			}
+			data.WriteString(value)
+			hasData = true
+		case "event":
+			event.Event = value
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				d.lastID = value
+			}
+		}
+	}
+	if err := d.scanner.Err(); err != nil {
+		return sseEvent{}, err
+	}
+
+	if dispatched, ok := dispatch(); ok {
+		return dispatched, nil
+	}
+	return sseEvent{}, io.EOF
+}
+
+// decodeRaycastData decodes the data of a Raycast event. Payloads that do not
+// fit RaycastSSEData still have their text picked from the usual fields.
+func decodeRaycastData(data string) (RaycastSSEData, bool) {
+	var jsonData RaycastSSEData
+	err := json.Unmarshal([]byte(data), &jsonData)
+	if err == nil {
+		return jsonData, true
+	}
+
+	var genericData map[string]interface{}
+	if jsonErr := json.Unmarshal([]byte(data), &genericData); jsonErr != nil {
+		slog.Warn("Failed to parse SSE data", "error", jsonErr)
+		return RaycastSSEData{}, false
+	}
+	slog.Debug("Failed to parse SSE data as RaycastSSEData", "error", err)
+	if text := extractTextFromJSON(genericData); text != "" {
+		return RaycastSSEData{Text: text}, true
+	}
+	slog.Debug("SSE data has no text or content field", contentAttr("data", data))
+	return RaycastSSEData{}, false
+}
+
+// readRaycastEvents reads the Raycast SSE stream and calls handle for every
+// data event until the stream ends or handle returns false
+func readRaycastEvents(body io.Reader, handle func(RaycastSSEData) bool) error {
+	decoder := newSSEDecoder(body)
+	for {
+		event, err := decoder.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if event.Event != "" && event.Event != "message" {
+			slog.Debug("Skipping SSE event", "event", event.Event, contentAttr("data", event.Data))
+			continue
+		}
+		if strings.TrimSpace(event.Data) == "[DONE]" {
+			continue
+		}
+		jsonData, ok := decodeRaycastData(event.Data)
+		if !ok {
+			continue
+		}
+		if !handle(jsonData) {
+			return nil
+		}
+	}
+}
+
+// parseSSEResponse parses SSE response from Raycast into a single text
+func parseSSEResponse(responseText string) raycastReply {
+	var reply raycastReply
+
+	slog.Debug("Parsing Raycast SSE response", "bytes", len(responseText))
+
+	// If the response is empty, return early
+	if strings.TrimSpace(responseText) == "" {
+		slog.Warn("Empty response received from Raycast")
+		return reply
+	}
+
+	var fullText strings.Builder
+	events := 0
+	err := readRaycastEvents(strings.NewReader(responseText), func(jsonData RaycastSSEData) bool {
+		events++
+		if jsonData.FinishReason != "" {
+			reply.FinishReason = jsonData.FinishReason
+		}
+		if jsonData.Usage != nil {
+			reply.Usage = jsonData.Usage
+		}
+		fullText.WriteString(jsonData.Text)
+		return true
+	})
+	if err != nil {
+		slog.Warn("Failed to read Raycast SSE response", "error", err)
+	}
+
+	slog.Debug("Parsed Raycast SSE response", "events", events, "text_bytes", fullText.Len())
+	reply.Text = fullText.String()
+	return reply
+}
@@ -0,0 +1,180 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-17 09:12:30
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-17 09:12:30
+ * @FilePath: /raycast2api/service/sse_test.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// decodeAll decodes every event of a stream
+func decodeAll(r io.Reader) ([]sseEvent, error) {
+	decoder := newSSEDecoder(r)
+	var events []sseEvent
+	for {
+		event, err := decoder.Next()
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return events, err
+		}
+		events = append(events, event)
+	}
+}
+
+// renderGolden describes how a captured stream is decoded: the raw events,
+// then the Raycast data read from them and the aggregated reply
+func renderGolden(t *testing.T, stream []byte) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	writeLine := func(prefix string, value interface{}) {
+		data, err := json.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(&out, "%s %s\n", prefix, data)
+	}
+
+	events, err := decodeAll(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatalf("decoding: %v", err)
+	}
+	for _, event := range events {
+		writeLine("event", event)
+	}
+
+	err = readRaycastEvents(bytes.NewReader(stream), func(data RaycastSSEData) bool {
+		writeLine("raycast", data)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("reading Raycast events: %v", err)
+	}
+	writeLine("reply", parseSSEResponse(string(stream)))
+	return out.Bytes()
+}
+
+func TestSSEDecoderGolden(t *testing.T) {
+	streams, err := filepath.Glob(filepath.Join("testdata", "sse", "*.sse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) == 0 {
+		t.Fatal("no captured streams in testdata/sse")
+	}
+
+	for _, path := range streams {
+		name := strings.TrimSuffix(filepath.Base(path), ".sse")
+		t.Run(name, func(t *testing.T) {
+			stream, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := renderGolden(t, stream)
+
+			goldenPath := strings.TrimSuffix(path, ".sse") + ".golden"
+			if *updateGolden {
+				if err := os.WriteFile(goldenPath, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatalf("missing golden file, run go test -update: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("decoded stream differs from %s\ngot:\n%s\nwant:\n%s", goldenPath, got, want)
+			}
+
+			// Reading the stream byte by byte must not change the result,
+			// as CRLF pairs and lines are then split across reads
+			events, err := decodeAll(iotest.OneByteReader(bytes.NewReader(stream)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			whole, _ := decodeAll(bytes.NewReader(stream))
+			if !reflect.DeepEqual(events, whole) {
+				t.Errorf("byte by byte decoding differs\ngot:  %+v\nwant: %+v", events, whole)
+			}
+		})
+	}
+}
+
+// encodeEvents writes events back into an event stream
+func encodeEvents(events []sseEvent) string {
+	var sb strings.Builder
+	for _, event := range events {
+		if event.Event != "" {
+			sb.WriteString("event: " + event.Event + "\n")
+		}
+		sb.WriteString("id: " + event.ID + "\n")
+		for _, line := range strings.Split(event.Data, "\n") {
+			sb.WriteString("data: " + line + "\n")
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func FuzzSSEDecoder(f *testing.F) {
+	streams, _ := filepath.Glob(filepath.Join("testdata", "sse", "*.sse"))
+	for _, path := range streams {
+		if stream, err := os.ReadFile(path); err == nil {
+			f.Add(stream)
+		}
+	}
+	f.Add([]byte("data:\r\n\r\rdata: x\r"))
+	f.Add([]byte(":\n\nid: a\x00b\nevent:\ndata"))
+
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		events, err := decodeAll(bytes.NewReader(stream))
+		if err != nil {
+			t.Skip() // Lines over maxSSELineSize
+		}
+
+		// Splitting the reads must not change the events
+		split, err := decodeAll(iotest.OneByteReader(bytes.NewReader(stream)))
+		if err != nil {
+			t.Fatalf("byte by byte decoding failed: %v", err)
+		}
+		if !reflect.DeepEqual(split, events) {
+			t.Fatalf("byte by byte decoding differs\ngot:  %+v\nwant: %+v", split, events)
+		}
+
+		// Decoded events survive a round trip through the encoder
+		roundTrip, err := decodeAll(strings.NewReader(encodeEvents(events)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(roundTrip, events) {
+			t.Fatalf("round trip differs\ngot:  %+v\nwant: %+v", roundTrip, events)
+		}
+
+		// Reading Raycast events never fails on a well-sized stream
+		if err := readRaycastEvents(bytes.NewReader(stream), func(RaycastSSEData) bool { return true }); err != nil {
+			t.Fatalf("reading Raycast events: %v", err)
+		}
+	})
+}
@@ -0,0 +1,173 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 16:02:37
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 16:02:37
+ * @FilePath: /raycast2api/service/tokenizer.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Raycast does not report usage, so token counts are computed locally. The
+// tokenizer follows the pre-tokenization of the BPE tokenizers (words,
+// digit groups, punctuation, CJK characters) and then applies the average
+// characters per token of each model family's vocabulary.
+
+// tokenizerFamily describes the vocabulary of a model family
+type tokenizerFamily struct {
+	Name          string
+	CharsPerToken float64 // Average Latin characters per token inside a word
+	DigitGroup    int     // Digits merged into a single token
+	CJKPerToken   float64 // Average CJK characters per token
+	MessageTokens int     // Formatting overhead per message
+	ReplyTokens   int     // Overhead priming the assistant reply
+}
+
+var (
+	tokenizerO200K         = tokenizerFamily{Name: "o200k", CharsPerToken: 4.2, DigitGroup: 3, CJKPerToken: 1.2, MessageTokens: 3, ReplyTokens: 3}
+	tokenizerCL100K        = tokenizerFamily{Name: "cl100k", CharsPerToken: 4.0, DigitGroup: 3, CJKPerToken: 0.8, MessageTokens: 3, ReplyTokens: 3}
+	tokenizerClaude        = tokenizerFamily{Name: "claude", CharsPerToken: 3.5, DigitGroup: 1, CJKPerToken: 0.9, MessageTokens: 4, ReplyTokens: 3}
+	tokenizerGemini        = tokenizerFamily{Name: "gemini", CharsPerToken: 4.2, DigitGroup: 1, CJKPerToken: 1.3, MessageTokens: 4, ReplyTokens: 2}
+	tokenizerLlama         = tokenizerFamily{Name: "llama", CharsPerToken: 4.0, DigitGroup: 3, CJKPerToken: 0.9, MessageTokens: 4, ReplyTokens: 4}
+	tokenizerSentencePiece = tokenizerFamily{Name: "sentencepiece", CharsPerToken: 3.6, DigitGroup: 1, CJKPerToken: 0.8, MessageTokens: 4, ReplyTokens: 2}
+)
+
+// tokenizerForModel picks the tokenizer family of a model
+func tokenizerForModel(provider, model string) tokenizerFamily {
+	model = strings.ToLower(model)
+	switch {
+	case strings.HasPrefix(model, "gpt-4o"), strings.HasPrefix(model, "gpt-4.1"),
+		strings.HasPrefix(model, "o1"), strings.HasPrefix(model, "o3"), strings.HasPrefix(model, "o4"):
+		return tokenizerO200K
+	case strings.HasPrefix(model, "gpt-"):
+		return tokenizerCL100K
+	case strings.Contains(model, "claude"):
+		return tokenizerClaude
+	case strings.HasPrefix(model, "gemini"):
+		return tokenizerGemini
+	case strings.Contains(model, "llama"), strings.Contains(model, "deepseek"), strings.Contains(model, "qwen"):
+		return tokenizerLlama
+	case strings.Contains(model, "mistral"), strings.Contains(model, "codestral"), strings.Contains(model, "pixtral"):
+		return tokenizerSentencePiece
+	}
+
+	switch provider {
+	case "anthropic":
+		return tokenizerClaude
+	case "google":
+		return tokenizerGemini
+	case "groq", "together":
+		return tokenizerLlama
+	case "mistral":
+		return tokenizerSentencePiece
+	}
+	return tokenizerO200K
+}
+
+// countTokens counts the tokens of a text
+func (t tokenizerFamily) countTokens(text string) int {
+	tokens := 0.0
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		switch {
+		case unicode.IsLetter(r) && !isCJK(r):
+			// A word, with its leading space merged in as BPE vocabularies do
+			start := i
+			for i < len(text) {
+				r, size = utf8.DecodeRuneInString(text[i:])
+				if !unicode.IsLetter(r) || isCJK(r) {
+					break
+				}
+				i += size
+			}
+			tokens += math.Ceil(float64(utf8.RuneCountInString(text[start:i])) / t.CharsPerToken)
+		case unicode.IsDigit(r):
+			digits := 0
+			for i < len(text) {
+				r, size = utf8.DecodeRuneInString(text[i:])
+				if !unicode.IsDigit(r) {
+					break
+				}
+				digits++
+				i += size
+			}
+			tokens += math.Ceil(float64(digits) / float64(t.DigitGroup))
+		case isCJK(r):
+			chars := 0
+			for i < len(text) {
+				r, size = utf8.DecodeRuneInString(text[i:])
+				if !isCJK(r) {
+					break
+				}
+				chars++
+				i += size
+			}
+			tokens += math.Ceil(float64(chars) / t.CJKPerToken)
+		case unicode.IsSpace(r):
+			// Single spaces merge into the next word, runs of whitespace and
+			// newlines take a token of their own
+			start := i
+			for i < len(text) {
+				r, size = utf8.DecodeRuneInString(text[i:])
+				if !unicode.IsSpace(r) {
+					break
+				}
+				i += size
+			}
+			if i-start > 1 || text[start] != ' ' {
+				tokens++
+			}
+		default:
+			// Punctuation and symbols, repeated runs merge into one token
+			i += size
+			for i < len(text) && strings.HasPrefix(text[i:], string(r)) {
+				i += size
+			}
+			tokens++
+		}
+	}
+	return int(tokens)
+}
+
+// countPromptTokens counts the prompt tokens of a Raycast request
+func countPromptTokens(request RaycastChatRequest) int {
+	t := tokenizerForModel(request.Provider, request.Model)
+
+	tokens := t.ReplyTokens
+	for _, instruction := range []string{request.SystemInstruction, request.AdditionalSystemInstructions} {
+		if instruction != "" {
+			tokens += t.MessageTokens + t.countTokens(instruction)
+		}
+	}
+	for _, msg := range request.Messages {
+		tokens += t.MessageTokens + t.countTokens(msg.Content.Text)
+		// Images are billed by size upstream; use the common flat estimate
+		tokens += len(msg.Content.Attachments) * imageTokens
+	}
+	return tokens
+}
+
+// countCompletionTokens counts the tokens of a generated reply
+func countCompletionTokens(request RaycastChatRequest, text string) int {
+	return tokenizerForModel(request.Provider, request.Model).countTokens(text)
+}
+
+// imageTokens is the estimated prompt cost of an image attachment
+const imageTokens = 765
+
+// isCJK reports whether a rune is a Chinese, Japanese or Korean character
+func isCJK(r rune) bool {
+	return unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) ||
+		unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r)
+}
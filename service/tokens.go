@@ -0,0 +1,308 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 13:05:47
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 13:05:47
+ * @FilePath: /raycast2api/service/tokens.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TokenPool holds the Raycast bearer tokens and tracks their health
+type TokenPool struct {
+	tokens    []*tokenState
+	nextID    int // Number of the next token added to the pool
+	lastError *UpstreamError
+	mutex     sync.Mutex
+}
+
+// UpstreamError is the last failure seen from Raycast, with any token
+type UpstreamError struct {
+	Token  string    `json:"token"` // Token id
+	Status int       `json:"status,omitempty"`
+	Error  string    `json:"error"`
+	Time   time.Time `json:"time"`
+}
+
+// tokenState tracks usage and health of a single bearer token
+type tokenState struct {
+	id            string
+	value         string
+	lastUsed      time.Time
+	cooldownUntil time.Time
+	lastStatus    int
+	lastError     string
+	requests      int64
+	failures      int64
+}
+
+// raycastToken is a bearer token handed out by the pool
+type raycastToken struct {
+	ID    string
+	Value string
+}
+
+// TokenStatus describes the state of a token for the admin API
+type TokenStatus struct {
+	ID            string     `json:"id"`
+	Token         string     `json:"token"` // Masked token value
+	Available     bool       `json:"available"`
+	CooldownUntil *time.Time `json:"cooldown_until,omitempty"`
+	LastUsed      *time.Time `json:"last_used,omitempty"`
+	LastStatus    int        `json:"last_status,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	Requests      int64      `json:"requests"`
+	Failures      int64      `json:"failures"`
+}
+
+// NewTokenPool creates a token pool from the given bearer tokens
+func NewTokenPool(tokens []string) *TokenPool {
+	pool := &TokenPool{}
+	pool.SetTokens(tokens)
+	return pool
+}
+
+// SetTokens replaces the tokens of the pool. Tokens that stay in the pool
+// keep their id, health and statistics.
+func (p *TokenPool) SetTokens(tokens []string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	existing := make(map[string]*tokenState)
+	for _, token := range p.tokens {
+		existing[token.value] = token
+	}
+
+	p.tokens = make([]*tokenState, 0, len(tokens))
+	for _, value := range tokens {
+		token, ok := existing[value]
+		if !ok {
+			p.nextID++
+			token = &tokenState{id: fmt.Sprintf("token-%d", p.nextID), value: value}
+		}
+		p.tokens = append(p.tokens, token)
+	}
+}
+
+// loadBearerTokens reads bearer tokens from a comma separated list and an
+// optional file with one token per line
+func loadBearerTokens(list, file string) ([]string, error) {
+	seen := make(map[string]bool)
+	var tokens []string
+	add := func(token string) {
+		token = strings.TrimSpace(token)
+		if token == "" || strings.HasPrefix(token, "#") || seen[token] {
+			return
+		}
+		seen[token] = true
+		tokens = append(tokens, token)
+	}
+
+	for _, token := range strings.Split(list, ",") {
+		add(token)
+	}
+
+	if file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, fmt.Errorf("error opening token file: %w", err)
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			add(scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("error reading token file: %w", err)
+		}
+	}
+
+	return tokens, nil
+}
+
+// Size returns the number of tokens in the pool
+func (p *TokenPool) Size() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.tokens)
+}
+
+// Acquire picks the least recently used token that is not cooling down. If
+// every token is cooling down, the one that recovers first is returned.
+func (p *TokenPool) Acquire() raycastToken {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if len(p.tokens) == 0 {
+		return raycastToken{}
+	}
+
+	now := time.Now()
+	var best *tokenState
+	for _, token := range p.tokens {
+		if now.Before(token.cooldownUntil) {
+			continue
+		}
+		if best == nil || token.lastUsed.Before(best.lastUsed) {
+			best = token
+		}
+	}
+
+	if best == nil {
+		for _, token := range p.tokens {
+			if best == nil || token.cooldownUntil.Before(best.cooldownUntil) {
+				best = token
+			}
+		}
+		slog.Warn("All Raycast tokens are cooling down", "token", best.id)
+	}
+
+	best.lastUsed = now
+	best.requests++
+	return raycastToken{ID: best.id, Value: best.value}
+}
+
+// Report records the upstream result of a request made with a token and puts
+// the token into cooldown when Raycast rejected or rate limited it
+func (p *TokenPool) Report(id string, resp *http.Response, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var token *tokenState
+	for _, t := range p.tokens {
+		if t.id == id {
+			token = t
+			break
+		}
+	}
+	if token == nil {
+		return
+	}
+
+	if err != nil {
+		token.failures++
+		token.lastError = err.Error()
+		p.lastError = &UpstreamError{Token: token.id, Error: err.Error(), Time: time.Now()}
+		return
+	}
+
+	token.lastStatus = resp.StatusCode
+	if resp.StatusCode >= 400 {
+		p.lastError = &UpstreamError{Token: token.id, Status: resp.StatusCode, Error: http.StatusText(resp.StatusCode), Time: time.Now()}
+	}
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		token.failures++
+		token.lastError = "unauthorized"
+		token.cooldownUntil = time.Now().Add(TokenUnauthorizedCooldown)
+		slog.Warn("Raycast token was rejected", "token", token.id, "cooldown_until", token.cooldownUntil)
+	case http.StatusTooManyRequests:
+		token.failures++
+		token.lastError = "rate limited"
+		cooldown := TokenRateLimitCooldown
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			cooldown = time.Duration(seconds) * time.Second
+		}
+		token.cooldownUntil = time.Now().Add(cooldown)
+		slog.Warn("Raycast token was rate limited", "token", token.id, "cooldown_until", token.cooldownUntil)
+	default:
+		if resp.StatusCode < http.StatusInternalServerError {
+			token.lastError = ""
+			token.cooldownUntil = time.Time{}
+		}
+	}
+}
+
+// Status returns the state of every token in the pool
+func (p *TokenPool) Status() []TokenStatus {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	statuses := make([]TokenStatus, 0, len(p.tokens))
+	for _, token := range p.tokens {
+		status := TokenStatus{
+			ID:         token.id,
+			Token:      maskToken(token.value),
+			Available:  !now.Before(token.cooldownUntil),
+			LastStatus: token.lastStatus,
+			LastError:  token.lastError,
+			Requests:   token.requests,
+			Failures:   token.failures,
+		}
+		if !status.Available {
+			cooldownUntil := token.cooldownUntil
+			status.CooldownUntil = &cooldownUntil
+		}
+		if !token.lastUsed.IsZero() {
+			lastUsed := token.lastUsed
+			status.LastUsed = &lastUsed
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// TokenPoolSummary counts the tokens of the pool by availability
+type TokenPoolSummary struct {
+	Total           int        `json:"total"`
+	Available       int        `json:"available"`
+	CoolingDown     int        `json:"cooling_down"`
+	NextAvailableAt *time.Time `json:"next_available_at,omitempty"` // When every token is cooling down
+}
+
+// Summary counts the available tokens
+func (p *TokenPool) Summary() TokenPoolSummary {
+	summary := TokenPoolSummary{}
+	for _, status := range p.Status() {
+		summary.Total++
+		if status.Available {
+			summary.Available++
+			continue
+		}
+		summary.CoolingDown++
+		if summary.NextAvailableAt == nil || status.CooldownUntil.Before(*summary.NextAvailableAt) {
+			summary.NextAvailableAt = status.CooldownUntil
+		}
+	}
+	if summary.Available > 0 {
+		summary.NextAvailableAt = nil
+	}
+	return summary
+}
+
+// LastError returns the last failure seen from Raycast, nil if there was none
+func (p *TokenPool) LastError() *UpstreamError {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.lastError == nil {
+		return nil
+	}
+	lastError := *p.lastError
+	return &lastError
+}
+
+// maskToken hides all but the edges of a secret
+func maskToken(token string) string {
+	if len(token) <= 8 {
+		return strings.Repeat("*", len(token))
+	}
+	return token[:4] + "..." + token[len(token)-4:]
+}
@@ -0,0 +1,298 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 10:12:40
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 10:12:40
+ * @FilePath: /raycast2api/service/tools.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Raycast has no client side function calling, so tools are described in the
+// system instructions and the model is asked to answer with tagged JSON blocks.
+const (
+	toolCallOpenTag    = "<tool_call>"
+	toolCallCloseTag   = "</tool_call>"
+	toolResultOpenTag  = "<tool_result"
+	toolResultCloseTag = "</tool_result>"
+)
+
+// toolCallPayload is the JSON object the model writes inside a tool call block
+type toolCallPayload struct {
+	ID        string          `json:"id,omitempty"`
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// toolsEnabled reports whether tool instructions should be sent upstream
+func toolsEnabled(tools []OpenAITool, toolChoice interface{}) bool {
+	if len(tools) == 0 {
+		return false
+	}
+	if choice, ok := toolChoice.(string); ok && choice == "none" {
+		return false
+	}
+	return true
+}
+
+// buildToolInstructions renders the tool definitions into system instructions
+func buildToolInstructions(tools []OpenAITool, toolChoice interface{}) string {
+	if !toolsEnabled(tools, toolChoice) {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteString("You have access to the following tools. ")
+	sb.WriteString("To call a tool, reply with one block per call in exactly this format:\n")
+	sb.WriteString(toolCallOpenTag + `{"name": "<tool name>", "arguments": {<JSON arguments>}}` + toolCallCloseTag + "\n")
+	sb.WriteString("You may call several tools at once. Do not invent tool results; ")
+	sb.WriteString("they will be sent back to you in " + toolResultOpenTag + "> blocks.\n\n")
+	sb.WriteString("Available tools:\n")
+	for _, tool := range tools {
+		if tool.Type != "" && tool.Type != "function" {
+			continue
+		}
+		sb.WriteString("- " + tool.Function.Name)
+		if tool.Function.Description != "" {
+			sb.WriteString(": " + tool.Function.Description)
+		}
+		sb.WriteString("\n")
+		if tool.Function.Parameters != nil {
+			if schema, err := json.Marshal(tool.Function.Parameters); err == nil {
+				sb.WriteString("  Parameters (JSON schema): " + string(schema) + "\n")
+			}
+		}
+	}
+
+	switch choice := toolChoice.(type) {
+	case string:
+		if choice == "required" {
+			sb.WriteString("\nYou must call at least one tool in your reply.\n")
+		}
+	case map[string]interface{}:
+		if function, ok := choice["function"].(map[string]interface{}); ok {
+			if name, ok := function["name"].(string); ok && name != "" {
+				sb.WriteString(fmt.Sprintf("\nYou must call the tool %q in your reply.\n", name))
+			}
+		}
+	}
+
+	return sb.String()
+}
+
+// renderToolCalls renders assistant tool calls back into the tagged format
+func renderToolCalls(calls []OpenAIToolCall) string {
+	var sb strings.Builder
+	for _, call := range calls {
+		arguments := json.RawMessage(call.Function.Arguments)
+		if !json.Valid(arguments) {
+			arguments, _ = json.Marshal(call.Function.Arguments)
+		}
+		payload, err := json.Marshal(toolCallPayload{
+			ID:        call.ID,
+			Name:      call.Function.Name,
+			Arguments: arguments,
+		})
+		if err != nil {
+			continue
+		}
+		sb.WriteString(toolCallOpenTag + string(payload) + toolCallCloseTag + "\n")
+	}
+	return sb.String()
+}
+
+// renderToolResult renders a "tool" role message as a tagged result block
+func renderToolResult(toolCallID, name, content string) string {
+	attrs := fmt.Sprintf(" tool_call_id=%q", toolCallID)
+	if name != "" {
+		attrs += fmt.Sprintf(" name=%q", name)
+	}
+	return toolResultOpenTag + attrs + ">\n" + content + "\n" + toolResultCloseTag
+}
+
+// newToolCallID generates an OpenAI style tool call ID
+func newToolCallID() string {
+	return "call_" + strings.ReplaceAll(uuid.New().String(), "-", "")[:24]
+}
+
+// parseToolCall decodes the body of a single tool call block
+func parseToolCall(body string) (OpenAIToolCall, bool) {
+	var payload toolCallPayload
+	if err := json.Unmarshal([]byte(strings.TrimSpace(body)), &payload); err != nil || payload.Name == "" {
+		return OpenAIToolCall{}, false
+	}
+
+	arguments := "{}"
+	if len(payload.Arguments) > 0 {
+		// Arguments may come back as an object or as an already encoded string
+		var encoded string
+		if err := json.Unmarshal(payload.Arguments, &encoded); err == nil {
+			arguments = encoded
+		} else {
+			var compact bytes.Buffer
+			if err := json.Compact(&compact, payload.Arguments); err == nil {
+				arguments = compact.String()
+			}
+		}
+	}
+
+	call := OpenAIToolCall{ID: newToolCallID(), Type: "function"}
+	call.Function.Name = payload.Name
+	call.Function.Arguments = arguments
+	return call, true
+}
+
+// extractToolCalls splits model output into plain text and tool calls
+func extractToolCalls(text string) (string, []OpenAIToolCall) {
+	var content strings.Builder
+	var calls []OpenAIToolCall
+
+	rest := text
+	for {
+		start := strings.Index(rest, toolCallOpenTag)
+		if start < 0 {
+			content.WriteString(rest)
+			break
+		}
+		end := strings.Index(rest[start:], toolCallCloseTag)
+		if end < 0 {
+			content.WriteString(rest)
+			break
+		}
+		end += start
+
+		body := rest[start+len(toolCallOpenTag) : end]
+		if call, ok := parseToolCall(body); ok {
+			content.WriteString(rest[:start])
+			calls = append(calls, call)
+		} else {
+			// Keep malformed blocks as text so nothing is silently lost
+			content.WriteString(rest[:end+len(toolCallCloseTag)])
+		}
+		rest = rest[end+len(toolCallCloseTag):]
+	}
+
+	if len(calls) == 0 {
+		return text, nil
+	}
+	return strings.TrimSpace(content.String()), calls
+}
+
+// toolCallStreamParser incrementally separates text from tool call blocks
+// in a streamed reply, holding back anything that may be the start of a tag.
+type toolCallStreamParser struct {
+	buffer string
+	calls  int
+}
+
+// Feed consumes a text delta and returns the text that is safe to emit along
+// with any tool calls that were completed by this delta.
+func (p *toolCallStreamParser) Feed(delta string) (string, []OpenAIToolCall) {
+	p.buffer += delta
+
+	var text strings.Builder
+	var calls []OpenAIToolCall
+	for {
+		start := strings.Index(p.buffer, toolCallOpenTag)
+		if start < 0 {
+			// Emit everything except a possible partial opening tag
+			keep := partialTagSuffix(p.buffer, toolCallOpenTag)
+			text.WriteString(p.buffer[:len(p.buffer)-keep])
+			p.buffer = p.buffer[len(p.buffer)-keep:]
+			break
+		}
+
+		text.WriteString(p.buffer[:start])
+		p.buffer = p.buffer[start:]
+
+		end := strings.Index(p.buffer, toolCallCloseTag)
+		if end < 0 {
+			break // Wait for the rest of the block
+		}
+
+		body := p.buffer[len(toolCallOpenTag):end]
+		if call, ok := parseToolCall(body); ok {
+			index := p.calls
+			call.Index = &index
+			p.calls++
+			calls = append(calls, call)
+		} else {
+			text.WriteString(p.buffer[:end+len(toolCallCloseTag)])
+		}
+		p.buffer = p.buffer[end+len(toolCallCloseTag):]
+	}
+
+	return text.String(), calls
+}
+
+// Flush returns any text still held back once the stream has ended
+func (p *toolCallStreamParser) Flush() string {
+	rest := p.buffer
+	p.buffer = ""
+	return rest
+}
+
+// HasToolCalls reports whether any tool call has been emitted
+func (p *toolCallStreamParser) HasToolCalls() bool {
+	return p.calls > 0
+}
+
+// partialTagSuffix returns the length of the longest suffix of s that is a
+// prefix of tag
+func partialTagSuffix(s, tag string) int {
+	max := len(tag) - 1
+	if len(s) < max {
+		max = len(s)
+	}
+	for n := max; n > 0; n-- {
+		if strings.HasSuffix(s, tag[:n]) {
+			return n
+		}
+	}
+	return 0
+}
+
+// pendingToolCalls pairs tool results with the calls they answer, for APIs
+// whose calls and results may carry no ID, such as Gemini and Ollama. Calls
+// without an ID get one, and a result without an ID answers the oldest
+// unanswered call of its function.
+type pendingToolCalls struct {
+	calls []OpenAIToolCall
+}
+
+// add records a call, giving it an ID if it has none
+func (p *pendingToolCalls) add(call *OpenAIToolCall) {
+	if call.ID == "" {
+		call.ID = newToolCallID()
+	}
+	p.calls = append(p.calls, *call)
+}
+
+// answer returns the ID and function name of the call a result answers. A
+// result without a name answers the oldest unanswered call of any function.
+func (p *pendingToolCalls) answer(id, name string) (string, string) {
+	for i, call := range p.calls {
+		if (id != "" && call.ID != id) || (id == "" && name != "" && call.Function.Name != name) {
+			continue
+		}
+		p.calls = append(p.calls[:i], p.calls[i+1:]...)
+		if name == "" {
+			name = call.Function.Name
+		}
+		return call.ID, name
+	}
+	return id, name
+}
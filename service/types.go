@@ -14,20 +14,61 @@ package service
 
 import (
 	"encoding/json"
+	"time"
 )
 
 // OpenAIMessage represents a message in OpenAI format
 type OpenAIMessage struct {
-	Role    string      `json:"role"`    // "user", "assistant", or "system"
-	Content interface{} `json:"content"` // Can be string or array
+	Role       string           `json:"role"`                   // "user", "assistant", "system", "developer" or "tool"
+	Content    interface{}      `json:"content"`                // Can be string or array
+	Name       string           `json:"name,omitempty"`         // Optional participant or function name
+	ToolCalls  []OpenAIToolCall `json:"tool_calls,omitempty"`   // Tool calls made by the assistant
+	ToolCallID string           `json:"tool_call_id,omitempty"` // Tool call answered by a "tool" message
+}
+
+// OpenAITool represents a tool definition in OpenAI format
+type OpenAITool struct {
+	Type     string             `json:"type"` // Only "function" is supported
+	Function OpenAIToolFunction `json:"function"`
+}
+
+// OpenAIToolFunction describes a function the model may call
+type OpenAIToolFunction struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Parameters  interface{} `json:"parameters,omitempty"` // JSON schema of the arguments
+}
+
+// OpenAIToolCall represents a tool call emitted by the assistant
+type OpenAIToolCall struct {
+	Index    *int   `json:"index,omitempty"` // Only set in streaming deltas
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments"` // JSON encoded arguments
+	} `json:"function"`
 }
 
 // RaycastMessage represents a message in Raycast format
 type RaycastMessage struct {
-	Author  string `json:"author"` // "user" or "assistant"
-	Content struct {
-		Text string `json:"text"`
-	} `json:"content"`
+	Author  string                `json:"author"` // "user" or "assistant"
+	Content RaycastMessageContent `json:"content"`
+}
+
+// RaycastMessageContent represents the content of a Raycast message
+type RaycastMessageContent struct {
+	Text        string              `json:"text"`
+	Attachments []RaycastAttachment `json:"attachments,omitempty"`
+}
+
+// RaycastAttachment represents an inline file attached to a Raycast message
+type RaycastAttachment struct {
+	Type     string `json:"type"` // "image"
+	MimeType string `json:"mime_type"`
+	Data     string `json:"data"` // Base64 encoded content
+
+	remote *remoteImage // Image URL not downloaded yet
 }
 
 // RaycastChatRequest represents a chat request to Raycast API
@@ -42,10 +83,14 @@ type RaycastChatRequest struct {
 	SystemInstruction            string           `json:"system_instruction"`
 	Temperature                  float64          `json:"temperature"`
 	ThreadID                     string           `json:"thread_id"`
-	Tools                        []struct {
-		Name string `json:"name"`
-		Type string `json:"type"`
-	} `json:"tools"`
+	Tools                        []RaycastTool    `json:"tools"`
+	MaxTokens                    int              `json:"max_tokens,omitempty"`
+}
+
+// RaycastTool represents a tool that Raycast can run on the server side
+type RaycastTool struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
 }
 
 // OpenAIChatRequest represents a chat request in OpenAI format
@@ -59,6 +104,11 @@ type OpenAIChatRequest struct {
 	TopP        float64                `json:"top_p,omitempty"`        // Optional top_p value
 	FrequencyPenalty float64           `json:"frequency_penalty,omitempty"` // Optional frequency penalty
 	PresencePenalty float64            `json:"presence_penalty,omitempty"`  // Optional presence penalty
+	Tools       []OpenAITool           `json:"tools,omitempty"`        // Optional function definitions
+	ToolChoice  interface{}            `json:"tool_choice,omitempty"`  // "none", "auto", "required" or a named function
+	StreamOptions *OpenAIStreamOptions `json:"stream_options,omitempty"` // Optional streaming options
+	N           int                    `json:"n,omitempty"`            // Number of choices to generate
+	BestOf      int                    `json:"best_of,omitempty"`      // Candidates generated, of which the best n are returned
 	Extra       map[string]interface{} `json:"-"`                      // Fields not explicitly defined above
 }
 
@@ -104,7 +154,6 @@ func (r *OpenAIChatRequest) UnmarshalJSON(data []byte) error {
 	
 	if v, ok := rawMap["system"].(string); ok {
 		r.System = v
-		r.Extra["system"] = v  // Also store in Extra for backward compatibility
 		delete(rawMap, "system")
 	}
 	
@@ -127,6 +176,40 @@ func (r *OpenAIChatRequest) UnmarshalJSON(data []byte) error {
 		r.PresencePenalty = v
 		delete(rawMap, "presence_penalty")
 	}
+
+	if v, ok := rawMap["tools"]; ok {
+		tools, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		var t []OpenAITool
+		if err := json.Unmarshal(tools, &t); err != nil {
+			return err
+		}
+		r.Tools = t
+		delete(rawMap, "tools")
+	}
+
+	if v, ok := rawMap["tool_choice"]; ok {
+		r.ToolChoice = v
+		delete(rawMap, "tool_choice")
+	}
+
+	if v, ok := rawMap["stream_options"].(map[string]interface{}); ok {
+		includeUsage, _ := v["include_usage"].(bool)
+		r.StreamOptions = &OpenAIStreamOptions{IncludeUsage: includeUsage}
+		delete(rawMap, "stream_options")
+	}
+
+	if v, ok := rawMap["n"].(float64); ok {
+		r.N = int(v)
+		delete(rawMap, "n")
+	}
+
+	if v, ok := rawMap["best_of"].(float64); ok {
+		r.BestOf = int(v)
+		delete(rawMap, "best_of")
+	}
 	
 	// Store any remaining fields in Extra
 	for k, v := range rawMap {
@@ -136,46 +219,95 @@ func (r *OpenAIChatRequest) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// OpenAIStreamOptions represents the streaming options of a chat request
+type OpenAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"` // Send a final chunk with usage
+}
+
 // OpenAIChatResponse represents a chat response in OpenAI format
 type OpenAIChatResponse struct {
-	ID      string `json:"id"`
-	Object  string `json:"object"`
-	Created int64  `json:"created"`
-	Model   string `json:"model"`
-	Choices []struct {
-		Index   int `json:"index"`
-		Message struct {
-			Role        string   `json:"role"`
-			Content     string   `json:"content"`
-			Refusal     *string  `json:"refusal"`
-			Annotations []string `json:"annotations"`
-		} `json:"message"`
-		Logprobs     *string `json:"logprobs"`
-		FinishReason string  `json:"finish_reason"`
-	} `json:"choices"`
-	Usage struct {
-		PromptTokens        int `json:"prompt_tokens"`
-		CompletionTokens    int `json:"completion_tokens"`
-		TotalTokens         int `json:"total_tokens"`
-		PromptTokensDetails struct {
-			CachedTokens int `json:"cached_tokens"`
-			AudioTokens  int `json:"audio_tokens"`
-		} `json:"prompt_tokens_details"`
-		CompletionTokensDetails struct {
-			ReasoningTokens          int `json:"reasoning_tokens"`
-			AudioTokens              int `json:"audio_tokens"`
-			AcceptedPredictionTokens int `json:"accepted_prediction_tokens"`
-			RejectedPredictionTokens int `json:"rejected_prediction_tokens"`
-		} `json:"completion_tokens_details"`
-	} `json:"usage"`
-	ServiceTier       string `json:"service_tier"`
-	SystemFingerprint string `json:"system_fingerprint"`
+	ID                string         `json:"id"`
+	Object            string         `json:"object"`
+	Created           int64          `json:"created"`
+	Model             string         `json:"model"`
+	Choices           []OpenAIChoice `json:"choices"`
+	Usage             OpenAIUsage    `json:"usage"`
+	ServiceTier       string         `json:"service_tier"`
+	SystemFingerprint string         `json:"system_fingerprint"`
+}
+
+// OpenAIChoice represents a single choice in a chat response
+type OpenAIChoice struct {
+	Index        int                   `json:"index"`
+	Message      OpenAIResponseMessage `json:"message"`
+	Logprobs     *string               `json:"logprobs"`
+	FinishReason string                `json:"finish_reason"`
+}
+
+// OpenAIResponseMessage represents the assistant message in a chat response
+type OpenAIResponseMessage struct {
+	Role        string           `json:"role"`
+	Content     *string          `json:"content"` // nil when the reply only contains tool calls
+	Refusal     *string          `json:"refusal"`
+	Annotations []string         `json:"annotations"`
+	ToolCalls   []OpenAIToolCall `json:"tool_calls,omitempty"`
+}
+
+// OpenAIUsage represents token usage in a chat response
+type OpenAIUsage struct {
+	PromptTokens        int `json:"prompt_tokens"`
+	CompletionTokens    int `json:"completion_tokens"`
+	TotalTokens         int `json:"total_tokens"`
+	PromptTokensDetails struct {
+		CachedTokens int `json:"cached_tokens"`
+		AudioTokens  int `json:"audio_tokens"`
+	} `json:"prompt_tokens_details"`
+	CompletionTokensDetails struct {
+		ReasoningTokens          int `json:"reasoning_tokens"`
+		AudioTokens              int `json:"audio_tokens"`
+		AcceptedPredictionTokens int `json:"accepted_prediction_tokens"`
+		RejectedPredictionTokens int `json:"rejected_prediction_tokens"`
+	} `json:"completion_tokens_details"`
+}
+
+// OpenAIChatChunk represents a streaming chunk in OpenAI format
+type OpenAIChatChunk struct {
+	ID      string              `json:"id"`
+	Object  string              `json:"object"`
+	Created int64               `json:"created"`
+	Model   string              `json:"model"`
+	Choices []OpenAIChunkChoice `json:"choices"`
+	Usage   *OpenAIUsage        `json:"usage,omitempty"` // Only set in the final chunk with include_usage
+}
+
+// OpenAIChunkChoice represents a single choice in a streaming chunk
+type OpenAIChunkChoice struct {
+	Index        int              `json:"index"`
+	Delta        OpenAIChunkDelta `json:"delta"`
+	FinishReason *string          `json:"finish_reason"`
+}
+
+// OpenAIChunkDelta represents the incremental message in a streaming chunk
+type OpenAIChunkDelta struct {
+	Role      string           `json:"role,omitempty"`
+	Content   string           `json:"content,omitempty"`
+	ToolCalls []OpenAIToolCall `json:"tool_calls,omitempty"`
 }
 
 // RaycastSSEData represents SSE data from Raycast
 type RaycastSSEData struct {
-	Text         string `json:"text,omitempty"`
-	FinishReason string `json:"finish_reason,omitempty"`
+	Text         string        `json:"text,omitempty"`
+	FinishReason string        `json:"finish_reason,omitempty"`
+	Usage        *RaycastUsage `json:"usage,omitempty"` // Only present if Raycast reports usage
+}
+
+// RaycastUsage represents token usage reported by Raycast, in either the
+// OpenAI or the Anthropic naming
+type RaycastUsage struct {
+	PromptTokens     int `json:"prompt_tokens,omitempty"`
+	CompletionTokens int `json:"completion_tokens,omitempty"`
+	InputTokens      int `json:"input_tokens,omitempty"`
+	OutputTokens     int `json:"output_tokens,omitempty"`
 }
 
 // OpenAIModelResponse represents a model list response in OpenAI format
@@ -188,3 +320,401 @@ type OpenAIModelResponse struct {
 		OwnedBy string `json:"owned_by"`
 	} `json:"data"`
 }
+
+// AnthropicMessagesRequest represents a request to the Anthropic Messages API
+type AnthropicMessagesRequest struct {
+	Model         string               `json:"model"`
+	Messages      []AnthropicMessage   `json:"messages"`
+	System        interface{}          `json:"system,omitempty"` // Can be string or array of text blocks
+	MaxTokens     int                  `json:"max_tokens"`
+	StopSequences []string             `json:"stop_sequences,omitempty"`
+	Stream        bool                 `json:"stream,omitempty"`
+	Temperature   float64              `json:"temperature,omitempty"`
+	Tools         []AnthropicTool      `json:"tools,omitempty"`
+	ToolChoice    *AnthropicToolChoice `json:"tool_choice,omitempty"`
+}
+
+// AnthropicMessage represents a message in Anthropic format
+type AnthropicMessage struct {
+	Role    string      `json:"role"`    // "user" or "assistant"
+	Content interface{} `json:"content"` // Can be string or array of content blocks
+}
+
+// AnthropicTool represents a tool definition in Anthropic format
+type AnthropicTool struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	InputSchema interface{} `json:"input_schema,omitempty"`
+}
+
+// AnthropicToolChoice controls how the model uses the tools
+type AnthropicToolChoice struct {
+	Type string `json:"type"` // "auto", "any", "tool" or "none"
+	Name string `json:"name,omitempty"`
+}
+
+// AnthropicContentBlock represents a content block in an Anthropic response
+type AnthropicContentBlock struct {
+	Type  string          `json:"type"` // "text" or "tool_use"
+	Text  string          `json:"text,omitempty"`
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+}
+
+// AnthropicMessagesResponse represents a response in Anthropic format
+type AnthropicMessagesResponse struct {
+	ID           string                  `json:"id"`
+	Type         string                  `json:"type"`
+	Role         string                  `json:"role"`
+	Model        string                  `json:"model"`
+	Content      []AnthropicContentBlock `json:"content"`
+	StopReason   *string                 `json:"stop_reason"`
+	StopSequence *string                 `json:"stop_sequence"`
+	Usage        AnthropicUsage          `json:"usage"`
+}
+
+// AnthropicUsage represents token usage in Anthropic format
+type AnthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// AnthropicErrorResponse represents an error response in Anthropic format
+type AnthropicErrorResponse struct {
+	Type  string `json:"type"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// OpenAICompletionRequest represents a legacy text completion request
+type OpenAICompletionRequest struct {
+	Model         string               `json:"model"`
+	Prompt        interface{}          `json:"prompt"` // A string or an array of strings
+	Suffix        string               `json:"suffix,omitempty"`
+	MaxTokens     int                  `json:"max_tokens,omitempty"`
+	Temperature   float64              `json:"temperature,omitempty"`
+	Stop          interface{}          `json:"stop,omitempty"` // A string or an array of strings
+	Echo          bool                 `json:"echo,omitempty"`
+	N             int                  `json:"n,omitempty"`
+	BestOf        int                  `json:"best_of,omitempty"` // Candidates generated for each prompt, of which the best n are returned
+	Stream        bool                 `json:"stream,omitempty"`
+	StreamOptions *OpenAIStreamOptions `json:"stream_options,omitempty"`
+}
+
+// OpenAICompletionResponse represents a text completion or a streaming chunk of one
+type OpenAICompletionResponse struct {
+	ID      string                   `json:"id"`
+	Object  string                   `json:"object"`
+	Created int64                    `json:"created"`
+	Model   string                   `json:"model"`
+	Choices []OpenAICompletionChoice `json:"choices"`
+	Usage   *OpenAIUsage             `json:"usage,omitempty"` // Omitted from streaming chunks unless include_usage
+}
+
+// OpenAICompletionChoice represents a single choice of a text completion
+type OpenAICompletionChoice struct {
+	Text         string  `json:"text"`
+	Index        int     `json:"index"`
+	Logprobs     *string `json:"logprobs"`
+	FinishReason *string `json:"finish_reason"`
+}
+
+// OpenAIResponsesRequest represents a request to the OpenAI Responses API
+type OpenAIResponsesRequest struct {
+	Model              string                `json:"model"`
+	Input              interface{}           `json:"input"` // A string or an array of input items
+	Instructions       string                `json:"instructions,omitempty"`
+	PreviousResponseID string                `json:"previous_response_id,omitempty"`
+	Temperature        float64               `json:"temperature,omitempty"`
+	MaxOutputTokens    int                   `json:"max_output_tokens,omitempty"`
+	Tools              []OpenAIResponsesTool `json:"tools,omitempty"`
+	ToolChoice         interface{}           `json:"tool_choice,omitempty"` // "none", "auto", "required" or a named function
+	Stream             bool                  `json:"stream,omitempty"`
+	Store              *bool                 `json:"store,omitempty"` // Whether the response is kept for chaining, true by default
+	Metadata           map[string]string     `json:"metadata,omitempty"`
+}
+
+// OpenAIResponsesTool represents a function tool of the Responses API
+type OpenAIResponsesTool struct {
+	Type        string      `json:"type"` // Only "function" is supported
+	Name        string      `json:"name"`
+	Description string      `json:"description,omitempty"`
+	Parameters  interface{} `json:"parameters,omitempty"`
+	Strict      *bool       `json:"strict,omitempty"`
+}
+
+// OpenAIResponse represents a response object of the Responses API
+type OpenAIResponse struct {
+	ID                 string                   `json:"id"`
+	Object             string                   `json:"object"`
+	CreatedAt          int64                    `json:"created_at"`
+	Status             string                   `json:"status"` // in_progress, completed or incomplete
+	Model              string                   `json:"model"`
+	Output             []interface{}            `json:"output"` // OpenAIResponseOutputMessage and OpenAIResponseFunctionCall items
+	Instructions       *string                  `json:"instructions"`
+	PreviousResponseID *string                  `json:"previous_response_id"`
+	IncompleteDetails  *OpenAIIncompleteDetails `json:"incomplete_details"`
+	Error              interface{}              `json:"error"` // Always null, failures are returned as HTTP errors
+	Temperature        float64                  `json:"temperature"`
+	MaxOutputTokens    *int                     `json:"max_output_tokens"`
+	ToolChoice         interface{}              `json:"tool_choice"`
+	Tools              []OpenAIResponsesTool    `json:"tools"`
+	ParallelToolCalls  bool                     `json:"parallel_tool_calls"`
+	Store              bool                     `json:"store"`
+	Metadata           map[string]string        `json:"metadata"`
+	Usage              *OpenAIResponsesUsage    `json:"usage"`
+}
+
+// OpenAIIncompleteDetails tells why a response is incomplete
+type OpenAIIncompleteDetails struct {
+	Reason string `json:"reason"` // max_output_tokens or content_filter
+}
+
+// OpenAIResponseOutputMessage represents an assistant message output item
+type OpenAIResponseOutputMessage struct {
+	Type    string                     `json:"type"` // "message"
+	ID      string                     `json:"id"`
+	Status  string                     `json:"status"`
+	Role    string                     `json:"role"`
+	Content []OpenAIResponseOutputText `json:"content"`
+}
+
+// OpenAIResponseOutputText represents the text content of an output message
+type OpenAIResponseOutputText struct {
+	Type        string   `json:"type"` // "output_text"
+	Text        string   `json:"text"`
+	Annotations []string `json:"annotations"`
+}
+
+// OpenAIResponseFunctionCall represents a function call output item
+type OpenAIResponseFunctionCall struct {
+	Type      string `json:"type"` // "function_call"
+	ID        string `json:"id"`
+	CallID    string `json:"call_id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"` // JSON encoded arguments
+	Status    string `json:"status"`
+}
+
+// OpenAIResponsesUsage represents token usage in the Responses API
+type OpenAIResponsesUsage struct {
+	InputTokens        int `json:"input_tokens"`
+	InputTokensDetails struct {
+		CachedTokens int `json:"cached_tokens"`
+	} `json:"input_tokens_details"`
+	OutputTokens        int `json:"output_tokens"`
+	OutputTokensDetails struct {
+		ReasoningTokens int `json:"reasoning_tokens"`
+	} `json:"output_tokens_details"`
+	TotalTokens int `json:"total_tokens"`
+}
+
+// GeminiGenerateContentRequest represents a Gemini generateContent request
+type GeminiGenerateContentRequest struct {
+	Contents          []GeminiContent         `json:"contents"`
+	SystemInstruction *GeminiContent          `json:"systemInstruction,omitempty"`
+	GenerationConfig  *GeminiGenerationConfig `json:"generationConfig,omitempty"`
+	Tools             []GeminiTool            `json:"tools,omitempty"`
+	ToolConfig        *GeminiToolConfig       `json:"toolConfig,omitempty"`
+}
+
+// GeminiContent represents a turn of a Gemini conversation
+type GeminiContent struct {
+	Role  string       `json:"role,omitempty"` // "user" or "model"
+	Parts []GeminiPart `json:"parts"`
+}
+
+// GeminiPart represents a part of a Gemini content, only one field is set
+type GeminiPart struct {
+	Text             string                  `json:"text,omitempty"`
+	InlineData       *GeminiBlob             `json:"inlineData,omitempty"`
+	FileData         *GeminiFileData         `json:"fileData,omitempty"`
+	FunctionCall     *GeminiFunctionCall     `json:"functionCall,omitempty"`
+	FunctionResponse *GeminiFunctionResponse `json:"functionResponse,omitempty"`
+}
+
+// GeminiBlob represents inline data, such as an image
+type GeminiBlob struct {
+	MimeType string `json:"mimeType"`
+	Data     string `json:"data"` // Base64 encoded content
+
+	remote *remoteImage // Image URL not downloaded yet
+}
+
+// GeminiFileData represents data referenced by URI
+type GeminiFileData struct {
+	MimeType string `json:"mimeType,omitempty"`
+	FileURI  string `json:"fileUri"`
+}
+
+// GeminiFunctionCall represents a function call made by the model
+type GeminiFunctionCall struct {
+	ID   string          `json:"id,omitempty"`
+	Name string          `json:"name"`
+	Args json.RawMessage `json:"args,omitempty"` // JSON object of the arguments
+}
+
+// GeminiFunctionResponse represents the result of a function call
+type GeminiFunctionResponse struct {
+	ID       string          `json:"id,omitempty"`
+	Name     string          `json:"name"`
+	Response json.RawMessage `json:"response"`
+}
+
+// GeminiGenerationConfig represents the generation options of a request
+type GeminiGenerationConfig struct {
+	Temperature     float64  `json:"temperature,omitempty"`
+	MaxOutputTokens int      `json:"maxOutputTokens,omitempty"`
+	StopSequences   []string `json:"stopSequences,omitempty"`
+	CandidateCount  int      `json:"candidateCount,omitempty"`
+}
+
+// GeminiTool represents a set of functions the model may call
+type GeminiTool struct {
+	FunctionDeclarations []GeminiFunctionDeclaration `json:"functionDeclarations,omitempty"`
+}
+
+// GeminiFunctionDeclaration describes a function the model may call
+type GeminiFunctionDeclaration struct {
+	Name                 string      `json:"name"`
+	Description          string      `json:"description,omitempty"`
+	Parameters           interface{} `json:"parameters,omitempty"`           // OpenAPI schema of the arguments
+	ParametersJSONSchema interface{} `json:"parametersJsonSchema,omitempty"` // JSON schema, used instead of parameters
+}
+
+// GeminiToolConfig represents how the model may use the functions
+type GeminiToolConfig struct {
+	FunctionCallingConfig *GeminiFunctionCallingConfig `json:"functionCallingConfig,omitempty"`
+}
+
+// GeminiFunctionCallingConfig represents the function calling mode
+type GeminiFunctionCallingConfig struct {
+	Mode                 string   `json:"mode,omitempty"` // AUTO, ANY or NONE
+	AllowedFunctionNames []string `json:"allowedFunctionNames,omitempty"`
+}
+
+// GeminiGenerateContentResponse represents a Gemini response or a streaming chunk of one
+type GeminiGenerateContentResponse struct {
+	Candidates    []GeminiCandidate    `json:"candidates"`
+	UsageMetadata *GeminiUsageMetadata `json:"usageMetadata,omitempty"` // Only set in the final chunk when streaming
+	ModelVersion  string               `json:"modelVersion"`
+	ResponseID    string               `json:"responseId"`
+}
+
+// GeminiCandidate represents a candidate reply
+type GeminiCandidate struct {
+	Content      GeminiContent `json:"content"`
+	FinishReason string        `json:"finishReason,omitempty"`
+	Index        int           `json:"index"`
+}
+
+// GeminiUsageMetadata represents token usage in Gemini format
+type GeminiUsageMetadata struct {
+	PromptTokenCount     int `json:"promptTokenCount"`
+	CandidatesTokenCount int `json:"candidatesTokenCount"`
+	TotalTokenCount      int `json:"totalTokenCount"`
+}
+
+// GeminiModel represents a model in the Gemini model list
+type GeminiModel struct {
+	Name                       string   `json:"name"` // models/{id}
+	BaseModelID                string   `json:"baseModelId"`
+	DisplayName                string   `json:"displayName"`
+	SupportedGenerationMethods []string `json:"supportedGenerationMethods"`
+}
+
+// GeminiErrorResponse represents an error response in Gemini format
+type GeminiErrorResponse struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+	} `json:"error"`
+}
+
+// OllamaChatRequest represents an Ollama /api/chat request
+type OllamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []OllamaMessage `json:"messages"`
+	Tools    []OpenAITool    `json:"tools,omitempty"`  // Same format as OpenAI
+	Stream   *bool           `json:"stream,omitempty"` // Streams unless set to false
+	Options  *OllamaOptions  `json:"options,omitempty"`
+}
+
+// OllamaGenerateRequest represents an Ollama /api/generate request
+type OllamaGenerateRequest struct {
+	Model   string         `json:"model"`
+	Prompt  string         `json:"prompt"`
+	Suffix  string         `json:"suffix,omitempty"`
+	System  string         `json:"system,omitempty"`
+	Images  []string       `json:"images,omitempty"` // Base64 encoded images
+	Stream  *bool          `json:"stream,omitempty"` // Streams unless set to false
+	Options *OllamaOptions `json:"options,omitempty"`
+}
+
+// OllamaMessage represents a message in Ollama format
+type OllamaMessage struct {
+	Role      string           `json:"role"` // "system", "user", "assistant" or "tool"
+	Content   string           `json:"content"`
+	Images    []string         `json:"images,omitempty"` // Base64 encoded images
+	ToolCalls []OllamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string           `json:"tool_name,omitempty"` // Function answered by a "tool" message
+}
+
+// OllamaToolCall represents a tool call in Ollama format
+type OllamaToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"` // JSON object, not an encoded string
+	} `json:"function"`
+}
+
+// OllamaOptions represents the model options of an Ollama request
+type OllamaOptions struct {
+	Temperature float64  `json:"temperature,omitempty"`
+	NumPredict  int      `json:"num_predict,omitempty"` // Maximum number of tokens
+	Stop        []string `json:"stop,omitempty"`
+}
+
+// OllamaResponse represents an Ollama reply or a streaming chunk of one. The
+// statistics are only set on the final chunk.
+type OllamaResponse struct {
+	Model              string         `json:"model"`
+	CreatedAt          time.Time      `json:"created_at"`
+	Message            *OllamaMessage `json:"message,omitempty"`  // Set by /api/chat
+	Response           *string        `json:"response,omitempty"` // Set by /api/generate
+	Done               bool           `json:"done"`
+	DoneReason         string         `json:"done_reason,omitempty"`
+	TotalDuration      int64          `json:"total_duration,omitempty"` // Nanoseconds
+	PromptEvalCount    int            `json:"prompt_eval_count,omitempty"`
+	PromptEvalDuration int64          `json:"prompt_eval_duration,omitempty"`
+	EvalCount          int            `json:"eval_count,omitempty"`
+	EvalDuration       int64          `json:"eval_duration,omitempty"`
+}
+
+// OllamaModel represents a model in the Ollama tag list
+type OllamaModel struct {
+	Name       string             `json:"name"` // {id}:latest
+	Model      string             `json:"model"`
+	ModifiedAt time.Time          `json:"modified_at"`
+	Size       int64              `json:"size"`
+	Digest     string             `json:"digest"`
+	Details    OllamaModelDetails `json:"details"`
+}
+
+// OllamaModelDetails describes a model in the Ollama tag list
+type OllamaModelDetails struct {
+	Format            string   `json:"format"`
+	Family            string   `json:"family"`
+	Families          []string `json:"families"`
+	ParameterSize     string   `json:"parameter_size"`
+	QuantizationLevel string   `json:"quantization_level"`
+}
+
+// OllamaErrorResponse represents an error response in Ollama format
+type OllamaErrorResponse struct {
+	Error string `json:"error"`
+}
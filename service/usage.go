@@ -0,0 +1,403 @@
+/*
+ * @Author: Vincent Yang
+ * @Date: 2026-10-16 19:26:03
+ * @LastEditors: Vincent Yang
+ * @LastEditTime: 2026-10-16 19:26:03
+ * @FilePath: /raycast2api/service/usage.go
+ * @Telegram: https://t.me/missuo
+ * @GitHub: https://github.com/missuo
+ *
+ * Copyright © 2026 by Vincent, All Rights Reserved.
+ */
+
+package service
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UsageRecord is a completion request as recorded in the usage ledger
+type UsageRecord struct {
+	Timestamp        time.Time `json:"timestamp"`
+	RequestID        string    `json:"request_id,omitempty"` // Shared by the records of a request
+	Endpoint         string    `json:"endpoint"`
+	KeyID            string    `json:"key_id"`
+	Model            string    `json:"model"`
+	Provider         string    `json:"provider"`
+	UpstreamToken    string    `json:"upstream_token"`
+	Stream           bool      `json:"stream"`
+	Status           int       `json:"status"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	LatencyMs        int64     `json:"latency_ms"`
+}
+
+// UsageLedger records completions in an append-only JSON lines file, one
+// record per line. The latest records are also kept in memory, which serves
+// recent queries without reading the file and is the whole ledger when no file
+// is configured.
+type UsageLedger struct {
+	path     string
+	recent   []UsageRecord // Latest records, oldest first
+	capacity int           // Records kept in recent
+	// Newest timestamp of the records dropped from recent, the queries
+	// starting after it are answered from memory
+	droppedUntil time.Time
+	dropped      bool
+	mutex        sync.Mutex
+}
+
+// NewUsageLedger creates a usage ledger writing to path, in memory when empty.
+// The latest records of an existing file are loaded into memory.
+func NewUsageLedger(path string) (*UsageLedger, error) {
+	l := &UsageLedger{path: path, capacity: UsageRecentRecords}
+	if path == "" {
+		slog.Warn("Usage ledger is not persisted, set USAGE_LEDGER_FILE to keep it on disk", "kept_records", l.capacity)
+		return l, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("error creating usage ledger directory: %w", err)
+	}
+	err := readUsageFile(path, func(record UsageRecord) {
+		l.remember(record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// remember adds a record to the in-memory records, dropping the oldest one
+// beyond the capacity. The caller holds the mutex.
+func (l *UsageLedger) remember(record UsageRecord) {
+	l.recent = append(l.recent, record)
+	if len(l.recent) > l.capacity {
+		oldest := l.recent[0]
+		if !l.dropped || oldest.Timestamp.After(l.droppedUntil) {
+			l.droppedUntil = oldest.Timestamp
+		}
+		l.dropped = true
+		l.recent = l.recent[1:]
+	}
+}
+
+// Record appends a completion to the ledger
+func (l *UsageLedger) Record(record UsageRecord) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.remember(record)
+	if l.path == "" {
+		return
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		slog.Error("Error encoding usage record", "error", err)
+		return
+	}
+	file, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		slog.Error("Error opening usage ledger", "error", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		slog.Error("Error writing usage record", "error", err)
+	}
+}
+
+// UsageFilter selects the records of a usage query
+type UsageFilter struct {
+	From  time.Time // Inclusive, unbounded when zero
+	To    time.Time // Exclusive, unbounded when zero
+	KeyID string
+	Model string
+}
+
+// matches reports whether a record passes the filter
+func (f UsageFilter) matches(record UsageRecord) bool {
+	if !f.From.IsZero() && record.Timestamp.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !record.Timestamp.Before(f.To) {
+		return false
+	}
+	if f.KeyID != "" && record.KeyID != f.KeyID {
+		return false
+	}
+	return f.Model == "" || record.Model == f.Model
+}
+
+// Records returns the records matching a filter, oldest first. The file is
+// only read when the query reaches past the records kept in memory, and
+// without holding the mutex so completions can still be recorded meanwhile.
+func (l *UsageLedger) Records(filter UsageFilter) ([]UsageRecord, error) {
+	var records []UsageRecord
+	collect := func(record UsageRecord) {
+		if filter.matches(record) {
+			records = append(records, record)
+		}
+	}
+
+	l.mutex.Lock()
+	if l.path == "" || !l.dropped || filter.From.After(l.droppedUntil) {
+		for _, record := range l.recent {
+			collect(record)
+		}
+		l.mutex.Unlock()
+		return records, nil
+	}
+	path := l.path
+	l.mutex.Unlock()
+
+	if err := readUsageFile(path, collect); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// readUsageFile calls fn with every record of a ledger file, oldest first
+func readUsageFile(path string, fn func(UsageRecord)) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening usage ledger: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var record UsageRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// A crash, or a record being appended while the file is read,
+			// can leave a partial last line, skip it rather than fail
+			slog.Warn("Skipping invalid usage record", "line", line, "error", err)
+			continue
+		}
+		fn(record)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading usage ledger: %w", err)
+	}
+	return nil
+}
+
+// usageGroupFields are the fields usage can be grouped by
+var usageGroupFields = []string{"day", "key", "model"}
+
+// UsageSummary aggregates the records of a group
+type UsageSummary struct {
+	Day              string `json:"day,omitempty"`
+	KeyID            string `json:"key_id,omitempty"`
+	Model            string `json:"model,omitempty"`
+	Requests         int    `json:"requests"`
+	Errors           int    `json:"errors"`
+	PromptTokens     int    `json:"prompt_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+	TotalTokens      int    `json:"total_tokens"`
+	AvgLatencyMs     int64  `json:"avg_latency_ms"`
+}
+
+// summarizeUsage groups records by the given fields, in order of the groups.
+// A request recorded several times, once per model and upstream token, counts
+// once in the requests, errors and latency of a group. Records written before
+// request ids were recorded count as a request each.
+func summarizeUsage(records []UsageRecord, groupBy []string) []UsageSummary {
+	type groupRequest struct {
+		group     int
+		requestID string
+	}
+	var summaries []UsageSummary
+	index := make(map[UsageSummary]int)
+	latency := make(map[int]int64)
+	counted := make(map[groupRequest]bool)
+
+	for _, record := range records {
+		var key UsageSummary
+		for _, field := range groupBy {
+			switch field {
+			case "day":
+				key.Day = record.Timestamp.UTC().Format(time.DateOnly)
+			case "key":
+				key.KeyID = record.KeyID
+			case "model":
+				key.Model = record.Model
+			}
+		}
+
+		i, ok := index[key]
+		if !ok {
+			i = len(summaries)
+			index[key] = i
+			summaries = append(summaries, key)
+		}
+		summary := &summaries[i]
+		if request := (groupRequest{i, record.RequestID}); record.RequestID == "" || !counted[request] {
+			counted[request] = true
+			summary.Requests++
+			if record.Status >= 400 {
+				summary.Errors++
+			}
+			latency[i] += record.LatencyMs
+		}
+		summary.PromptTokens += record.PromptTokens
+		summary.CompletionTokens += record.CompletionTokens
+		summary.TotalTokens += record.PromptTokens + record.CompletionTokens
+	}
+
+	for i := range summaries {
+		summaries[i].AvgLatencyMs = latency[i] / int64(summaries[i].Requests)
+	}
+	slices.SortStableFunc(summaries, func(a, b UsageSummary) int {
+		if c := strings.Compare(a.Day, b.Day); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a.KeyID, b.KeyID); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Model, b.Model)
+	})
+	return summaries
+}
+
+// parseUsageTime parses a from/to query parameter, a date or an RFC 3339 time
+func parseUsageTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// handleUsage reports recorded usage, raw or grouped, as JSON or CSV.
+// Query parameters: from, to, key, model, group_by (day,key,model) and
+// format (json or csv).
+func handleUsage(c *gin.Context, config Config) {
+	from, err := parseUsageTime(c.Query("from"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, newErrorResponse("Invalid from, expected a date or an RFC 3339 time", "invalid_request_error", err.Error()))
+		return
+	}
+	to, err := parseUsageTime(c.Query("to"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, newErrorResponse("Invalid to, expected a date or an RFC 3339 time", "invalid_request_error", err.Error()))
+		return
+	}
+	// A date as upper bound includes the whole day
+	if len(c.Query("to")) == len(time.DateOnly) {
+		to = to.AddDate(0, 0, 1)
+	}
+
+	var groupBy []string
+	if value := c.Query("group_by"); value != "" {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if !slices.Contains(usageGroupFields, field) {
+				c.JSON(http.StatusBadRequest, newErrorResponse(fmt.Sprintf("Invalid group_by field %q, expected day, key or model", field), "invalid_request_error", ""))
+				return
+			}
+			groupBy = append(groupBy, field)
+		}
+	}
+
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		c.JSON(http.StatusBadRequest, newErrorResponse("Invalid format, expected json or csv", "invalid_request_error", ""))
+		return
+	}
+
+	records, err := config.Usage.Records(UsageFilter{From: from, To: to, KeyID: c.Query("key"), Model: c.Query("model")})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, newErrorResponse("Failed to read the usage ledger", "server_error", err.Error()))
+		return
+	}
+
+	if len(groupBy) == 0 {
+		if format == "csv" {
+			writeUsageCSV(c, usageRecordsCSV(records))
+			return
+		}
+		if records == nil {
+			records = []UsageRecord{}
+		}
+		c.JSON(http.StatusOK, gin.H{"object": "list", "data": records})
+		return
+	}
+
+	summaries := summarizeUsage(records, groupBy)
+	if format == "csv" {
+		writeUsageCSV(c, usageSummariesCSV(summaries, groupBy))
+		return
+	}
+	if summaries == nil {
+		summaries = []UsageSummary{}
+	}
+	c.JSON(http.StatusOK, gin.H{"object": "list", "group_by": groupBy, "data": summaries})
+}
+
+// usageRecordsCSV renders raw records as CSV rows
+func usageRecordsCSV(records []UsageRecord) [][]string {
+	rows := [][]string{{"timestamp", "request_id", "endpoint", "key_id", "model", "provider", "upstream_token",
+		"stream", "status", "prompt_tokens", "completion_tokens", "latency_ms"}}
+	for _, r := range records {
+		rows = append(rows, []string{
+			r.Timestamp.UTC().Format(time.RFC3339Nano), r.RequestID, r.Endpoint, r.KeyID, r.Model, r.Provider, r.UpstreamToken,
+			strconv.FormatBool(r.Stream), strconv.Itoa(r.Status), strconv.Itoa(r.PromptTokens),
+			strconv.Itoa(r.CompletionTokens), strconv.FormatInt(r.LatencyMs, 10),
+		})
+	}
+	return rows
+}
+
+// usageSummariesCSV renders grouped usage as CSV rows, with one column per group field
+func usageSummariesCSV(summaries []UsageSummary, groupBy []string) [][]string {
+	header := []string{}
+	for _, field := range groupBy {
+		header = append(header, map[string]string{"day": "day", "key": "key_id", "model": "model"}[field])
+	}
+	rows := [][]string{append(header, "requests", "errors", "prompt_tokens", "completion_tokens", "total_tokens", "avg_latency_ms")}
+	for _, s := range summaries {
+		row := []string{}
+		for _, field := range groupBy {
+			row = append(row, map[string]string{"day": s.Day, "key": s.KeyID, "model": s.Model}[field])
+		}
+		rows = append(rows, append(row,
+			strconv.Itoa(s.Requests), strconv.Itoa(s.Errors), strconv.Itoa(s.PromptTokens),
+			strconv.Itoa(s.CompletionTokens), strconv.Itoa(s.TotalTokens), strconv.FormatInt(s.AvgLatencyMs, 10),
+		))
+	}
+	return rows
+}
+
+// writeUsageCSV sends CSV rows as a download
+func writeUsageCSV(c *gin.Context, rows [][]string) {
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="usage.csv"`)
+	c.Status(http.StatusOK)
+	writer := csv.NewWriter(c.Writer)
+	writer.WriteAll(rows)
+}
@@ -13,13 +13,12 @@
 package service
 
 import (
-	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
-	"regexp"
 	"strings"
 	"time"
 
@@ -27,8 +26,9 @@ import (
 	"github.com/google/uuid"
 )
 
-// convertMessages converts OpenAI messages format to Raycast format
-func convertMessages(openaiMessages []OpenAIMessage) []RaycastMessage {
+// convertMessages converts OpenAI messages format to Raycast format. Image
+// parts are resolved into attachments, which can fail on bad or oversized images.
+func convertMessages(config Config, openaiMessages []OpenAIMessage) ([]RaycastMessage, error) {
 	raycastMessages := make([]RaycastMessage, len(openaiMessages))
 	for i, msg := range openaiMessages {
 		author := "user"
@@ -36,153 +36,139 @@ func convertMessages(openaiMessages []OpenAIMessage) []RaycastMessage {
 			author = "assistant"
 		}
 
-		var contentText string
-		switch content := msg.Content.(type) {
-		case string:
-			contentText = content
-		case []interface{}:
-			// Handle array content (extract text parts)
-			for _, part := range content {
-				if partMap, ok := part.(map[string]interface{}); ok {
-					if partMap["type"] == "text" {
-						if textValue, ok := partMap["text"].(string); ok {
-							contentText += textValue
-						}
-					}
-				}
+		contentText := extractContentText(msg.Content)
+
+		switch {
+		case msg.Role == "tool":
+			// Tool results go back to the model as tagged user text
+			contentText = renderToolResult(msg.ToolCallID, msg.Name, contentText)
+		case msg.Role == "assistant" && len(msg.ToolCalls) > 0:
+			if contentText != "" {
+				contentText += "\n"
+			}
+			contentText += renderToolCalls(msg.ToolCalls)
+		}
+
+		var attachments []RaycastAttachment
+		for _, url := range extractImageURLs(msg.Content) {
+			attachment, err := loadImageAttachment(config, url)
+			if err != nil {
+				return nil, fmt.Errorf("message %d: %w", i, err)
 			}
+			attachments = append(attachments, attachment)
 		}
 
 		raycastMessages[i] = RaycastMessage{
 			Author: author,
-			Content: struct {
-				Text string `json:"text"`
-			}{
-				Text: contentText,
+			Content: RaycastMessageContent{
+				Text:        contentText,
+				Attachments: attachments,
 			},
 		}
 	}
-	return raycastMessages
+	return raycastMessages, nil
 }
 
-// parseSSEResponse parses SSE response from Raycast into a single text
-func parseSSEResponse(responseText string) string {
-	scanner := bufio.NewScanner(strings.NewReader(responseText))
-	var fullText string
-	
-	log.Printf("Starting to parse SSE response, length: %d", len(responseText))
-	
-	// If the response is empty, return early
-	if strings.TrimSpace(responseText) == "" {
-		log.Println("Empty response received from Raycast")
-		return ""
+// extractSystemMessages removes system and developer messages from the
+// conversation and returns their text, concatenated in order
+func extractSystemMessages(openaiMessages []OpenAIMessage) (string, []OpenAIMessage) {
+	var systemParts []string
+	messages := make([]OpenAIMessage, 0, len(openaiMessages))
+	for _, msg := range openaiMessages {
+		if msg.Role == "system" || msg.Role == "developer" {
+			systemParts = append(systemParts, extractContentText(msg.Content))
+			continue
+		}
+		messages = append(messages, msg)
 	}
+	return joinNonEmpty("\n\n", systemParts...), messages
+}
 
-	lineCount := 0
-	for scanner.Scan() {
-		line := scanner.Text()
-		lineCount++
-		
-		if line == "" {
-			continue
+// joinNonEmpty joins the non-empty strings with the separator
+func joinNonEmpty(sep string, parts ...string) string {
+	var nonEmpty []string
+	for _, part := range parts {
+		if strings.TrimSpace(part) != "" {
+			nonEmpty = append(nonEmpty, part)
 		}
-		
-		if strings.HasPrefix(line, "data:") {
-			data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
-			log.Printf("SSE data line %d: %s", lineCount, data)
-			
-			// Skip [DONE] marker
-			if data == "[DONE]" {
-				log.Println("Reached end of SSE stream")
-				continue
-			}
-			
-			// Try standard parsing first
-			var jsonData RaycastSSEData
-			if err := json.Unmarshal([]byte(data), &jsonData); err != nil {
-				log.Printf("Failed to parse SSE data as RaycastSSEData: %v", err)
-				
-				// If standard parsing fails, try as a generic JSON object
-				var genericData map[string]interface{}
-				if jsonErr := json.Unmarshal([]byte(data), &genericData); jsonErr != nil {
-					log.Printf("Failed to parse as generic JSON: %v", jsonErr)
-					continue
-				}
-				
-				// Try to extract text from various possible fields
-				if text, ok := genericData["text"].(string); ok && text != "" {
-					log.Printf("Found text in generic JSON: %s", text)
-					fullText += text
-					continue
-				}
-				
-				if content, ok := genericData["content"].(string); ok && content != "" {
-					log.Printf("Found content in generic JSON: %s", content)
-					fullText += content
-					continue
-				}
-				
-				// Check for nested message structure
-				if message, ok := genericData["message"].(map[string]interface{}); ok {
-					if content, ok := message["content"].(string); ok && content != "" {
-						log.Printf("Found content in nested message: %s", content)
-						fullText += content
-						continue
+	}
+	return strings.Join(nonEmpty, sep)
+}
+
+// extractContentText extracts the text of an OpenAI message content
+func extractContentText(content interface{}) string {
+	var contentText string
+	switch content := content.(type) {
+	case string:
+		contentText = content
+	case []interface{}:
+		// Handle array content (extract text parts)
+		for _, part := range content {
+			if partMap, ok := part.(map[string]interface{}); ok {
+				if partMap["type"] == "text" {
+					if textValue, ok := partMap["text"].(string); ok {
+						contentText += textValue
 					}
 				}
-				
-				// If we got here, we found JSON but no recognizable text field
-				log.Printf("Found JSON but no text/content fields: %v", genericData)
-				continue
-			}
-			
-			// Standard parsing succeeded
-			if jsonData.Text != "" {
-				log.Printf("Adding text from standard format: %s", jsonData.Text)
-				fullText += jsonData.Text
-			} else {
-				log.Println("Empty text field in otherwise valid JSON")
 			}
-		} else {
-			// Log non-data lines for debugging
-			log.Printf("Non-data line: %s", line)
 		}
 	}
-	
-	log.Printf("Parsed response, extracted text length: %d", len(fullText))
-	
-	// If we didn't extract any text but had data lines, try one more fallback approach
-	if fullText == "" && lineCount > 0 {
-		log.Println("No text extracted but response exists, trying whole-response parsing")
-		
-		// Try to extract any JSON objects from the entire response
-		var allMatches []string
-		re := regexp.MustCompile(`{[^{}]*({[^{}]*})*[^{}]*}`)
-		matches := re.FindAllString(responseText, -1)
-		
-		for _, match := range matches {
-			var genericData map[string]interface{}
-			if err := json.Unmarshal([]byte(match), &genericData); err == nil {
-				// Look for content or text fields at any level (simplified)
-				jsonBytes, _ := json.Marshal(genericData)
-				if strings.Contains(string(jsonBytes), "\"text\":") || 
-				   strings.Contains(string(jsonBytes), "\"content\":") {
-					allMatches = append(allMatches, match)
-				}
-			}
-		}
-		
-		if len(allMatches) > 0 {
-			log.Printf("Found %d potential JSON objects in response", len(allMatches))
-			// For now just log them, could add more parsing logic here
-		}
+	return contentText
+}
+
+// raycastReply is the aggregated content of a Raycast SSE response
+type raycastReply struct {
+	Text         string
+	FinishReason string
+	Usage        *RaycastUsage
+}
+
+// chatResponseOptions carries the request details needed to render a reply
+type chatResponseOptions struct {
+	Model        string             // Model name reported to the client
+	Request      RaycastChatRequest // Request sent upstream, used for token counting
+	WithTools    bool               // Whether tool call blocks should be parsed
+	IncludeUsage bool               // Whether a streaming usage chunk was requested
+}
+
+// mapFinishReason maps a Raycast finish reason to an OpenAI finish reason
+func mapFinishReason(finishReason string, toolCalls bool) string {
+	if toolCalls {
+		return "tool_calls"
+	}
+	switch strings.ToLower(finishReason) {
+	case "length", "max_tokens", "max_output_tokens":
+		return "length"
+	case "content_filter", "safety", "refusal", "recitation", "blocked":
+		return "content_filter"
+	case "tool_calls", "tool_use", "function_call":
+		return "tool_calls"
 	}
+	return "stop"
+}
 
-	return fullText
+// buildUsage returns the reported usage, or counts the tokens locally when
+// Raycast did not report any
+func buildUsage(request RaycastChatRequest, completionText string, reported *RaycastUsage) OpenAIUsage {
+	var usage OpenAIUsage
+	if reported != nil {
+		usage.PromptTokens = reported.PromptTokens + reported.InputTokens
+		usage.CompletionTokens = reported.CompletionTokens + reported.OutputTokens
+	}
+	if usage.PromptTokens == 0 {
+		usage.PromptTokens = countPromptTokens(request)
+	}
+	if usage.CompletionTokens == 0 {
+		usage.CompletionTokens = countCompletionTokens(request, completionText)
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	return usage
 }
 
-// handleStreamingResponse handles streaming response from Raycast
-func handleStreamingResponse(c *gin.Context, response *http.Response, modelId string) {
+// handleStreamingResponse relays the Raycast replies as chat completion
+// chunks. With several choices, the replies are read concurrently and their
+// chunks interleaved, each carrying its choice index.
+func handleStreamingResponse(c *gin.Context, results []relayResult, opts chatResponseOptions) {
 	c.Header("Content-Type", "text/event-stream")
 	c.Header("Cache-Control", "no-cache")
 	c.Header("Connection", "keep-alive")
@@ -191,110 +177,165 @@ func handleStreamingResponse(c *gin.Context, response *http.Response, modelId st
 	// Set up a flush interval for the writer
 	flusher, ok := c.Writer.(http.Flusher)
 	if !ok {
-		log.Println("Streaming unsupported")
+		slog.Error("Streaming unsupported")
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	reader := bufio.NewReader(response.Body)
-	buffer := ""
+	chunkID := fmt.Sprintf("chatcmpl-%s", uuid.New().String())
+	created := time.Now().Unix()
+
+	// writeChunk writes a single OpenAI-compatible streaming chunk
+	writeChunk := func(chunk OpenAIChatChunk) {
+		chunk.ID = chunkID
+		chunk.Object = "chat.completion.chunk"
+		chunk.Created = created
+		chunk.Model = opts.Model
 
-	for {
-		line, err := reader.ReadString('\n')
+		chunkData, err := json.Marshal(chunk)
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			log.Printf("Error reading from response: %v", err)
-			break
+			slog.Error("Error marshaling chunk", "error", err)
+			return
 		}
 
-		buffer += line
+		// Send the chunk
+		fmt.Fprintf(c.Writer, "data: %s\n\n", string(chunkData))
+		flusher.Flush()
+	}
 
-		// Process complete SSE messages in the buffer
-		if strings.HasSuffix(buffer, "\n\n") {
-			lines := strings.Split(buffer, "\n")
-			buffer = ""
+	// Only this goroutine writes, the readers hand their chunks over
+	chunks := make(chan OpenAIChunkChoice)
+	usages := make([]OpenAIUsage, len(results))
+	errs := make([]error, len(results))
+	go func() {
+		fanOut(len(results), func(i int) {
+			usages[i], errs[i] = streamChatChoice(results[i], opts, i, func(choice OpenAIChunkChoice) {
+				chunks <- choice
+			})
+		})
+		close(chunks)
+	}()
 
-			for _, l := range lines {
-				if strings.TrimSpace(l) == "" {
-					continue
-				}
+	record := getRequestRecord(c.Request.Context())
+	for chunk := range chunks {
+		if chunk.Delta.Content != "" || len(chunk.Delta.ToolCalls) > 0 {
+			record.markFirstToken()
+		}
+		writeChunk(OpenAIChatChunk{
+			Choices: []OpenAIChunkChoice{chunk},
+		})
+	}
+	if err := errors.Join(errs...); err != nil {
+		if clientDisconnected(c) {
+			logCancelledRequest(c, opts.Model)
+			return
+		}
+		slog.Error("Error reading from response", "error", err)
+	}
 
-				if strings.HasPrefix(l, "data:") {
-					data := strings.TrimSpace(strings.TrimPrefix(l, "data:"))
-					var jsonData RaycastSSEData
-					if err := json.Unmarshal([]byte(data), &jsonData); err != nil {
-						log.Printf("Failed to parse SSE data: %v", err)
-						continue
-					}
+	for i, result := range results {
+		record.setUsage(result.Request, usages[i])
+	}
+	usage := sumUsage(usages...)
 
-					// Create OpenAI-compatible streaming chunk
-					chunk := struct {
-						ID      string `json:"id"`
-						Object  string `json:"object"`
-						Created int64  `json:"created"`
-						Model   string `json:"model"`
-						Choices []struct {
-							Index int `json:"index"`
-							Delta struct {
-								Content string `json:"content"`
-							} `json:"delta"`
-							FinishReason string `json:"finish_reason"`
-						} `json:"choices"`
-					}{
-						ID:      fmt.Sprintf("chatcmpl-%s", uuid.New().String()),
-						Object:  "chat.completion.chunk",
-						Created: time.Now().Unix(),
-						Model:   modelId,
-						Choices: []struct {
-							Index int `json:"index"`
-							Delta struct {
-								Content string `json:"content"`
-							} `json:"delta"`
-							FinishReason string `json:"finish_reason"`
-						}{
-							{
-								Index: 0,
-								Delta: struct {
-									Content string `json:"content"`
-								}{
-									Content: jsonData.Text,
-								},
-								FinishReason: jsonData.FinishReason,
-							},
-						},
-					}
+	// The usage chunk has no choices, as in the OpenAI API
+	if opts.IncludeUsage {
+		writeChunk(OpenAIChatChunk{
+			Choices: []OpenAIChunkChoice{},
+			Usage:   &usage,
+		})
+	}
 
-					chunkData, err := json.Marshal(chunk)
-					if err != nil {
-						log.Printf("Error marshaling chunk: %v", err)
-						continue
-					}
+	// Send final [DONE] marker
+	fmt.Fprintf(c.Writer, "data: [DONE]\n\n")
+	flusher.Flush()
+}
 
-					// Send the chunk
-					fmt.Fprintf(c.Writer, "data: %s\n\n", string(chunkData))
-					flusher.Flush()
-				}
+// streamChatChoice reads a Raycast reply and sends it as the deltas of one
+// choice, from the assistant role to the finish reason
+func streamChatChoice(result relayResult, opts chatResponseOptions, index int, send func(OpenAIChunkChoice)) (OpenAIUsage, error) {
+	opts.Model, opts.Request = result.Model, result.Request
+	sendChunk := func(delta OpenAIChunkDelta, finishReason *string) {
+		send(OpenAIChunkChoice{
+			Index:        index,
+			Delta:        delta,
+			FinishReason: finishReason,
+		})
+	}
+
+	// Tool call blocks are held back and re-emitted as delta.tool_calls
+	var toolParser *toolCallStreamParser
+	if opts.WithTools {
+		toolParser = &toolCallStreamParser{}
+	}
+
+	sendChunk(OpenAIChunkDelta{Role: "assistant"}, nil)
+
+	finishReason := ""
+	var completionText strings.Builder
+	var reportedUsage *RaycastUsage
+
+	err := readRaycastEvents(result.Response.Body, func(jsonData RaycastSSEData) bool {
+		if jsonData.FinishReason != "" {
+			finishReason = jsonData.FinishReason
+		}
+		if jsonData.Usage != nil {
+			reportedUsage = jsonData.Usage
+		}
+		completionText.WriteString(jsonData.Text)
+
+		if toolParser == nil {
+			if jsonData.Text != "" {
+				sendChunk(OpenAIChunkDelta{Content: jsonData.Text}, nil)
 			}
+			return true
 		}
+
+		text, calls := toolParser.Feed(jsonData.Text)
+		if text != "" {
+			sendChunk(OpenAIChunkDelta{Content: text}, nil)
+		}
+		if len(calls) > 0 {
+			sendChunk(OpenAIChunkDelta{ToolCalls: calls}, nil)
+		}
+		return true
+	})
+
+	hasToolCalls := false
+	if toolParser != nil {
+		if rest := toolParser.Flush(); rest != "" {
+			sendChunk(OpenAIChunkDelta{Content: rest}, nil)
+		}
+		hasToolCalls = toolParser.HasToolCalls()
 	}
+	finishReason = mapFinishReason(finishReason, hasToolCalls)
+	sendChunk(OpenAIChunkDelta{}, &finishReason)
 
-	// Send final [DONE] marker
-	fmt.Fprintf(c.Writer, "data: [DONE]\n\n")
-	flusher.Flush()
+	usage := buildUsage(opts.Request, completionText.String(), reportedUsage)
+	logReply(opts, completionText.String(), usage)
+	return usage, err
 }
 
-// handleNonStreamingResponse handles non-streaming response from Raycast
-func handleNonStreamingResponse(c *gin.Context, response *http.Response, modelId string) {
-	// Collect the entire response
-	bodyBytes, err := io.ReadAll(response.Body)
-	if err != nil {
+// handleNonStreamingResponse collects the Raycast replies into a chat
+// completion, keeping the best n replies as its choices
+func handleNonStreamingResponse(c *gin.Context, results []relayResult, n int, opts chatResponseOptions) {
+	choices := make([]OpenAIChoice, len(results))
+	usages := make([]OpenAIUsage, len(results))
+	errs := make([]error, len(results))
+	fanOut(len(results), func(i int) {
+		choices[i], usages[i], errs[i] = readChatChoice(results[i], opts, i)
+	})
+	if err := errors.Join(errs...); err != nil {
+		if clientDisconnected(c) {
+			logCancelledRequest(c, opts.Model)
+			return
+		}
 		c.JSON(http.StatusInternalServerError, ErrorResponse{
 			Error: struct {
 				Message string `json:"message"`
 				Type    string `json:"type"`
 				Details string `json:"details,omitempty"`
+				Code    string `json:"code,omitempty"`
 			}{
 				Message: "Error reading response body",
 				Type:    "server_error",
@@ -304,106 +345,33 @@ func handleNonStreamingResponse(c *gin.Context, response *http.Response, modelId
 		return
 	}
 
-	responseText := string(bodyBytes)
-	log.Printf("Raw response: %s", responseText)
+	record := getRequestRecord(c.Request.Context())
+	for i, result := range results {
+		record.setUsage(result.Request, usages[i])
+	}
+	usage := sumUsage(usages...)
 
-	// Parse the SSE format to extract the full text
-	fullText := parseSSEResponse(responseText)
-	
-	// If no text was extracted, try direct JSON parsing as fallback
-	if fullText == "" {
-		log.Println("No text extracted from SSE parsing, trying direct JSON parsing")
-		
-		// First, check if the response is a complete JSON object
-		var directJsonResponse map[string]interface{}
-		if err := json.Unmarshal(bodyBytes, &directJsonResponse); err == nil {
-			log.Println("Response is a valid JSON object, checking for content")
-			
-			// Check for various content fields
-			if extractedText := extractTextFromJSON(directJsonResponse); extractedText != "" {
-				log.Printf("Extracted text directly from JSON: %s", extractedText)
-				fullText = extractedText
-			}
-		}
-		
-		// If still no content, use a default message to indicate the issue
-		if fullText == "" {
-			log.Println("Warning: Could not extract any content from response")
-			fullText = "抱歉，无法提取响应内容。请尝试重新发送请求或联系管理员检查服务器日志。"
-		}
+	// With best_of, only the best n candidates are returned
+	finishReasons := make([]string, len(choices))
+	for i, choice := range choices {
+		finishReasons[i] = choice.FinishReason
 	}
+	best := make([]OpenAIChoice, 0, n)
+	for _, i := range pickBestOf(finishReasons, n) {
+		choice := choices[i]
+		choice.Index = len(best)
+		best = append(best, choice)
+	}
+	choices = best
 
 	// Convert to OpenAI format
 	openaiResponse := OpenAIChatResponse{
-		ID:      fmt.Sprintf("chatcmpl-%s", uuid.New().String()),
-		Object:  "chat.completion",
-		Created: time.Now().Unix(),
-		Model:   modelId,
-		Choices: []struct {
-			Index   int `json:"index"`
-			Message struct {
-				Role        string   `json:"role"`
-				Content     string   `json:"content"`
-				Refusal     *string  `json:"refusal"`
-				Annotations []string `json:"annotations"`
-			} `json:"message"`
-			Logprobs     *string `json:"logprobs"`
-			FinishReason string  `json:"finish_reason"`
-		}{
-			{
-				Index: 0,
-				Message: struct {
-					Role        string   `json:"role"`
-					Content     string   `json:"content"`
-					Refusal     *string  `json:"refusal"`
-					Annotations []string `json:"annotations"`
-				}{
-					Role:        "assistant",
-					Content:     fullText,
-					Refusal:     nil,
-					Annotations: []string{},
-				},
-				Logprobs:     nil,
-				FinishReason: "length",
-			},
-		},
-		Usage: struct {
-			PromptTokens        int `json:"prompt_tokens"`
-			CompletionTokens    int `json:"completion_tokens"`
-			TotalTokens         int `json:"total_tokens"`
-			PromptTokensDetails struct {
-				CachedTokens int `json:"cached_tokens"`
-				AudioTokens  int `json:"audio_tokens"`
-			} `json:"prompt_tokens_details"`
-			CompletionTokensDetails struct {
-				ReasoningTokens          int `json:"reasoning_tokens"`
-				AudioTokens              int `json:"audio_tokens"`
-				AcceptedPredictionTokens int `json:"accepted_prediction_tokens"`
-				RejectedPredictionTokens int `json:"rejected_prediction_tokens"`
-			} `json:"completion_tokens_details"`
-		}{
-			PromptTokens:     10,
-			CompletionTokens: 10,
-			TotalTokens:      20,
-			PromptTokensDetails: struct {
-				CachedTokens int `json:"cached_tokens"`
-				AudioTokens  int `json:"audio_tokens"`
-			}{
-				CachedTokens: 0,
-				AudioTokens:  0,
-			},
-			CompletionTokensDetails: struct {
-				ReasoningTokens          int `json:"reasoning_tokens"`
-				AudioTokens              int `json:"audio_tokens"`
-				AcceptedPredictionTokens int `json:"accepted_prediction_tokens"`
-				RejectedPredictionTokens int `json:"rejected_prediction_tokens"`
-			}{
-				ReasoningTokens:          0,
-				AudioTokens:              0,
-				AcceptedPredictionTokens: 0,
-				RejectedPredictionTokens: 0,
-			},
-		},
+		ID:                fmt.Sprintf("chatcmpl-%s", uuid.New().String()),
+		Object:            "chat.completion",
+		Created:           time.Now().Unix(),
+		Model:             opts.Model,
+		Choices:           choices,
+		Usage:             usage,
 		ServiceTier:       "default",
 		SystemFingerprint: "fp_b376dfbbd5",
 	}
@@ -415,6 +383,7 @@ func handleNonStreamingResponse(c *gin.Context, response *http.Response, modelId
 				Message string `json:"message"`
 				Type    string `json:"type"`
 				Details string `json:"details,omitempty"`
+				Code    string `json:"code,omitempty"`
 			}{
 				Message: "Error formatting JSON response",
 				Type:    "server_error",
@@ -431,6 +400,73 @@ func handleNonStreamingResponse(c *gin.Context, response *http.Response, modelId
 	c.Writer.Write(jsonData)
 }
 
+// readChatChoice reads a whole Raycast reply into a chat completion choice
+func readChatChoice(result relayResult, opts chatResponseOptions, index int) (OpenAIChoice, OpenAIUsage, error) {
+	opts.Model, opts.Request = result.Model, result.Request
+
+	// Collect the entire response
+	bodyBytes, err := io.ReadAll(result.Response.Body)
+	if err != nil {
+		return OpenAIChoice{}, OpenAIUsage{}, err
+	}
+
+	responseText := string(bodyBytes)
+	slog.Debug("Raw Raycast response", contentAttr("response", responseText))
+
+	// Parse the SSE format to extract the full text
+	reply := parseSSEResponse(responseText)
+	fullText := reply.Text
+	
+	// If no text was extracted, try direct JSON parsing as fallback
+	if fullText == "" {
+		slog.Debug("No text extracted from SSE parsing, trying direct JSON parsing")
+		
+		// First, check if the response is a complete JSON object
+		var directJsonResponse map[string]interface{}
+		if err := json.Unmarshal(bodyBytes, &directJsonResponse); err == nil {
+			
+			// Check for various content fields
+			if extractedText := extractTextFromJSON(directJsonResponse); extractedText != "" {
+				fullText = extractedText
+			}
+		}
+		
+		// If still no content, use a default message to indicate the issue
+		if fullText == "" {
+			slog.Warn("Could not extract any content from response", contentAttr("response", responseText))
+			fullText = "抱歉，无法提取响应内容。请尝试重新发送请求或联系管理员检查服务器日志。"
+		}
+	}
+
+	usage := buildUsage(opts.Request, fullText, reply.Usage)
+	logReply(opts, fullText, usage)
+
+	// Split tool call blocks out of the reply when tools were offered
+	var toolCalls []OpenAIToolCall
+	if opts.WithTools {
+		fullText, toolCalls = extractToolCalls(fullText)
+	}
+	finishReason := mapFinishReason(reply.FinishReason, len(toolCalls) > 0)
+
+	var content *string
+	if fullText != "" || len(toolCalls) == 0 {
+		content = &fullText
+	}
+
+	return OpenAIChoice{
+		Index: index,
+		Message: OpenAIResponseMessage{
+			Role:        "assistant",
+			Content:     content,
+			Refusal:     nil,
+			Annotations: []string{},
+			ToolCalls:   toolCalls,
+		},
+		Logprobs:     nil,
+		FinishReason: finishReason,
+	}, usage, nil
+}
+
 // Add a helper function to extract text from JSON
 func extractTextFromJSON(jsonData map[string]interface{}) string {
 	// Check for common patterns in the JSON response
@@ -465,7 +501,14 @@ func extractTextFromJSON(jsonData map[string]interface{}) string {
 		return text
 	}
 	
-	// Pattern 4: Check for completion field (some APIs use this)
+	// Pattern 4: Check for a nested message structure
+	if message, ok := jsonData["message"].(map[string]interface{}); ok {
+		if content, ok := message["content"].(string); ok && content != "" {
+			return content
+		}
+	}
+	
+	// Pattern 5: Check for completion field (some APIs use this)
 	if completion, ok := jsonData["completion"].(string); ok && completion != "" {
 		return completion
 	}
@@ -473,3 +516,71 @@ func extractTextFromJSON(jsonData map[string]interface{}) string {
 	// No content found
 	return ""
 }
+
+// stopSequenceFilter truncates streamed text at the first stop sequence,
+// holding back anything that may be the beginning of one
+type stopSequenceFilter struct {
+	stops   []string
+	buffer  string
+	matched string
+	done    bool
+}
+
+// newStopSequenceFilter creates a filter for the given stop sequences
+func newStopSequenceFilter(stops []string) *stopSequenceFilter {
+	filter := &stopSequenceFilter{}
+	for _, stop := range stops {
+		if stop != "" {
+			filter.stops = append(filter.stops, stop)
+		}
+	}
+	return filter
+}
+
+// Feed consumes a text delta and returns the text that is safe to emit
+func (f *stopSequenceFilter) Feed(delta string) string {
+	if f.done {
+		return ""
+	}
+	if len(f.stops) == 0 {
+		return delta
+	}
+	f.buffer += delta
+
+	// Cut at the earliest stop sequence
+	cut := -1
+	for _, stop := range f.stops {
+		if idx := strings.Index(f.buffer, stop); idx >= 0 && (cut < 0 || idx < cut) {
+			cut = idx
+			f.matched = stop
+		}
+	}
+	if cut >= 0 {
+		out := f.buffer[:cut]
+		f.buffer = ""
+		f.done = true
+		return out
+	}
+
+	keep := 0
+	for _, stop := range f.stops {
+		if n := partialTagSuffix(f.buffer, stop); n > keep {
+			keep = n
+		}
+	}
+	out := f.buffer[:len(f.buffer)-keep]
+	f.buffer = f.buffer[len(f.buffer)-keep:]
+	return out
+}
+
+// Flush returns any text still held back once the stream has ended
+func (f *stopSequenceFilter) Flush() string {
+	rest := f.buffer
+	f.buffer = ""
+	return rest
+}
+
+// Stopped reports whether a stop sequence was hit and which one
+func (f *stopSequenceFilter) Stopped() (string, bool) {
+	return f.matched, f.done
+}